@@ -1,13 +1,19 @@
-// Package cache provides a time cache implementation safe for concurrent use
-// without the need of additional locking.
+// Package cache provides time cache implementations safe for concurrent use
+// without the need of additional locking: TimeCache deduplicating entries and
+// TTLCache keeping arbitrary values with per-entry time-to-live.
 package cache
 
 import (
 	"container/list"
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ipfs/go-log"
+
+	"github.com/keep-network/keep-common/pkg/metrics"
 )
 
 var logger = log.Logger("keep-cache")
@@ -15,6 +21,12 @@ var logger = log.Logger("keep-cache")
 // TimeCache provides a time cache safe for concurrent use by
 // multiple goroutines without additional locking or coordination.
 type TimeCache struct {
+	// counters are updated atomically and kept at the beginning of the
+	// struct to be 64-bit aligned on 32-bit platforms
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
 	// all items in the cache in the order they were added
 	// most recent items are on the front of the indexer;
 	// it is used to optimize cache sweeping
@@ -26,6 +38,10 @@ type TimeCache struct {
 	// as outdated and can be removed from the cache
 	timespan time.Duration
 	mutex    sync.RWMutex
+
+	// storage the cache content is persisted to; nil if the cache is not
+	// persistent
+	storage *timeCacheStorage
 }
 
 // NewTimeCache creates a new cache instance with provided timespan.
@@ -37,6 +53,21 @@ func NewTimeCache(timespan time.Duration) *TimeCache {
 	}
 }
 
+// TimeCacheStats holds the counters of the cache usage.
+type TimeCacheStats struct {
+	// Hits is the number of lookups which found the entry in the cache,
+	// that is calls to Has returning `true` and calls to Add returning
+	// `false`.
+	Hits uint64
+	// Misses is the number of lookups which did not find the entry in the
+	// cache, that is calls to Has returning `false` and calls to Add
+	// returning `true`.
+	Misses uint64
+	// Evictions is the number of entries removed from the cache because
+	// their caching timespan has passed.
+	Evictions uint64
+}
+
 // Add adds an entry to the cache. Returns `true` if entry was not present in
 // the cache and was successfully added into it. Returns `false` if
 // entry is already in the cache. This method is synchronized.
@@ -44,12 +75,16 @@ func (tc *TimeCache) Add(item string) bool {
 	tc.mutex.Lock()
 	defer tc.mutex.Unlock()
 
+	// sweep first so that an outdated entry is not considered as present
+	tc.sweep()
+
 	_, ok := tc.cache[item]
 	if ok {
+		atomic.AddUint64(&tc.hits, 1)
 		return false
 	}
 
-	tc.sweep()
+	atomic.AddUint64(&tc.misses, 1)
 
 	tc.cache[item] = time.Now()
 	tc.indexer.PushFront(item)
@@ -57,13 +92,99 @@ func (tc *TimeCache) Add(item string) bool {
 }
 
 // Has checks presence of an entry in the cache. Returns `true` if entry is
-// present and `false` otherwise.
+// present and its caching timespan has not passed yet and `false` otherwise.
 func (tc *TimeCache) Has(item string) bool {
 	tc.mutex.RLock()
 	defer tc.mutex.RUnlock()
 
-	_, ok := tc.cache[item]
-	return ok
+	itemTime, ok := tc.cache[item]
+	if !ok || time.Since(itemTime) > tc.timespan {
+		atomic.AddUint64(&tc.misses, 1)
+		return false
+	}
+
+	atomic.AddUint64(&tc.hits, 1)
+	return true
+}
+
+// Stats returns the current values of the cache usage counters.
+func (tc *TimeCache) Stats() TimeCacheStats {
+	return TimeCacheStats{
+		Hits:      atomic.LoadUint64(&tc.hits),
+		Misses:    atomic.LoadUint64(&tc.misses),
+		Evictions: atomic.LoadUint64(&tc.evictions),
+	}
+}
+
+// StartSweeping triggers a cyclic sweep of old entries with the given
+// interval so that they are removed even if no new entries are added to
+// the cache. Sweeping stops when the context is done. An error is returned
+// if the interval is not positive.
+func (tc *TimeCache) StartSweeping(
+	ctx context.Context,
+	interval time.Duration,
+) error {
+	if interval <= 0 {
+		return fmt.Errorf("sweeping interval must be positive; has [%v]", interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tc.Sweep()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// RegisterMetrics registers the cache usage counters as gauges in the metrics
+// registry. Gauge names are the given name with `_hits`, `_misses` and
+// `_evictions` suffixes. Gauges are refreshed with the given tick until the
+// context is done.
+func (tc *TimeCache) RegisterMetrics(
+	ctx context.Context,
+	registry *metrics.Registry,
+	name string,
+	tick time.Duration,
+) error {
+	counters := map[string]*uint64{
+		"hits":      &tc.hits,
+		"misses":    &tc.misses,
+		"evictions": &tc.evictions,
+	}
+
+	observers := make([]*metrics.Observer, 0, len(counters))
+
+	for suffix, counter := range counters {
+		// capture shared loop variable for the closure
+		counter := counter
+
+		observer, err := registry.NewGaugeObserver(
+			fmt.Sprintf("%s_%s", name, suffix),
+			func() float64 {
+				return float64(atomic.LoadUint64(counter))
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("could not register cache metrics: [%v]", err)
+		}
+
+		observers = append(observers, observer)
+	}
+
+	for _, observer := range observers {
+		observer.Observe(ctx, tick)
+	}
+
+	return nil
 }
 
 // Sweep removes old entries. That is those for which caching timespan has
@@ -95,6 +216,7 @@ func (tc *TimeCache) sweep() {
 		if time.Since(itemTime) > tc.timespan {
 			tc.indexer.Remove(back)
 			delete(tc.cache, item)
+			atomic.AddUint64(&tc.evictions, 1)
 		} else {
 			break
 		}
@@ -1,10 +1,15 @@
 package cache
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/keep-network/keep-common/pkg/metrics"
 )
 
 func TestAdd(t *testing.T) {
@@ -67,3 +72,124 @@ func TestSweep(t *testing.T) {
 		t.Fatal("should still have 'new' in the cache")
 	}
 }
+
+func TestHasExpired(t *testing.T) {
+	cache := NewTimeCache(100 * time.Millisecond)
+	cache.Add("test")
+
+	time.Sleep(200 * time.Millisecond)
+
+	if cache.Has("test") {
+		t.Fatal("should not have expired 'test' key")
+	}
+
+	if !cache.Add("test") {
+		t.Fatal("should add expired 'test' key again")
+	}
+}
+
+func TestBackgroundSweeping(t *testing.T) {
+	cache := NewTimeCache(100 * time.Millisecond)
+	cache.Add("test")
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	err := cache.StartSweeping(ctx, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	cache.mutex.RLock()
+	size := len(cache.cache)
+	cache.mutex.RUnlock()
+
+	if size != 0 {
+		t.Fatalf("expected empty cache; has [%v] entries", size)
+	}
+}
+
+func TestBackgroundSweeping_InvalidInterval(t *testing.T) {
+	var tests = map[string]struct {
+		interval      time.Duration
+		expectedError error
+	}{
+		"zero interval": {
+			interval: 0,
+			expectedError: fmt.Errorf(
+				"sweeping interval must be positive; has [0s]",
+			),
+		},
+		"negative interval": {
+			interval: -time.Minute,
+			expectedError: fmt.Errorf(
+				"sweeping interval must be positive; has [-1m0s]",
+			),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancelCtx := context.WithCancel(context.Background())
+			defer cancelCtx()
+
+			err := NewTimeCache(time.Minute).StartSweeping(ctx, test.interval)
+			if !reflect.DeepEqual(test.expectedError, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					test.expectedError,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := NewTimeCache(100 * time.Millisecond)
+
+	cache.Add("test")  // miss
+	cache.Add("test")  // hit
+	cache.Has("test")  // hit
+	cache.Has("other") // miss
+
+	time.Sleep(200 * time.Millisecond)
+
+	cache.Has("test") // miss
+	cache.Sweep()     // eviction
+
+	expected := TimeCacheStats{Hits: 2, Misses: 3, Evictions: 1}
+	if !reflect.DeepEqual(expected, cache.Stats()) {
+		t.Fatalf(
+			"unexpected stats\nexpected: [%+v]\nactual:   [%+v]",
+			expected,
+			cache.Stats(),
+		)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	cache := NewTimeCache(time.Minute)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	registry := metrics.NewRegistry()
+
+	err := cache.RegisterMetrics(ctx, registry, "test_cache", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"test_cache_hits",
+		"test_cache_misses",
+		"test_cache_evictions",
+	} {
+		if _, err := registry.NewGauge(name); err == nil {
+			t.Errorf("gauge [%v] has not been registered", name)
+		}
+	}
+}
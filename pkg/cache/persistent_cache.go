@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keep-network/keep-common/pkg/persistence"
+)
+
+// persistedCacheVersion is the version of the persisted cache content format.
+const persistedCacheVersion = 1
+
+// timeCacheStorage describes where the content of the persistent cache is
+// kept.
+type timeCacheStorage struct {
+	handle    persistence.Handle
+	directory string
+	name      string
+
+	// ensures the content is not overwritten by an older one persisted
+	// concurrently
+	mutex sync.Mutex
+}
+
+type persistedCache struct {
+	Version int                   `json:"version"`
+	Entries []*persistedCacheItem `json:"entries"`
+}
+
+type persistedCacheItem struct {
+	Item    string    `json:"item"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// NewPersistentTimeCache creates a new cache instance with provided timespan
+// which content can be persisted under the given name in the provided
+// directory of the persistence handle. The content persisted before is
+// restored along with the time each entry has been added to the cache;
+// entries which caching timespan has already passed are dropped.
+func NewPersistentTimeCache(
+	timespan time.Duration,
+	handle persistence.Handle,
+	directory string,
+	name string,
+) (*TimeCache, error) {
+	tc := NewTimeCache(timespan)
+	tc.storage = &timeCacheStorage{
+		handle:    handle,
+		directory: directory,
+		name:      name,
+	}
+
+	if err := tc.restore(); err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// Persist saves the current content of the cache to the persistence handle.
+// It can be called only for caches created with NewPersistentTimeCache.
+func (tc *TimeCache) Persist() error {
+	if tc.storage == nil {
+		return fmt.Errorf("cache is not persistent")
+	}
+
+	tc.storage.mutex.Lock()
+	defer tc.storage.mutex.Unlock()
+
+	tc.mutex.RLock()
+	content := &persistedCache{
+		Version: persistedCacheVersion,
+		Entries: make([]*persistedCacheItem, 0, len(tc.cache)),
+	}
+	// from the oldest to the most recent entry
+	for element := tc.indexer.Back(); element != nil; element = element.Prev() {
+		item := element.Value.(string)
+		content.Entries = append(content.Entries, &persistedCacheItem{
+			Item:    item,
+			AddedAt: tc.cache[item],
+		})
+	}
+	tc.mutex.RUnlock()
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("could not serialize cache content: [%v]", err)
+	}
+
+	err = tc.storage.handle.Save(data, tc.storage.directory, tc.storage.name)
+	if err != nil {
+		return fmt.Errorf("could not persist cache content: [%v]", err)
+	}
+
+	return nil
+}
+
+// StartPersisting triggers a cyclic persisting of the cache content with the
+// given interval. The content is persisted for the last time once the
+// context is done, so the context should be cancelled at shutdown. The
+// returned channel is closed once the last persisting completes. An error is
+// returned if the interval is not positive.
+func (tc *TimeCache) StartPersisting(
+	ctx context.Context,
+	interval time.Duration,
+) (<-chan struct{}, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf(
+			"persisting interval must be positive; has [%v]",
+			interval,
+		)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := tc.Persist(); err != nil {
+					logger.Errorf("could not persist cache: [%v]", err)
+				}
+			case <-ctx.Done():
+				if err := tc.Persist(); err != nil {
+					logger.Errorf("could not persist cache: [%v]", err)
+				}
+				return
+			}
+		}
+	}()
+
+	return done, nil
+}
+
+func (tc *TimeCache) restore() error {
+	names, err := tc.storage.handle.List(tc.storage.directory)
+	if err != nil {
+		return fmt.Errorf("could not list persisted cache: [%v]", err)
+	}
+
+	persisted := false
+	for _, name := range names {
+		if name == tc.storage.name {
+			persisted = true
+			break
+		}
+	}
+
+	if !persisted {
+		return nil
+	}
+
+	data, err := tc.storage.handle.Read(tc.storage.directory, tc.storage.name)
+	if err != nil {
+		return fmt.Errorf("could not read persisted cache: [%v]", err)
+	}
+
+	content := &persistedCache{}
+	if err := json.Unmarshal(data, content); err != nil {
+		return fmt.Errorf("could not parse persisted cache: [%v]", err)
+	}
+
+	if content.Version != persistedCacheVersion {
+		return fmt.Errorf(
+			"unsupported persisted cache version [%v]",
+			content.Version,
+		)
+	}
+
+	sort.SliceStable(content.Entries, func(i, j int) bool {
+		return content.Entries[i].AddedAt.Before(content.Entries[j].AddedAt)
+	})
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	for _, entry := range content.Entries {
+		if time.Since(entry.AddedAt) > tc.timespan {
+			continue
+		}
+
+		if _, ok := tc.cache[entry.Item]; ok {
+			continue
+		}
+
+		tc.cache[entry.Item] = entry.AddedAt
+		tc.indexer.PushFront(entry.Item)
+	}
+
+	return nil
+}
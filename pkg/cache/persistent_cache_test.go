@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/keep-network/keep-common/pkg/persistence"
+)
+
+func TestPersistentTimeCache(t *testing.T) {
+	handle := persistence.NewMemoryHandle()
+
+	cache, err := NewPersistentTimeCache(time.Minute, handle, "cache", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Add("first")
+	cache.Add("second")
+
+	if err := cache.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewPersistentTimeCache(time.Minute, handle, "cache", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []string{"first", "second"} {
+		if !restored.Has(item) {
+			t.Errorf("should have restored '%v' key", item)
+		}
+	}
+
+	if restored.Add("first") {
+		t.Fatal("should not add restored 'first' key again")
+	}
+}
+
+func TestPersistentTimeCacheDropExpired(t *testing.T) {
+	handle := persistence.NewMemoryHandle()
+
+	newAddedAt := time.Now().Add(-30 * time.Second)
+
+	data, err := json.Marshal(&persistedCache{
+		Version: persistedCacheVersion,
+		Entries: []*persistedCacheItem{
+			{Item: "old", AddedAt: time.Now().Add(-2 * time.Minute)},
+			{Item: "new", AddedAt: newAddedAt},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handle.Save(data, "cache", "seen"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewPersistentTimeCache(time.Minute, handle, "cache", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Has("old") {
+		t.Fatal("should have dropped 'old' key from the cache")
+	}
+	if !cache.Has("new") {
+		t.Fatal("should have restored 'new' key")
+	}
+
+	// the original insertion time is kept
+	cache.mutex.RLock()
+	addedAt := cache.cache["new"]
+	cache.mutex.RUnlock()
+	if !addedAt.Equal(newAddedAt) {
+		t.Fatalf(
+			"unexpected insertion time\nexpected: [%v]\nactual:   [%v]",
+			newAddedAt,
+			addedAt,
+		)
+	}
+}
+
+func TestPersistAtShutdown(t *testing.T) {
+	handle := persistence.NewMemoryHandle()
+
+	cache, err := NewPersistentTimeCache(time.Minute, handle, "cache", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	done, err := cache.StartPersisting(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Add("test")
+
+	cancelCtx()
+	<-done
+
+	restored, err := NewPersistentTimeCache(time.Minute, handle, "cache", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !restored.Has("test") {
+		t.Fatal("should have restored 'test' key")
+	}
+}
+
+func TestStartPersisting_InvalidInterval(t *testing.T) {
+	var tests = map[string]struct {
+		interval      time.Duration
+		expectedError error
+	}{
+		"zero interval": {
+			interval: 0,
+			expectedError: fmt.Errorf(
+				"persisting interval must be positive; has [0s]",
+			),
+		},
+		"negative interval": {
+			interval: -time.Minute,
+			expectedError: fmt.Errorf(
+				"persisting interval must be positive; has [-1m0s]",
+			),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			cache, err := NewPersistentTimeCache(
+				time.Minute,
+				persistence.NewMemoryHandle(),
+				"cache",
+				"seen",
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancelCtx := context.WithCancel(context.Background())
+			defer cancelCtx()
+
+			_, err = cache.StartPersisting(ctx, test.interval)
+			if !reflect.DeepEqual(test.expectedError, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					test.expectedError,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestPersistNonPersistentCache(t *testing.T) {
+	if err := NewTimeCache(time.Minute).Persist(); err == nil {
+		t.Fatal("expected error for non-persistent cache")
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultShardCount is the number of shards used when the number of shards
+// provided is not positive.
+const defaultShardCount = 32
+
+// ShardedTimeCache provides a time cache with the same semantics as
+// TimeCache but partitioned into multiple shards by the hash of the entry.
+// Each shard has its own lock, indexer and sweeping so concurrent calls for
+// entries from different shards do not contend for one lock. It is meant for
+// high-contention workloads.
+type ShardedTimeCache struct {
+	shards []*TimeCache
+}
+
+// NewShardedTimeCache creates a new cache instance with provided timespan
+// partitioned into the given number of shards. If the number of shards is
+// not positive, the default number of shards is used.
+func NewShardedTimeCache(timespan time.Duration, shards int) *ShardedTimeCache {
+	if shards <= 0 {
+		shards = defaultShardCount
+	}
+
+	stc := &ShardedTimeCache{
+		shards: make([]*TimeCache, shards),
+	}
+
+	for i := range stc.shards {
+		stc.shards[i] = NewTimeCache(timespan)
+	}
+
+	return stc
+}
+
+// Add adds an entry to the cache. Returns `true` if entry was not present in
+// the cache and was successfully added into it. Returns `false` if
+// entry is already in the cache. Only the shard of the entry is swept.
+func (stc *ShardedTimeCache) Add(item string) bool {
+	return stc.shard(item).Add(item)
+}
+
+// Has checks presence of an entry in the cache. Returns `true` if entry is
+// present and its caching timespan has not passed yet and `false` otherwise.
+func (stc *ShardedTimeCache) Has(item string) bool {
+	return stc.shard(item).Has(item)
+}
+
+// Sweep removes old entries from all the shards, one shard at a time.
+func (stc *ShardedTimeCache) Sweep() {
+	for _, shard := range stc.shards {
+		shard.Sweep()
+	}
+}
+
+// Stats returns the current values of the cache usage counters summed over
+// all the shards.
+func (stc *ShardedTimeCache) Stats() TimeCacheStats {
+	stats := TimeCacheStats{}
+
+	for _, shard := range stc.shards {
+		shardStats := shard.Stats()
+		stats.Hits += shardStats.Hits
+		stats.Misses += shardStats.Misses
+		stats.Evictions += shardStats.Evictions
+	}
+
+	return stats
+}
+
+// StartSweeping triggers a cyclic sweep of old entries from all the shards
+// with the given interval. Sweeping stops when the context is done. An error
+// is returned if the interval is not positive.
+func (stc *ShardedTimeCache) StartSweeping(
+	ctx context.Context,
+	interval time.Duration,
+) error {
+	if interval <= 0 {
+		return fmt.Errorf("sweeping interval must be positive; has [%v]", interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				stc.Sweep()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (stc *ShardedTimeCache) shard(item string) *TimeCache {
+	return stc.shards[fnv32a(item)%uint32(len(stc.shards))]
+}
+
+// fnv32a computes the 32-bit FNV-1a hash of the string without allocating.
+func fnv32a(item string) uint32 {
+	const (
+		offsetBasis = 2166136261
+		prime       = 16777619
+	)
+
+	hash := uint32(offsetBasis)
+	for i := 0; i < len(item); i++ {
+		hash ^= uint32(item[i])
+		hash *= prime
+	}
+
+	return hash
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedAdd(t *testing.T) {
+	cache := NewShardedTimeCache(time.Minute, 4)
+
+	if !cache.Add("test") {
+		t.Fatal("should add 'test' key")
+	}
+
+	if cache.Add("test") {
+		t.Fatal("should not add 'test' key again")
+	}
+
+	if !cache.Has("test") {
+		t.Fatal("should have 'test' key")
+	}
+}
+
+func TestShardedConcurrentAdd(t *testing.T) {
+	cache := NewShardedTimeCache(time.Minute, 4)
+
+	var wg sync.WaitGroup
+	wg.Add(100)
+
+	for i := 0; i < 100; i++ {
+		go func(item int) {
+			cache.Add(strconv.Itoa(item))
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		if !cache.Has(strconv.Itoa(i)) {
+			t.Fatalf("should have '%v' key", i)
+		}
+	}
+}
+
+func TestShardedSweep(t *testing.T) {
+	cache := NewShardedTimeCache(500*time.Millisecond, 4)
+	for i := 0; i < 10; i++ {
+		cache.Add("old" + strconv.Itoa(i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	cache.Add("new")
+	time.Sleep(400 * time.Millisecond)
+
+	cache.Sweep()
+
+	for i := 0; i < 10; i++ {
+		if cache.Has("old" + strconv.Itoa(i)) {
+			t.Fatalf("should have dropped 'old%v' key from the cache", i)
+		}
+	}
+	if !cache.Has("new") {
+		t.Fatal("should still have 'new' in the cache")
+	}
+
+	if evictions := cache.Stats().Evictions; evictions != 10 {
+		t.Fatalf("unexpected number of evictions: [%v]", evictions)
+	}
+}
+
+func TestShardedBackgroundSweeping(t *testing.T) {
+	cache := NewShardedTimeCache(100*time.Millisecond, 4)
+	for i := 0; i < 10; i++ {
+		cache.Add(strconv.Itoa(i))
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	err := cache.StartSweeping(ctx, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	for _, shard := range cache.shards {
+		shard.mutex.RLock()
+		size := len(shard.cache)
+		shard.mutex.RUnlock()
+
+		if size != 0 {
+			t.Fatalf("expected empty shard; has [%v] entries", size)
+		}
+	}
+}
+
+func TestShardedBackgroundSweeping_InvalidInterval(t *testing.T) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	err := NewShardedTimeCache(time.Minute, 4).StartSweeping(ctx, 0)
+	expectedError := fmt.Errorf("sweeping interval must be positive; has [0s]")
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+}
+
+func TestShardedDefaultShardCount(t *testing.T) {
+	cache := NewShardedTimeCache(time.Minute, 0)
+
+	if len(cache.shards) != defaultShardCount {
+		t.Fatalf("unexpected number of shards: [%v]", len(cache.shards))
+	}
+}
+
+func TestFnv32a(t *testing.T) {
+	for _, item := range []string{"", "a", "test", "0x424242"} {
+		hash := fnv.New32a()
+		hash.Write([]byte(item))
+
+		if fnv32a(item) != hash.Sum32() {
+			t.Errorf("unexpected hash of [%v]", item)
+		}
+	}
+}
+
+func BenchmarkTimeCacheAdd(b *testing.B) {
+	benchmarkAdd(b, NewTimeCache(time.Minute))
+}
+
+func BenchmarkShardedTimeCacheAdd(b *testing.B) {
+	benchmarkAdd(b, NewShardedTimeCache(time.Minute, defaultShardCount))
+}
+
+func BenchmarkTimeCacheAddAndHas(b *testing.B) {
+	benchmarkAddAndHas(b, NewTimeCache(time.Minute))
+}
+
+func BenchmarkShardedTimeCacheAddAndHas(b *testing.B) {
+	benchmarkAddAndHas(b, NewShardedTimeCache(time.Minute, defaultShardCount))
+}
+
+type benchmarkedCache interface {
+	Add(item string) bool
+	Has(item string) bool
+}
+
+// benchmarkAdd adds unique entries from multiple goroutines.
+func benchmarkAdd(b *testing.B, cache benchmarkedCache) {
+	var counter uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Add(strconv.FormatUint(atomic.AddUint64(&counter, 1), 10))
+		}
+	})
+}
+
+// benchmarkAddAndHas adds entries and checks their presence from multiple
+// goroutines, as it happens for broadcast channel message deduplication.
+func benchmarkAddAndHas(b *testing.B, cache benchmarkedCache) {
+	var counter uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			item := strconv.FormatUint(atomic.AddUint64(&counter, 1)%10000, 10)
+			if !cache.Has(item) {
+				cache.Add(item)
+			}
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EvictionReason describes why an entry has been evicted from the cache.
+type EvictionReason int
+
+const (
+	// Expired means the time-to-live of the entry has passed.
+	Expired EvictionReason = iota
+	// Capacity means the entry has been the least recently used one when
+	// the maximum size of the cache has been reached.
+	Capacity
+)
+
+// EvictionCallback is called for each entry evicted from the cache. It is
+// not called for entries removed with Delete or replaced with Put. The
+// callback is called without holding the cache lock so it is safe to use
+// the cache from within the callback.
+type EvictionCallback func(key string, value interface{}, reason EvictionReason)
+
+// TTLCache provides a cache of arbitrary values with per-entry time-to-live
+// safe for concurrent use by multiple goroutines without additional locking
+// or coordination. Optionally, the number of entries can be limited in which
+// case the least recently used entry is evicted when the limit is reached.
+// Just like TimeCache, expired entries are swept on write.
+type TTLCache struct {
+	// all entries in the cache in the order they were used;
+	// most recently used entries are on the front of the list
+	recency *list.List
+	// entries with time-to-live ordered by the expiration time;
+	// it is used to optimize cache sweeping
+	expiry expiryHeap
+	cache  map[string]*ttlEntry
+	// the maximum number of entries in the cache; zero means no limit
+	maxSize int
+	onEvict EvictionCallback
+	mutex   sync.Mutex
+}
+
+type ttlEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+	// the element of the recency list holding the entry key
+	element *list.Element
+	// the index of the entry in the expiry heap; -1 if the entry does not
+	// expire
+	heapIndex int
+}
+
+func (te *ttlEntry) expires() bool {
+	return te.heapIndex >= 0
+}
+
+func (te *ttlEntry) isExpired(now time.Time) bool {
+	return te.expires() && !now.Before(te.expiresAt)
+}
+
+type eviction struct {
+	entry  *ttlEntry
+	reason EvictionReason
+}
+
+// NewTTLCache creates a new cache instance holding at most maxSize entries.
+// Zero maxSize means the number of entries is not limited. The eviction
+// callback is optional and may be nil.
+func NewTTLCache(maxSize int, onEvict EvictionCallback) *TTLCache {
+	return &TTLCache{
+		recency: list.New(),
+		expiry:  make(expiryHeap, 0),
+		cache:   make(map[string]*ttlEntry),
+		maxSize: maxSize,
+		onEvict: onEvict,
+	}
+}
+
+// Put adds the value to the cache under the given key replacing the value
+// already present under that key, if any. The entry expires after the given
+// time-to-live; zero or negative time-to-live means the entry never expires.
+// This method is synchronized.
+func (tc *TTLCache) Put(key string, value interface{}, ttl time.Duration) {
+	tc.notify(tc.put(key, value, ttl))
+}
+
+func (tc *TTLCache) put(
+	key string,
+	value interface{},
+	ttl time.Duration,
+) []*eviction {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	now := time.Now()
+
+	if entry, ok := tc.cache[key]; ok {
+		tc.remove(entry)
+	}
+
+	evictions := tc.sweep(now)
+
+	entry := &ttlEntry{
+		key:       key,
+		value:     value,
+		heapIndex: -1,
+	}
+	entry.element = tc.recency.PushFront(entry)
+	tc.cache[key] = entry
+
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+		heap.Push(&tc.expiry, entry)
+	}
+
+	for tc.maxSize > 0 && len(tc.cache) > tc.maxSize {
+		leastRecent := tc.recency.Back().Value.(*ttlEntry)
+		tc.remove(leastRecent)
+
+		evictions = append(evictions, &eviction{leastRecent, Capacity})
+	}
+
+	return evictions
+}
+
+// Get returns the value present in the cache under the given key and marks
+// the entry as the most recently used one. Returns `false` if there is no
+// such entry or if it has already expired.
+func (tc *TTLCache) Get(key string) (interface{}, bool) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	entry, ok := tc.cache[key]
+	if !ok || entry.isExpired(time.Now()) {
+		return nil, false
+	}
+
+	tc.recency.MoveToFront(entry.element)
+
+	return entry.value, true
+}
+
+// Delete removes the entry with the given key from the cache. Returns `true`
+// if the entry was present in the cache and `false` otherwise.
+func (tc *TTLCache) Delete(key string) bool {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	entry, ok := tc.cache[key]
+	if !ok {
+		return false
+	}
+
+	expired := entry.isExpired(time.Now())
+
+	tc.remove(entry)
+
+	return !expired
+}
+
+// Len returns the number of entries in the cache which have not expired.
+func (tc *TTLCache) Len() int {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	now := time.Now()
+
+	expired := 0
+	for _, entry := range tc.expiry {
+		if entry.isExpired(now) {
+			expired++
+		}
+	}
+
+	return len(tc.cache) - expired
+}
+
+// Sweep removes expired entries. That is those for which time-to-live has
+// passed.
+func (tc *TTLCache) Sweep() {
+	tc.mutex.Lock()
+	evictions := tc.sweep(time.Now())
+	tc.mutex.Unlock()
+
+	tc.notify(evictions)
+}
+
+func (tc *TTLCache) sweep(now time.Time) []*eviction {
+	var evictions []*eviction
+
+	for len(tc.expiry) > 0 && tc.expiry[0].isExpired(now) {
+		entry := tc.expiry[0]
+		tc.remove(entry)
+
+		evictions = append(evictions, &eviction{entry, Expired})
+	}
+
+	return evictions
+}
+
+func (tc *TTLCache) remove(entry *ttlEntry) {
+	if entry.expires() {
+		heap.Remove(&tc.expiry, entry.heapIndex)
+	}
+	tc.recency.Remove(entry.element)
+	delete(tc.cache, entry.key)
+}
+
+// notify calls the eviction callback for all the evictions. It must be
+// called without holding the cache lock.
+func (tc *TTLCache) notify(evictions []*eviction) {
+	if tc.onEvict == nil {
+		return
+	}
+
+	for _, eviction := range evictions {
+		tc.onEvict(eviction.entry.key, eviction.entry.value, eviction.reason)
+	}
+}
+
+// expiryHeap implements heap.Interface ordering entries by the expiration
+// time, the earliest expiring entry first.
+type expiryHeap []*ttlEntry
+
+func (eh expiryHeap) Len() int {
+	return len(eh)
+}
+
+func (eh expiryHeap) Less(i, j int) bool {
+	return eh[i].expiresAt.Before(eh[j].expiresAt)
+}
+
+func (eh expiryHeap) Swap(i, j int) {
+	eh[i], eh[j] = eh[j], eh[i]
+	eh[i].heapIndex = i
+	eh[j].heapIndex = j
+}
+
+func (eh *expiryHeap) Push(x interface{}) {
+	entry := x.(*ttlEntry)
+	entry.heapIndex = len(*eh)
+	*eh = append(*eh, entry)
+}
+
+func (eh *expiryHeap) Pop() interface{} {
+	old := *eh
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.heapIndex = -1
+	*eh = old[:n-1]
+	return entry
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTTLCachePutAndGet(t *testing.T) {
+	cache := NewTTLCache(0, nil)
+
+	cache.Put("test", 1, time.Minute)
+
+	value, ok := cache.Get("test")
+	if !ok {
+		t.Fatal("should have 'test' key")
+	}
+	if value != 1 {
+		t.Fatalf("unexpected value: [%v]", value)
+	}
+
+	cache.Put("test", "replaced", time.Minute)
+
+	value, ok = cache.Get("test")
+	if !ok || value != "replaced" {
+		t.Fatalf("unexpected value: [%v]", value)
+	}
+
+	if cache.Len() != 1 {
+		t.Fatalf("unexpected length: [%v]", cache.Len())
+	}
+}
+
+func TestTTLCacheDelete(t *testing.T) {
+	cache := NewTTLCache(0, nil)
+
+	cache.Put("test", 1, time.Minute)
+
+	if !cache.Delete("test") {
+		t.Fatal("should have deleted 'test' key")
+	}
+
+	if _, ok := cache.Get("test"); ok {
+		t.Fatal("should not have 'test' key")
+	}
+
+	if cache.Delete("test") {
+		t.Fatal("should not have deleted missing 'test' key")
+	}
+}
+
+func TestTTLCacheConcurrentPut(t *testing.T) {
+	cache := NewTTLCache(0, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(10)
+
+	for i := 0; i < 10; i++ {
+		go func(item int) {
+			cache.Put(strconv.Itoa(item), item, time.Minute)
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if value, ok := cache.Get(strconv.Itoa(i)); !ok || value != i {
+			t.Fatalf("should have '%v' key", i)
+		}
+	}
+}
+
+func TestTTLCachePerEntryExpiration(t *testing.T) {
+	cache := NewTTLCache(0, nil)
+
+	cache.Put("short", 1, 100*time.Millisecond)
+	cache.Put("long", 2, time.Minute)
+	cache.Put("forever", 3, 0)
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, ok := cache.Get("short"); ok {
+		t.Fatal("should have expired 'short' key")
+	}
+	if _, ok := cache.Get("long"); !ok {
+		t.Fatal("should have 'long' key")
+	}
+	if _, ok := cache.Get("forever"); !ok {
+		t.Fatal("should have 'forever' key")
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("unexpected length: [%v]", cache.Len())
+	}
+}
+
+func TestTTLCacheSweep(t *testing.T) {
+	var evicted []string
+
+	cache := NewTTLCache(0, func(key string, value interface{}, reason EvictionReason) {
+		if reason != Expired {
+			t.Errorf("unexpected eviction reason: [%v]", reason)
+		}
+		evicted = append(evicted, key)
+	})
+
+	cache.Put("second", 2, 200*time.Millisecond)
+	cache.Put("first", 1, 100*time.Millisecond)
+	cache.Put("third", 3, time.Minute)
+
+	time.Sleep(300 * time.Millisecond)
+
+	// expired entries are swept on write
+	cache.Put("new", 4, time.Minute)
+
+	expected := []string{"first", "second"}
+	if !reflect.DeepEqual(expected, evicted) {
+		t.Fatalf(
+			"unexpected evicted keys\nexpected: [%v]\nactual:   [%v]",
+			expected,
+			evicted,
+		)
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("unexpected length: [%v]", cache.Len())
+	}
+}
+
+func TestTTLCacheEvictLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+
+	cache := NewTTLCache(2, func(key string, value interface{}, reason EvictionReason) {
+		if reason != Capacity {
+			t.Errorf("unexpected eviction reason: [%v]", reason)
+		}
+		evicted = append(evicted, key)
+	})
+
+	cache.Put("a", 1, time.Minute)
+	cache.Put("b", 2, 0)
+
+	// "a" becomes the most recently used entry
+	cache.Get("a")
+
+	cache.Put("c", 3, time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("should have evicted 'b' key")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("should have 'a' key")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("should have 'c' key")
+	}
+
+	expected := []string{"b"}
+	if !reflect.DeepEqual(expected, evicted) {
+		t.Fatalf(
+			"unexpected evicted keys\nexpected: [%v]\nactual:   [%v]",
+			expected,
+			evicted,
+		)
+	}
+}
+
+func TestTTLCacheUseFromEvictionCallback(t *testing.T) {
+	var cache *TTLCache
+	cache = NewTTLCache(1, func(key string, value interface{}, reason EvictionReason) {
+		// the callback is called without holding the lock
+		cache.Len()
+	})
+
+	cache.Put("a", 1, time.Minute)
+	cache.Put("b", 2, time.Minute)
+}
@@ -1,6 +1,7 @@
 package chainutil
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipfs/go-log"
@@ -13,6 +14,12 @@ type BlockHeightWaiter interface {
 	WaitForBlockHeight(blockNumber uint64) error
 }
 
+// BlockHeightWaiterWithContext provides the ability to wait for a given block
+// height. Waiting is aborted with an error once the provided context is done.
+type BlockHeightWaiterWithContext interface {
+	WaitForBlockHeightWithContext(ctx context.Context, blockNumber uint64) error
+}
+
 // WaitForBlockConfirmations ensures that after receiving specific number of block
 // confirmations the state of the chain is actually as expected. It waits for
 // predefined number of blocks since the start block number provided. After the
@@ -23,11 +30,48 @@ func WaitForBlockConfirmations(
 	startBlockNumber uint64,
 	blockConfirmations uint64,
 	stateCheck func() (bool, error),
+) (bool, error) {
+	return waitForBlockConfirmations(
+		blockHeightWaiter.WaitForBlockHeight,
+		startBlockNumber,
+		blockConfirmations,
+		stateCheck,
+	)
+}
+
+// WaitForBlockConfirmationsWithContext works as WaitForBlockConfirmations but
+// an error is returned if the context is done before the required block
+// number is reached.
+func WaitForBlockConfirmationsWithContext(
+	ctx context.Context,
+	blockHeightWaiter BlockHeightWaiterWithContext,
+	startBlockNumber uint64,
+	blockConfirmations uint64,
+	stateCheck func() (bool, error),
+) (bool, error) {
+	return waitForBlockConfirmations(
+		func(blockNumber uint64) error {
+			return blockHeightWaiter.WaitForBlockHeightWithContext(
+				ctx,
+				blockNumber,
+			)
+		},
+		startBlockNumber,
+		blockConfirmations,
+		stateCheck,
+	)
+}
+
+func waitForBlockConfirmations(
+	waitForBlockHeight func(blockNumber uint64) error,
+	startBlockNumber uint64,
+	blockConfirmations uint64,
+	stateCheck func() (bool, error),
 ) (bool, error) {
 	blockHeight := startBlockNumber + blockConfirmations
 	logger.Infof("waiting for block [%d] to confirm chain state", blockHeight)
 
-	err := blockHeightWaiter.WaitForBlockHeight(blockHeight)
+	err := waitForBlockHeight(blockHeight)
 	if err != nil {
 		return false, fmt.Errorf("failed to wait for block height: [%v]", err)
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/ethereum/go-ethereum"
+	"math/big"
 	"strconv"
 	"sync"
 	"time"
@@ -11,20 +12,85 @@ import (
 	"github.com/ipfs/go-log"
 
 	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/keep-network/keep-common/pkg/diagnostics"
 )
 
 var logger = log.Logger("keep-block-counter")
 
+// recentBlocksLimit is the number of the most recent block hashes tracked to
+// detect chain reorganizations. Reorganizations deeper than that are reported
+// with an unknown fork point.
+const recentBlocksLimit = 128
+
+const (
+	// DefaultPollingInterval is the interval in which the latest block is
+	// polled when subscriptions to new blocks are not available.
+	DefaultPollingInterval = 10 * time.Second
+	// DefaultResubscribeInterval is the interval in which the subscription to
+	// new blocks is retried after it failed.
+	DefaultResubscribeInterval = 5 * time.Second
+)
+
+// Config represents the configuration of the block counter.
+type Config struct {
+	// PollingInterval is the interval in which the latest block is polled
+	// when subscriptions to new blocks are not available. If not set,
+	// DefaultPollingInterval is used.
+	PollingInterval time.Duration
+
+	// ResubscribeInterval is the interval in which the subscription to new
+	// blocks is retried after it failed. If not set,
+	// DefaultResubscribeInterval is used.
+	ResubscribeInterval time.Duration
+}
+
+// Mode describes how the block counter receives new blocks.
+type Mode int
+
+const (
+	// SubscriptionMode means new blocks are pushed by the Ethereum client
+	// over the subscription.
+	SubscriptionMode Mode = iota
+	// PollingMode means the latest block is periodically requested from the
+	// Ethereum client because the subscription is not available.
+	PollingMode
+)
+
+func (m Mode) String() string {
+	switch m {
+	case SubscriptionMode:
+		return "subscription"
+	case PollingMode:
+		return "polling"
+	default:
+		return "unknown"
+	}
+}
+
 type EthereumBlockCounter struct {
 	structMutex         sync.Mutex
 	latestBlockHeight   uint64
 	subscriptionChannel chan block
 	waiters             map[uint64][]chan uint64
 	watchers            []*watcher
+	reorgWatchers       []*reorgWatcher
+	mode                Mode
+
+	// recentBlocks maps heights of the most recent blocks to their hashes
+	recentBlocks      map[uint64]string
+	recentBlocksMutex sync.Mutex
+	// fetchBlock returns the block of the given height from the canonical
+	// chain; it is used to find the fork point of the reorganization
+	fetchBlock func(number uint64) (*block, error)
+	// reorgMutex serializes searches for fork points of reorganizations
+	reorgMutex sync.Mutex
 }
 
 type block struct {
-	Number string
+	Number     string
+	Hash       string
+	ParentHash string
 }
 
 type watcher struct {
@@ -32,18 +98,94 @@ type watcher struct {
 	channel chan uint64
 }
 
+// Reorg describes a chain reorganization observed by the block counter.
+type Reorg struct {
+	// Block is the height of the block which revealed the reorganization.
+	Block uint64
+	// ForkPointKnown is false if the fork point could not be determined,
+	// for example, because blocks of the new chain could not be fetched or
+	// the reorganization is deeper than the tracked blocks. ForkPoint and
+	// Depth are zero then.
+	ForkPointKnown bool
+	// ForkPoint is the height of the last block common to the abandoned and
+	// the new chain.
+	ForkPoint uint64
+	// Depth is the number of blocks of the abandoned chain above the fork
+	// point.
+	Depth uint64
+}
+
+type reorgWatcher struct {
+	ctx     context.Context
+	channel chan Reorg
+}
+
+func newBlock(header *types.Header) block {
+	return block{
+		Number:     header.Number.String(),
+		Hash:       header.Hash().Hex(),
+		ParentHash: header.ParentHash.Hex(),
+	}
+}
+
 func (ebc *EthereumBlockCounter) WaitForBlockHeight(blockNumber uint64) error {
-	waiter, err := ebc.BlockHeightWaiter(blockNumber)
+	return ebc.WaitForBlockHeightWithContext(context.Background(), blockNumber)
+}
+
+// WaitForBlockHeightWithContext blocks until the given block height is
+// reached or the context is done. In the latter case, the context error is
+// returned.
+func (ebc *EthereumBlockCounter) WaitForBlockHeightWithContext(
+	ctx context.Context,
+	blockNumber uint64,
+) error {
+	waiter, err := ebc.BlockHeightWaiterWithContext(ctx, blockNumber)
 	if err != nil {
 		return err
 	}
-	<-waiter
-	return nil
+
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (ebc *EthereumBlockCounter) BlockHeightWaiter(
 	blockNumber uint64,
 ) (<-chan uint64, error) {
+	return ebc.addWaiter(blockNumber), nil
+}
+
+// BlockHeightWaiterWithContext returns a channel receiving the block height
+// once it is reached. When the context is done before that, the waiter is
+// removed and the channel never receives a value.
+func (ebc *EthereumBlockCounter) BlockHeightWaiterWithContext(
+	ctx context.Context,
+	blockNumber uint64,
+) (<-chan uint64, error) {
+	waiter := ebc.addWaiter(blockNumber)
+	result := make(chan uint64, 1)
+
+	go func() {
+		select {
+		case height := <-waiter:
+			result <- height
+		case <-ctx.Done():
+			if !ebc.removeWaiter(blockNumber, waiter) {
+				// the waiter has already been triggered so the pending
+				// notification has to be received to not leak the goroutine
+				// sending it
+				<-waiter
+			}
+		}
+	}()
+
+	return result, nil
+}
+
+func (ebc *EthereumBlockCounter) addWaiter(blockNumber uint64) chan uint64 {
 	newWaiter := make(chan uint64)
 
 	ebc.structMutex.Lock()
@@ -60,10 +202,41 @@ func (ebc *EthereumBlockCounter) BlockHeightWaiter(
 		ebc.waiters[blockNumber] = append(waiterList, newWaiter)
 	}
 
-	return newWaiter, nil
+	return newWaiter
+}
+
+// removeWaiter removes the waiter for the given block height. It returns
+// false if the waiter was not found because it has already been triggered.
+func (ebc *EthereumBlockCounter) removeWaiter(
+	blockNumber uint64,
+	waiter chan uint64,
+) bool {
+	ebc.structMutex.Lock()
+	defer ebc.structMutex.Unlock()
+
+	waiterList := ebc.waiters[blockNumber]
+	for i, w := range waiterList {
+		if w == waiter {
+			waiterList[i] = waiterList[len(waiterList)-1]
+			waiterList = waiterList[:len(waiterList)-1]
+
+			if len(waiterList) == 0 {
+				delete(ebc.waiters, blockNumber)
+			} else {
+				ebc.waiters[blockNumber] = waiterList
+			}
+
+			return true
+		}
+	}
+
+	return false
 }
 
 func (ebc *EthereumBlockCounter) CurrentBlock() (uint64, error) {
+	ebc.structMutex.Lock()
+	defer ebc.structMutex.Unlock()
+
 	return ebc.latestBlockHeight, nil
 }
 
@@ -94,6 +267,82 @@ func (ebc *EthereumBlockCounter) WatchBlocks(ctx context.Context) <-chan uint64
 	return watcher.channel
 }
 
+// Mode returns the mode in which the block counter currently receives new
+// blocks.
+func (ebc *EthereumBlockCounter) Mode() Mode {
+	ebc.structMutex.Lock()
+	defer ebc.structMutex.Unlock()
+
+	return ebc.mode
+}
+
+func (ebc *EthereumBlockCounter) setMode(mode Mode) {
+	ebc.structMutex.Lock()
+	defer ebc.structMutex.Unlock()
+
+	if ebc.mode == mode {
+		return
+	}
+
+	logger.Infof("switching to [%v] mode of receiving new blocks", mode)
+
+	ebc.mode = mode
+}
+
+// RegisterDiagnostics registers the block counter as the diagnostics source
+// exposing the current block and the mode of receiving new blocks.
+func (ebc *EthereumBlockCounter) RegisterDiagnostics(
+	registry *diagnostics.DiagnosticsRegistry,
+) {
+	registry.RegisterSource("block_counter", func() string {
+		currentBlock, _ := ebc.CurrentBlock()
+
+		return fmt.Sprintf(
+			`{"current_block":%v,"mode":"%v"}`,
+			currentBlock,
+			ebc.Mode(),
+		)
+	})
+}
+
+// WatchReorgs returns a channel receiving a notification about each chain
+// reorganization detected by the block counter. The fork point is searched
+// for in the background so the notification may come after blocks of the
+// new chain are passed to block watchers. The current block never decreases
+// because of the reorganization, and blocks of the new chain at heights
+// already seen are not passed to block watchers again. Notifications are
+// dropped if the channel is not read. The channel is closed once the context
+// is done.
+func (ebc *EthereumBlockCounter) WatchReorgs(ctx context.Context) <-chan Reorg {
+	watcher := &reorgWatcher{
+		ctx:     ctx,
+		channel: make(chan Reorg),
+	}
+
+	ebc.structMutex.Lock()
+	ebc.reorgWatchers = append(ebc.reorgWatchers, watcher)
+	ebc.structMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		ebc.structMutex.Lock()
+		for i, w := range ebc.reorgWatchers {
+			if w == watcher {
+				ebc.reorgWatchers[i] = ebc.reorgWatchers[len(ebc.reorgWatchers)-1]
+				ebc.reorgWatchers = ebc.reorgWatchers[:len(ebc.reorgWatchers)-1]
+				break
+			}
+		}
+		// notifications are sent with the lock held so the channel can be
+		// safely closed here
+		close(watcher.channel)
+		ebc.structMutex.Unlock()
+	}()
+
+	return watcher.channel
+}
+
 // receiveBlocks gets each new block back from Geth and extracts the
 // block height (topBlockNumber) form it. For each block height that is being
 // waited on a message will be sent.
@@ -114,6 +363,16 @@ func (ebc *EthereumBlockCounter) receiveBlocks() {
 		// we do nothing. All handlers were already called for this block
 		// height.
 		receivedBlockHeight := uint64(topBlockNumber)
+
+		// If the received block does not match the hashes of blocks we have
+		// already seen, the chain has been reorganized. Watchers are notified
+		// about the reorganization but the latest block height stays as it
+		// is so the current block never decreases.
+		if ebc.isReorganized(receivedBlockHeight, block) {
+			ebc.handleReorg(receivedBlockHeight, block)
+		}
+		ebc.recordBlock(receivedBlockHeight, block.Hash)
+
 		if receivedBlockHeight == ebc.latestBlockHeight {
 			continue
 		}
@@ -154,8 +413,212 @@ func (ebc *EthereumBlockCounter) receiveBlocks() {
 	}
 }
 
-// subscribeBlocks creates a subscription to Geth to get each block.
-func (ebc *EthereumBlockCounter) subscribeBlocks(ctx context.Context, client ethereum.ChainReader) error {
+// isReorganized returns true if the given block conflicts with the blocks
+// already seen, that is, when the block of the same height or the parent of
+// the block has a different hash.
+func (ebc *EthereumBlockCounter) isReorganized(height uint64, block block) bool {
+	if block.Hash == "" || height == 0 {
+		return false
+	}
+
+	ebc.recentBlocksMutex.Lock()
+	defer ebc.recentBlocksMutex.Unlock()
+
+	if hash, ok := ebc.recentBlocks[height]; ok && hash != block.Hash {
+		return true
+	}
+
+	if hash, ok := ebc.recentBlocks[height-1]; ok && hash != block.ParentHash {
+		return true
+	}
+
+	return false
+}
+
+// handleReorg replaces hashes of the abandoned blocks at and above the height
+// of the given block with the hash of that block and searches for the fork point of the reorganization
+// in the background so that fetching blocks of the new chain does not delay
+// delivery of new blocks and waiters.
+func (ebc *EthereumBlockCounter) handleReorg(height uint64, block block) {
+	ebc.structMutex.Lock()
+	latestBlockHeight := ebc.latestBlockHeight
+	ebc.structMutex.Unlock()
+
+	ebc.recentBlocksMutex.Lock()
+	seenBlocks := make(map[uint64]string, len(ebc.recentBlocks))
+	for number, hash := range ebc.recentBlocks {
+		if number >= height {
+			delete(ebc.recentBlocks, number)
+			continue
+		}
+		seenBlocks[number] = hash
+	}
+	ebc.recentBlocks[height] = block.Hash
+	ebc.recentBlocksMutex.Unlock()
+
+	go ebc.resolveReorg(height, block, seenBlocks, latestBlockHeight)
+}
+
+// resolveReorg finds the fork point of the reorganization revealed by the
+// given block and notifies reorganization watchers. Hashes of the abandoned
+// blocks below the given block are replaced with hashes of the new chain.
+// If the fork point could not be found, hashes of all the blocks below the
+// given block are forgotten as it is not known which of them are abandoned.
+func (ebc *EthereumBlockCounter) resolveReorg(
+	height uint64,
+	block block,
+	seenBlocks map[uint64]string,
+	latestBlockHeight uint64,
+) {
+	ebc.reorgMutex.Lock()
+	defer ebc.reorgMutex.Unlock()
+
+	reorg := Reorg{Block: height}
+
+	forkPoint, canonicalHashes, err := ebc.findForkPoint(
+		height-1,
+		block.ParentHash,
+		seenBlocks,
+	)
+
+	ebc.recentBlocksMutex.Lock()
+	// the chain could be reorganized again in the meantime; hashes are
+	// updated only if the block is still the one seen at its height
+	if ebc.recentBlocks[height] == block.Hash {
+		for number := range ebc.recentBlocks {
+			if number < height && (err != nil || number > forkPoint) {
+				delete(ebc.recentBlocks, number)
+			}
+		}
+		for number, hash := range canonicalHashes {
+			ebc.recentBlocks[number] = hash
+		}
+	}
+	ebc.recentBlocksMutex.Unlock()
+
+	if err != nil {
+		logger.Warningf(
+			"chain reorganization detected at block [%v]; "+
+				"could not find the fork point: [%v]",
+			height,
+			err,
+		)
+	} else {
+		reorg.ForkPointKnown = true
+		reorg.ForkPoint = forkPoint
+		if latestBlockHeight > forkPoint {
+			reorg.Depth = latestBlockHeight - forkPoint
+		}
+
+		logger.Warningf(
+			"chain reorganization detected at block [%v]; "+
+				"fork point: [%v], depth: [%v]",
+			height,
+			reorg.ForkPoint,
+			reorg.Depth,
+		)
+	}
+
+	ebc.structMutex.Lock()
+	defer ebc.structMutex.Unlock()
+
+	for _, watcher := range ebc.reorgWatchers {
+		if watcher.ctx.Err() != nil {
+			continue
+		}
+
+		select {
+		case watcher.channel <- reorg: // perfect
+		default: // we don't care, let's drop it
+		}
+	}
+}
+
+// findForkPoint walks back the new chain starting from the block of the given
+// height and hash until it finds one of the seen blocks. It returns the
+// height of that block and hashes of the new chain blocks above it which
+// replace the seen blocks. The walk is bounded by the number of seen blocks;
+// an error is returned if no common block is found among them or if blocks
+// of the new chain could not be fetched.
+func (ebc *EthereumBlockCounter) findForkPoint(
+	number uint64,
+	hash string,
+	seenBlocks map[uint64]string,
+) (uint64, map[uint64]string, error) {
+	canonicalHashes := make(map[uint64]string)
+
+	for {
+		seenHash, ok := seenBlocks[number]
+		if !ok {
+			return 0, nil, fmt.Errorf(
+				"no common block found down to block [%v]",
+				number,
+			)
+		}
+
+		if seenHash == hash {
+			return number, canonicalHashes, nil
+		}
+
+		canonicalHashes[number] = hash
+
+		if number == 0 || ebc.fetchBlock == nil {
+			return 0, nil, fmt.Errorf("could not fetch block [%v]", number)
+		}
+
+		block, err := ebc.fetchBlock(number)
+		if err != nil {
+			return 0, nil, fmt.Errorf(
+				"could not fetch block [%v]: [%v]",
+				number,
+				err,
+			)
+		}
+
+		// the chain could be reorganized again in the meantime
+		if block.Hash != hash {
+			return 0, nil, fmt.Errorf(
+				"chain changed while fetching block [%v]",
+				number,
+			)
+		}
+
+		number--
+		hash = block.ParentHash
+	}
+}
+
+// recordBlock stores the hash of the block of the given height and forgets
+// hashes of blocks which are too old to be tracked.
+func (ebc *EthereumBlockCounter) recordBlock(height uint64, hash string) {
+	if hash == "" {
+		return
+	}
+
+	ebc.recentBlocksMutex.Lock()
+	defer ebc.recentBlocksMutex.Unlock()
+
+	if ebc.recentBlocks == nil {
+		ebc.recentBlocks = make(map[uint64]string)
+	}
+
+	ebc.recentBlocks[height] = hash
+
+	for number := range ebc.recentBlocks {
+		if number+recentBlocksLimit <= height {
+			delete(ebc.recentBlocks, number)
+		}
+	}
+}
+
+// subscribeBlocks creates a subscription to Geth to get each block. When the
+// subscription is not available, the block counter switches to polling the
+// latest block until the subscription is successfully retried.
+func (ebc *EthereumBlockCounter) subscribeBlocks(
+	ctx context.Context,
+	client ethereum.ChainReader,
+	config *Config,
+) error {
 	errorChan := make(chan error)
 	newBlockChan := make(chan *types.Header)
 
@@ -178,10 +641,12 @@ func (ebc *EthereumBlockCounter) subscribeBlocks(ctx context.Context, client eth
 			return
 		}
 
+		ebc.setMode(SubscriptionMode)
+
 		for {
 			select {
 			case header := <-newBlockChan:
-				ebc.subscriptionChannel <- block{header.Number.String()}
+				ebc.subscriptionChannel <- newBlock(header)
 			case err = <-subscription.Err():
 				logger.Warningf("subscription to new blocks interrupted: [%v]", err)
 				subscription.Unsubscribe()
@@ -196,10 +661,13 @@ func (ebc *EthereumBlockCounter) subscribeBlocks(ctx context.Context, client eth
 		for {
 			go subscribe()
 			<-errorChan
-			time.Sleep(5 * time.Second)
+			ebc.setMode(PollingMode)
+			time.Sleep(config.ResubscribeInterval)
 		}
 	}()
 
+	go ebc.pollBlocks(ctx, client, config.PollingInterval)
+
 	lastBlock, err := client.BlockByNumber(
 		ctx,
 		nil, // if `nil` then latest known block is returned
@@ -208,14 +676,75 @@ func (ebc *EthereumBlockCounter) subscribeBlocks(ctx context.Context, client eth
 		return err
 	}
 
-	ebc.subscriptionChannel <- block{lastBlock.Number().String()}
+	ebc.subscriptionChannel <- newBlock(lastBlock.Header())
 
 	return nil
 }
 
+// pollBlocks requests the latest block from Geth in the given interval as
+// long as the block counter is in the polling mode.
+func (ebc *EthereumBlockCounter) pollBlocks(
+	ctx context.Context,
+	client ethereum.ChainReader,
+	interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ebc.Mode() != PollingMode {
+				continue
+			}
+
+			pollContext, cancel := context.WithTimeout(
+				ctx,
+				10*time.Second, // timeout for header request
+			)
+			header, err := client.HeaderByNumber(
+				pollContext,
+				nil, // if `nil` then latest known header is returned
+			)
+			cancel()
+			if err != nil {
+				logger.Warningf("could not poll the latest block: [%v]", err)
+				continue
+			}
+
+			ebc.subscriptionChannel <- newBlock(header)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CreateBlockCounter creates the block counter with the default
+// configuration.
 func CreateBlockCounter(client ethereum.ChainReader) (*EthereumBlockCounter, error) {
+	return CreateBlockCounterWithConfig(client, &Config{})
+}
+
+// CreateBlockCounterWithConfig creates the block counter with the given
+// configuration.
+func CreateBlockCounterWithConfig(
+	client ethereum.ChainReader,
+	config *Config,
+) (*EthereumBlockCounter, error) {
 	ctx := context.Background()
 
+	// copy the configuration so that defaults do not modify the caller's one
+	config = &Config{
+		PollingInterval:     config.PollingInterval,
+		ResubscribeInterval: config.ResubscribeInterval,
+	}
+	if config.PollingInterval <= 0 {
+		config.PollingInterval = DefaultPollingInterval
+	}
+	if config.ResubscribeInterval <= 0 {
+		config.ResubscribeInterval = DefaultResubscribeInterval
+	}
+
 	startupBlock, err := client.BlockByNumber(
 		ctx,
 		nil, // if `nil` then latest known block is returned
@@ -232,10 +761,28 @@ func CreateBlockCounter(client ethereum.ChainReader) (*EthereumBlockCounter, err
 		latestBlockHeight:   startupBlock.NumberU64(),
 		waiters:             make(map[uint64][]chan uint64),
 		subscriptionChannel: make(chan block),
+		fetchBlock: func(number uint64) (*block, error) {
+			fetchContext, cancel := context.WithTimeout(
+				ctx,
+				10*time.Second, // timeout for header request
+			)
+			defer cancel()
+
+			header, err := client.HeaderByNumber(
+				fetchContext,
+				new(big.Int).SetUint64(number),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			block := newBlock(header)
+			return &block, nil
+		},
 	}
 
 	go blockCounter.receiveBlocks()
-	err = blockCounter.subscribeBlocks(ctx, client)
+	err = blockCounter.subscribeBlocks(ctx, client, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to subscribe to new blocks: [%v]", err)
 	}
@@ -2,9 +2,23 @@ package blockcounter
 
 import (
 	"context"
+	"fmt"
+	"math/big"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+
+	"github.com/keep-network/keep-common/pkg/chain/chainutil"
+)
+
+var (
+	_ chainutil.BlockHeightWaiter            = &EthereumBlockCounter{}
+	_ chainutil.BlockHeightWaiterWithContext = &EthereumBlockCounter{}
 )
 
 func TestWaitForNewMinedBlock(t *testing.T) {
@@ -103,6 +117,62 @@ func TestExecuteBlockHandlerOnlyOnce(t *testing.T) {
 	}
 }
 
+func TestWaitForBlockHeightWithContext(t *testing.T) {
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+	}
+	go blockCounter.receiveBlocks()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	go func() {
+		blockCounter.subscriptionChannel <- block{Number: "2"}
+	}()
+
+	err := blockCounter.WaitForBlockHeightWithContext(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForBlockHeightWithContext_Cancelled(t *testing.T) {
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+	}
+	go blockCounter.receiveBlocks()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		50*time.Millisecond,
+	)
+	defer cancel()
+
+	err := blockCounter.WaitForBlockHeightWithContext(ctx, 3)
+	if err != context.DeadlineExceeded {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			context.DeadlineExceeded,
+			err,
+		)
+	}
+
+	// give some time for the waiter to be removed
+	time.Sleep(50 * time.Millisecond)
+
+	blockCounter.structMutex.Lock()
+	waitersCount := len(blockCounter.waiters)
+	blockCounter.structMutex.Unlock()
+
+	if waitersCount != 0 {
+		t.Fatalf("expected no waiters; has [%v]", waitersCount)
+	}
+}
+
 func TestWatchBlocks(t *testing.T) {
 	blockCounter := &EthereumBlockCounter{
 		latestBlockHeight:   uint64(1),
@@ -184,3 +254,366 @@ func TestWatchBlocksIsNonBlocking(t *testing.T) {
 		t.Fatalf("watcher should receive [2] blocks, has [%v]", receivedCount)
 	}
 }
+
+func TestWatchReorgs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newChain := map[uint64]*block{
+		4: {Number: "4", Hash: "b4", ParentHash: "a3"},
+		5: {Number: "5", Hash: "b5", ParentHash: "b4"},
+	}
+
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+		fetchBlock: func(number uint64) (*block, error) {
+			return newChain[number], nil
+		},
+	}
+	go blockCounter.receiveBlocks()
+
+	reorgWatcher := blockCounter.WatchReorgs(ctx)
+
+	blockCounter.subscriptionChannel <- block{Number: "2", Hash: "a2", ParentHash: "a1"}
+	blockCounter.subscriptionChannel <- block{Number: "3", Hash: "a3", ParentHash: "a2"}
+	blockCounter.subscriptionChannel <- block{Number: "4", Hash: "a4", ParentHash: "a3"}
+	blockCounter.subscriptionChannel <- block{Number: "5", Hash: "a5", ParentHash: "a4"}
+
+	go func() {
+		blockCounter.subscriptionChannel <- block{Number: "6", Hash: "b6", ParentHash: "b5"}
+	}()
+
+	select {
+	case reorg := <-reorgWatcher:
+		expectedReorg := Reorg{
+			Block:          6,
+			ForkPointKnown: true,
+			ForkPoint:      3,
+			Depth:          2,
+		}
+		if reorg != expectedReorg {
+			t.Fatalf(
+				"unexpected reorg\nexpected: [%+v]\nactual:   [%+v]",
+				expectedReorg,
+				reorg,
+			)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("reorg has not been reported")
+	}
+
+	block6Waiter, err := blockCounter.BlockHeightWaiter(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-block6Waiter:
+	case <-time.After(1 * time.Second):
+		t.Fatal("block of the new chain has not been received")
+	}
+
+	blockCounter.recentBlocksMutex.Lock()
+	hash := blockCounter.recentBlocks[4]
+	blockCounter.recentBlocksMutex.Unlock()
+
+	if hash != "b4" {
+		t.Errorf(
+			"unexpected hash of block [4]\nexpected: [b4]\nactual:   [%v]",
+			hash,
+		)
+	}
+}
+
+func TestWatchReorgs_UnknownForkPoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+		fetchBlock: func(number uint64) (*block, error) {
+			return nil, fmt.Errorf("unavailable")
+		},
+	}
+	go blockCounter.receiveBlocks()
+
+	reorgWatcher := blockCounter.WatchReorgs(ctx)
+
+	blockCounter.subscriptionChannel <- block{Number: "2", Hash: "a2", ParentHash: "a1"}
+	blockCounter.subscriptionChannel <- block{Number: "3", Hash: "a3", ParentHash: "a2"}
+	blockCounter.subscriptionChannel <- block{Number: "4", Hash: "a4", ParentHash: "a3"}
+	blockCounter.subscriptionChannel <- block{Number: "5", Hash: "a5", ParentHash: "a4"}
+
+	go func() {
+		blockCounter.subscriptionChannel <- block{Number: "4", Hash: "b4", ParentHash: "b3"}
+	}()
+
+	select {
+	case reorg := <-reorgWatcher:
+		expectedReorg := Reorg{Block: 4}
+		if reorg != expectedReorg {
+			t.Fatalf(
+				"unexpected reorg\nexpected: [%+v]\nactual:   [%+v]",
+				expectedReorg,
+				reorg,
+			)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("reorg has not been reported")
+	}
+
+	currentBlock, err := blockCounter.CurrentBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currentBlock != 5 {
+		t.Fatalf("current block should not decrease; has [%v]", currentBlock)
+	}
+}
+
+func TestWatchReorgs_DoesNotDelayBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fetchReleased := make(chan struct{})
+
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+		fetchBlock: func(number uint64) (*block, error) {
+			<-fetchReleased
+			return &block{Number: "3", Hash: "b3", ParentHash: "a2"}, nil
+		},
+	}
+	go blockCounter.receiveBlocks()
+
+	reorgWatcher := blockCounter.WatchReorgs(ctx)
+
+	blockCounter.subscriptionChannel <- block{Number: "2", Hash: "a2", ParentHash: "a1"}
+	blockCounter.subscriptionChannel <- block{Number: "3", Hash: "a3", ParentHash: "a2"}
+	blockCounter.subscriptionChannel <- block{Number: "4", Hash: "b4", ParentHash: "b3"}
+
+	block5Waiter, err := blockCounter.BlockHeightWaiter(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		blockCounter.subscriptionChannel <- block{Number: "5", Hash: "b5", ParentHash: "b4"}
+	}()
+
+	select {
+	case <-block5Waiter:
+	case <-time.After(1 * time.Second):
+		t.Fatal("block has been delayed by the fork point search")
+	}
+
+	go close(fetchReleased)
+
+	select {
+	case reorg := <-reorgWatcher:
+		expectedReorg := Reorg{
+			Block:          4,
+			ForkPointKnown: true,
+			ForkPoint:      2,
+			Depth:          1,
+		}
+		if reorg != expectedReorg {
+			t.Fatalf(
+				"unexpected reorg\nexpected: [%+v]\nactual:   [%+v]",
+				expectedReorg,
+				reorg,
+			)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("reorg has not been reported")
+	}
+}
+
+func TestWatchReorgsIgnoresLinearChain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blockCounter := &EthereumBlockCounter{
+		latestBlockHeight:   uint64(1),
+		waiters:             make(map[uint64][]chan uint64),
+		subscriptionChannel: make(chan block),
+	}
+	go blockCounter.receiveBlocks()
+
+	reorgWatcher := blockCounter.WatchReorgs(ctx)
+
+	blockCounter.subscriptionChannel <- block{Number: "2", Hash: "a2", ParentHash: "a1"}
+	blockCounter.subscriptionChannel <- block{Number: "2", Hash: "a2", ParentHash: "a1"}
+	blockCounter.subscriptionChannel <- block{Number: "4", Hash: "a4", ParentHash: "a3"}
+	blockCounter.subscriptionChannel <- block{Number: "5", Hash: "a5", ParentHash: "a4"}
+
+	select {
+	case reorg := <-reorgWatcher:
+		t.Fatalf("unexpected reorg [%+v]", reorg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-reorgWatcher:
+		if ok {
+			t.Fatal("expected closed channel")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("channel has not been closed after cancellation")
+	}
+}
+
+func TestPollingFallback(t *testing.T) {
+	client := &mockChainReader{latestBlock: 1}
+
+	blockCounter, err := CreateBlockCounterWithConfig(client, &Config{
+		PollingInterval:     10 * time.Millisecond,
+		ResubscribeInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.setLatestBlock(3)
+
+	waitForBlock(t, blockCounter, 3)
+
+	if mode := blockCounter.Mode(); mode != PollingMode {
+		t.Fatalf(
+			"unexpected mode\nexpected: [%v]\nactual:   [%v]",
+			PollingMode,
+			mode,
+		)
+	}
+
+	client.enableSubscriptions()
+
+	// give some time for the subscription to be retried
+	time.Sleep(200 * time.Millisecond)
+
+	if mode := blockCounter.Mode(); mode != SubscriptionMode {
+		t.Fatalf(
+			"unexpected mode\nexpected: [%v]\nactual:   [%v]",
+			SubscriptionMode,
+			mode,
+		)
+	}
+
+	client.pushBlock(4)
+
+	waitForBlock(t, blockCounter, 4)
+}
+
+func waitForBlock(
+	t *testing.T,
+	blockCounter *EthereumBlockCounter,
+	blockNumber uint64,
+) {
+	waiter, err := blockCounter.BlockHeightWaiter(blockNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-waiter:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("block [%v] has not been received", blockNumber)
+	}
+}
+
+// mockChainReader serves headers of a linear chain; subscriptions to new
+// blocks fail until they are enabled.
+type mockChainReader struct {
+	ethereum.ChainReader
+
+	mutex                sync.Mutex
+	latestBlock          uint64
+	subscriptionsEnabled bool
+	subscriber           chan<- *types.Header
+}
+
+func (mcr *mockChainReader) setLatestBlock(number uint64) {
+	mcr.mutex.Lock()
+	defer mcr.mutex.Unlock()
+
+	mcr.latestBlock = number
+}
+
+func (mcr *mockChainReader) enableSubscriptions() {
+	mcr.mutex.Lock()
+	defer mcr.mutex.Unlock()
+
+	mcr.subscriptionsEnabled = true
+}
+
+func (mcr *mockChainReader) pushBlock(number uint64) {
+	mcr.mutex.Lock()
+	mcr.latestBlock = number
+	subscriber := mcr.subscriber
+	mcr.mutex.Unlock()
+
+	subscriber <- mockHeader(number)
+}
+
+func (mcr *mockChainReader) BlockByNumber(
+	ctx context.Context,
+	number *big.Int,
+) (*types.Block, error) {
+	header, err := mcr.HeaderByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.NewBlockWithHeader(header), nil
+}
+
+func (mcr *mockChainReader) HeaderByNumber(
+	ctx context.Context,
+	number *big.Int,
+) (*types.Header, error) {
+	mcr.mutex.Lock()
+	defer mcr.mutex.Unlock()
+
+	if number == nil {
+		return mockHeader(mcr.latestBlock), nil
+	}
+
+	return mockHeader(number.Uint64()), nil
+}
+
+func (mcr *mockChainReader) SubscribeNewHead(
+	ctx context.Context,
+	ch chan<- *types.Header,
+) (ethereum.Subscription, error) {
+	mcr.mutex.Lock()
+	defer mcr.mutex.Unlock()
+
+	if !mcr.subscriptionsEnabled {
+		return nil, fmt.Errorf("subscriptions not supported")
+	}
+
+	mcr.subscriber = ch
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	}), nil
+}
+
+// mockHeader returns a header of the given number. Headers of different
+// numbers are linked by parent hashes.
+func mockHeader(number uint64) *types.Header {
+	header := &types.Header{Number: new(big.Int).SetUint64(number)}
+	if number > 0 {
+		header.ParentHash = mockHeader(number - 1).Hash()
+	}
+	return header
+}
@@ -0,0 +1,198 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// aeadBox is used to encrypt and decrypt a plaintext with an AEAD cipher,
+// optionally authenticating associated data.
+type aeadBox struct {
+	cipher cipherID
+	key    [KeyLength]byte
+}
+
+// NewAESGCMBox uses AES-256 in Galois/Counter Mode to encrypt and decrypt the
+// plaintext with the key. Ciphertexts are written in the versioned envelope
+// format.
+//
+// AES-GCM nonces are 12 bytes long and generated randomly so no more than
+// 2^32 messages should be encrypted with the same key.
+func NewAESGCMBox(key [KeyLength]byte) AEADBox {
+	return &aeadBox{
+		cipher: cipherAES256GCM,
+		key:    key,
+	}
+}
+
+// streamBox is an XChaCha20-Poly1305 box able to encrypt and decrypt streams.
+type streamBox struct {
+	aeadBox
+}
+
+// NewXChaCha20Poly1305Box uses XChaCha20 and Poly1305 to encrypt and decrypt
+// the plaintext with the key. Ciphertexts are written in the versioned
+// envelope format. The returned box implements StreamBox as well and
+// decrypts ciphertexts produced by its encrypting writer.
+func NewXChaCha20Poly1305Box(key [KeyLength]byte) AEADBox {
+	return &streamBox{
+		aeadBox{
+			cipher: cipherXChaCha20Poly1305,
+			key:    key,
+		},
+	}
+}
+
+// Decrypt takes the input ciphertext and decrypts it.
+func (sb *streamBox) Decrypt(ciphertext []byte) ([]byte, error) {
+	return sb.DecryptWithAD(ciphertext, nil)
+}
+
+// DecryptWithAD takes the input ciphertext, either a stream or not, and
+// decrypts it. The additional data has to be the same as the one provided
+// for encryption.
+func (sb *streamBox) DecryptWithAD(
+	ciphertext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header, payload, err := parseEnvelope(ciphertext)
+	if err == nil &&
+		header.kdf == kdfNone &&
+		header.cipher == cipherXChaCha20Poly1305Stream {
+		headerBytes := ciphertext[:len(ciphertext)-len(payload)]
+		return decryptStream(&sb.key, headerBytes, payload, additionalData)
+	}
+
+	return sb.aeadBox.DecryptWithAD(ciphertext, additionalData)
+}
+
+// Encrypt takes the input plaintext and encrypts it with the key.
+func (ab *aeadBox) Encrypt(plaintext []byte) ([]byte, error) {
+	return ab.EncryptWithAD(plaintext, nil)
+}
+
+// Decrypt takes the input ciphertext and decrypts it.
+func (ab *aeadBox) Decrypt(ciphertext []byte) ([]byte, error) {
+	return ab.DecryptWithAD(ciphertext, nil)
+}
+
+// EncryptWithAD takes the input plaintext and encrypts it with the key,
+// authenticating the additional data.
+func (ab *aeadBox) EncryptWithAD(
+	plaintext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header := &envelopeHeader{cipher: ab.cipher, kdf: kdfNone}
+
+	return sealAEAD(ab.cipher, &ab.key, header.marshal(), plaintext, additionalData)
+}
+
+// DecryptWithAD takes the input ciphertext and decrypts it. The additional
+// data has to be the same as the one provided for encryption.
+func (ab *aeadBox) DecryptWithAD(
+	ciphertext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header, payload, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.kdf != kdfNone {
+		return nil, fmt.Errorf(
+			"ciphertext is encrypted with a password-derived key",
+		)
+	}
+
+	if header.cipher != ab.cipher {
+		return nil, fmt.Errorf(
+			"ciphertext is encrypted with cipher [%v]; expected [%v]",
+			header.cipher,
+			ab.cipher,
+		)
+	}
+
+	headerBytes := ciphertext[:len(ciphertext)-len(payload)]
+
+	return openAEAD(ab.cipher, &ab.key, headerBytes, payload, additionalData)
+}
+
+func newAEAD(id cipherID, key *[KeyLength]byte) (cipher.AEAD, error) {
+	switch id {
+	case cipherAES256GCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	default:
+		return nil, fmt.Errorf("unsupported cipher [%v]", id)
+	}
+}
+
+// sealAEAD encrypts the plaintext with the key and appends the nonce and
+// the ciphertext to the envelope header. Both the header and the additional
+// data are authenticated.
+func sealAEAD(
+	id cipherID,
+	key *[KeyLength]byte,
+	header []byte,
+	plaintext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	aead, err := newAEAD(id, key)
+	if err != nil {
+		return nil, fmt.Errorf("key encryption failed [%v]", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("key encryption failed [%v]", err)
+	}
+
+	sealed := concat(header, nonce)
+
+	return aead.Seal(sealed, nonce, plaintext, concat(header, additionalData)), nil
+}
+
+// openAEAD decrypts `nonce || ciphertext` payload with the key verifying the
+// envelope header and the additional data.
+func openAEAD(
+	id cipherID,
+	key *[KeyLength]byte,
+	header []byte,
+	payload []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	aead, err := newAEAD(id, key)
+	if err != nil {
+		return nil, fmt.Errorf("symmetric key decryption failed [%v]", err)
+	}
+
+	if len(payload) < aead.NonceSize() {
+		return nil, fmt.Errorf("symmetric key decryption failed")
+	}
+
+	nonce := payload[:aead.NonceSize()]
+	ciphertext := payload[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, concat(header, additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("symmetric key decryption failed")
+	}
+
+	return plaintext, nil
+}
+
+func concat(a []byte, b []byte) []byte {
+	result := make([]byte, 0, len(a)+len(b))
+	result = append(result, a...)
+	return append(result, b...)
+}
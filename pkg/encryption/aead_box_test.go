@@ -0,0 +1,88 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestAEADBoxEncryptDecrypt(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+	additionalData := []byte("0x424242/membership")
+
+	key := sha256.Sum256(accountPassword)
+
+	var tests = map[string]struct {
+		box AEADBox
+	}{
+		"AES-256-GCM": {
+			box: NewAESGCMBox(key),
+		},
+		"XChaCha20-Poly1305": {
+			box: NewXChaCha20Poly1305Box(key),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			encrypted, err := test.box.EncryptWithAD(msg, additionalData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decrypted, err := test.box.DecryptWithAD(encrypted, additionalData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(msg, decrypted) {
+				t.Fatalf(
+					"unexpected message\nexpected: %v\nactual:   %v",
+					msg,
+					decrypted,
+				)
+			}
+
+			_, err = test.box.DecryptWithAD(encrypted, []byte("0x424242/other"))
+			if err == nil {
+				t.Fatal("expected decryption with other associated data to fail")
+			}
+
+			_, err = test.box.Decrypt(encrypted)
+			if err == nil {
+				t.Fatal("expected decryption without associated data to fail")
+			}
+		})
+	}
+}
+
+func TestAEADBoxAuthenticatesHeader(t *testing.T) {
+	box := NewXChaCha20Poly1305Box(sha256.Sum256(accountPassword))
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// KDF id is the last byte of the header; unknown value must be refused
+	encrypted[envelopeHeaderLength-1] = 0xff
+
+	_, err = box.Decrypt(encrypted)
+	if err == nil {
+		t.Fatal("expected decryption of tampered header to fail")
+	}
+}
+
+func TestAEADBoxRefuseOtherCipher(t *testing.T) {
+	key := sha256.Sum256(accountPassword)
+
+	encrypted, err := NewAESGCMBox(key).Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewXChaCha20Poly1305Box(key).Decrypt(encrypted)
+	if err == nil {
+		t.Fatal("expected decryption with other cipher to fail")
+	}
+}
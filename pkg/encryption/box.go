@@ -24,7 +24,9 @@ type box struct {
 }
 
 // NewBox uses XSalsa20 and Poly1305 to encrypt and decrypt the plaintext
-// with the key.
+// with the key. Ciphertexts are written in the versioned envelope format.
+// Bare ciphertexts produced before the envelope format has been introduced
+// are still decrypted.
 func NewBox(key [KeyLength]byte) Box {
 	return &box{
 		key: key,
@@ -34,6 +36,42 @@ func NewBox(key [KeyLength]byte) Box {
 // Encrypt takes the input plaintext and uses XSalsa20 and Poly1305 to encrypt
 // the plaintext with the key.
 func (b *box) Encrypt(plaintext []byte) ([]byte, error) {
+	header := &envelopeHeader{cipher: cipherSecretbox, kdf: kdfNone}
+
+	return sealSecretbox(header.marshal(), plaintext, &b.key)
+}
+
+// Decrypt takes the input ciphertext and decrypts it.
+func (b *box) Decrypt(ciphertext []byte) ([]byte, error) {
+	if !isEnvelope(ciphertext) {
+		return openSecretbox(ciphertext, &b.key)
+	}
+
+	header, payload, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.kdf != kdfNone {
+		return nil, fmt.Errorf(
+			"ciphertext is encrypted with a password-derived key",
+		)
+	}
+
+	if header.cipher != cipherSecretbox {
+		return nil, fmt.Errorf("unsupported cipher [%v]", header.cipher)
+	}
+
+	return openSecretbox(payload, &b.key)
+}
+
+// sealSecretbox encrypts the plaintext with the key and appends the nonce and
+// the ciphertext to the provided prefix.
+func sealSecretbox(
+	prefix []byte,
+	plaintext []byte,
+	key *[KeyLength]byte,
+) ([]byte, error) {
 	// The nonce needs to be unique, but not secure. Therefore we include it
 	// at the beginning of the ciphertext.
 	var nonce [NonceSize]byte
@@ -41,11 +79,14 @@ func (b *box) Encrypt(plaintext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("key encryption failed [%v]", err)
 	}
 
-	return secretbox.Seal(nonce[:], plaintext, &nonce, &b.key), nil
+	return secretbox.Seal(append(prefix, nonce[:]...), plaintext, &nonce, key), nil
 }
 
-// Decrypt takes the input ciphertext and decrypts it.
-func (b *box) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
+// openSecretbox decrypts `nonce || secretbox` payload with the key.
+func openSecretbox(
+	payload []byte,
+	key *[KeyLength]byte,
+) (plaintext []byte, err error) {
 	defer func() {
 		// secretbox Open panics for invalid input
 		if recover() != nil {
@@ -54,9 +95,9 @@ func (b *box) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
 	}()
 
 	var nonce [NonceSize]byte
-	copy(nonce[:], ciphertext[:NonceSize])
+	copy(nonce[:], payload[:NonceSize])
 
-	plaintext, ok := secretbox.Open(nil, ciphertext[NonceSize:], &nonce, &b.key)
+	plaintext, ok := secretbox.Open(nil, payload[NonceSize:], &nonce, key)
 	if !ok {
 		err = fmt.Errorf("symmetric key decryption failed")
 	}
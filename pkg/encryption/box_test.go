@@ -1,10 +1,13 @@
 package encryption
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"reflect"
 	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 var accountPassword = []byte("passW0rd")
@@ -79,3 +82,72 @@ func TestGracefullyHandleBrokenCipher(t *testing.T) {
 		)
 	}
 }
+
+func TestDecryptLegacyCiphertext(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+	key := sha256.Sum256(accountPassword)
+
+	var nonce [NonceSize]byte
+	legacy := secretbox.Seal(nonce[:], msg, &nonce, &key)
+
+	decrypted, err := NewBox(key).Decrypt(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, decrypted) {
+		t.Fatalf(
+			"unexpected message\nexpected: %v\nactual:   %v",
+			msg,
+			decrypted,
+		)
+	}
+}
+
+func TestCiphertextEnvelope(t *testing.T) {
+	box := NewBox(sha256.Sum256(accountPassword))
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err := parseEnvelope(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHeader := &envelopeHeader{cipher: cipherSecretbox, kdf: kdfNone}
+	if !reflect.DeepEqual(expectedHeader, header) {
+		t.Fatalf(
+			"unexpected header\nexpected: %v\nactual:   %v",
+			expectedHeader,
+			header,
+		)
+	}
+}
+
+func TestRefuseUnsupportedEnvelopeVersion(t *testing.T) {
+	box := NewBox(sha256.Sum256(accountPassword))
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted[envelopeMagicLength] = envelopeVersion + 1
+
+	_, err = box.Decrypt(encrypted)
+
+	expectedError := fmt.Errorf(
+		"unsupported envelope version [%v]",
+		envelopeVersion+1,
+	)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: %v\nactual:   %v",
+			expectedError,
+			err,
+		)
+	}
+}
@@ -2,11 +2,54 @@
 // a filesystem is compromised.
 // Under the hood we use "golang.org/x/crypto/nacl/secretbox" for encryption.
 // Secretbox uses XSalsa20 and Poly1305 to encrypt an array of bytes with
-// secret-key cryptography.
+// secret-key cryptography. AES-256-GCM and XChaCha20-Poly1305 boxes are
+// available for authenticated encryption with associated data.
+//
+// Ciphertexts are written in a versioned envelope format carrying the cipher
+// and key derivation function identifiers along with the key derivation
+// parameters, so that the format can evolve without breaking already
+// encrypted data. Keys for password-based boxes are derived with scrypt.
+// Envelope boxes encrypt each plaintext with its own random data key wrapped
+// by a KeyProvider, so the master key can be kept in a key file, an
+// environment variable or a hardware security module.
+//
+// Sealed boxes use public-key cryptography to encrypt data for another party
+// holding the matching private key.
 package encryption
 
+import "io"
+
 // Box is a general interface to encrypt and decrypt an array of bytes.
 type Box interface {
 	Encrypt([]byte) ([]byte, error)
 	Decrypt([]byte) ([]byte, error)
 }
+
+// AEADBox is a Box using an authenticated encryption with associated data.
+// The associated data is not encrypted but it is authenticated, so the
+// ciphertext can be decrypted only if exactly the same associated data is
+// provided as for the encryption. It allows to bind the ciphertext to the
+// context it is used in.
+type AEADBox interface {
+	Box
+
+	EncryptWithAD(plaintext []byte, additionalData []byte) ([]byte, error)
+	DecryptWithAD(ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+// StreamBox is a box able to encrypt and decrypt streams of data of an
+// arbitrary size without holding them in memory as a whole. The stream is
+// encrypted in chunks, each one authenticated separately, and truncating or
+// reordering chunks is detected.
+type StreamBox interface {
+	NewEncryptingWriter(w io.Writer, additionalData []byte) (io.WriteCloser, error)
+	NewDecryptingReader(r io.Reader, additionalData []byte) (io.Reader, error)
+}
+
+// SealedBox is a general interface to encrypt an array of bytes with the
+// public key of the recipient and to decrypt an array of bytes encrypted with
+// the public key matching the private key of the box.
+type SealedBox interface {
+	Seal(plaintext []byte, recipient *PublicKey) ([]byte, error)
+	Open(ciphertext []byte) ([]byte, error)
+}
@@ -0,0 +1,210 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The envelope is a versioned ciphertext format with the following layout:
+//
+//	magic (7 bytes) | version (1 byte) | cipher id (1 byte) | KDF id (1 byte) |
+//	KDF parameters (KDF-specific length) | nonce | ciphertext
+//
+// For scrypt, KDF parameters are encoded as:
+//
+//	salt (16 bytes) | log2(N) (1 byte) | r (4 bytes) | p (4 bytes)
+//
+// For data keys wrapped by a key provider, KDF parameters are encoded as:
+//
+//	wrapped key length (2 bytes) | wrapped key
+//
+// Ciphertexts produced before the envelope has been introduced are bare
+// `nonce || secretbox` blobs without any header.
+var envelopeMagic = []byte("KEEPENC")
+
+const (
+	envelopeVersion = 1
+
+	envelopeMagicLength  = 7
+	envelopeHeaderLength = envelopeMagicLength + 3 // version, cipher, kdf
+
+	scryptSaltLength   = 16
+	scryptParamsLength = scryptSaltLength + 1 + 4 + 4
+
+	wrappedKeyLengthLength = 2
+	maxWrappedKeyLength    = 1<<16 - 1
+)
+
+type cipherID byte
+
+const (
+	// XSalsa20 with Poly1305, as implemented by NaCl secretbox.
+	cipherSecretbox cipherID = 1
+	// AES-256 in Galois/Counter Mode.
+	cipherAES256GCM cipherID = 2
+	// XChaCha20 with Poly1305, as specified in the IETF draft.
+	cipherXChaCha20Poly1305 cipherID = 3
+	// XChaCha20 with Poly1305 applied to chunks of a stream.
+	cipherXChaCha20Poly1305Stream cipherID = 4
+)
+
+type kdfID byte
+
+const (
+	// The key is used as-is, without any derivation.
+	kdfNone kdfID = 0
+	// The key is derived from a password with scrypt.
+	kdfScrypt kdfID = 1
+	// The key is a random data key wrapped by a key provider.
+	kdfWrappedKey kdfID = 2
+)
+
+// envelopeHeader holds all the information needed to decrypt a ciphertext
+// except the key or password.
+type envelopeHeader struct {
+	cipher cipherID
+	kdf    kdfID
+
+	// Set only for kdfScrypt.
+	salt   []byte
+	scrypt ScryptParams
+
+	// Set only for kdfWrappedKey.
+	wrappedKey []byte
+}
+
+// marshal serializes the header to the envelope format.
+func (eh *envelopeHeader) marshal() []byte {
+	buffer := &bytes.Buffer{}
+	buffer.Write(envelopeMagic)
+	buffer.WriteByte(envelopeVersion)
+	buffer.WriteByte(byte(eh.cipher))
+	buffer.WriteByte(byte(eh.kdf))
+
+	if eh.kdf == kdfScrypt {
+		buffer.Write(eh.salt)
+		buffer.WriteByte(eh.scrypt.LogN)
+		binary.Write(buffer, binary.BigEndian, eh.scrypt.R)
+		binary.Write(buffer, binary.BigEndian, eh.scrypt.P)
+	}
+
+	if eh.kdf == kdfWrappedKey {
+		binary.Write(buffer, binary.BigEndian, uint16(len(eh.wrappedKey)))
+		buffer.Write(eh.wrappedKey)
+	}
+
+	return buffer.Bytes()
+}
+
+// isEnvelope returns true if the data starts with the envelope magic bytes.
+// Legacy ciphertexts start with a random nonce so the chance of confusing
+// them with an envelope is negligible.
+func isEnvelope(data []byte) bool {
+	return len(data) >= envelopeMagicLength &&
+		bytes.Equal(data[:envelopeMagicLength], envelopeMagic)
+}
+
+// parseEnvelope parses the envelope header and returns it along with the
+// remaining nonce and ciphertext.
+func parseEnvelope(data []byte) (*envelopeHeader, []byte, error) {
+	if !isEnvelope(data) || len(data) < envelopeHeaderLength {
+		return nil, nil, fmt.Errorf("malformed envelope header")
+	}
+
+	version := data[envelopeMagicLength]
+	if version != envelopeVersion {
+		return nil, nil, fmt.Errorf("unsupported envelope version [%v]", version)
+	}
+
+	header := &envelopeHeader{
+		cipher: cipherID(data[envelopeMagicLength+1]),
+		kdf:    kdfID(data[envelopeMagicLength+2]),
+	}
+	rest := data[envelopeHeaderLength:]
+
+	switch header.kdf {
+	case kdfNone:
+	case kdfScrypt:
+		if len(rest) < scryptParamsLength {
+			return nil, nil, fmt.Errorf("malformed scrypt parameters")
+		}
+
+		header.salt = rest[:scryptSaltLength]
+		header.scrypt = ScryptParams{
+			LogN: rest[scryptSaltLength],
+			R:    binary.BigEndian.Uint32(rest[scryptSaltLength+1:]),
+			P:    binary.BigEndian.Uint32(rest[scryptSaltLength+5:]),
+		}
+		rest = rest[scryptParamsLength:]
+	case kdfWrappedKey:
+		if len(rest) < wrappedKeyLengthLength {
+			return nil, nil, fmt.Errorf("malformed wrapped key")
+		}
+
+		wrappedKeyLength := int(binary.BigEndian.Uint16(rest))
+		rest = rest[wrappedKeyLengthLength:]
+
+		if len(rest) < wrappedKeyLength {
+			return nil, nil, fmt.Errorf("malformed wrapped key")
+		}
+
+		header.wrappedKey = rest[:wrappedKeyLength]
+		rest = rest[wrappedKeyLength:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported KDF [%v]", header.kdf)
+	}
+
+	return header, rest, nil
+}
+
+// readEnvelopeHeader reads the envelope header from the reader leaving the
+// reader at the first byte following the header. The raw header is returned
+// along with the parsed one.
+func readEnvelopeHeader(r io.Reader) ([]byte, *envelopeHeader, error) {
+	headerBytes := make([]byte, envelopeHeaderLength)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return nil, nil, fmt.Errorf("malformed envelope header")
+	}
+
+	switch kdfID(headerBytes[envelopeHeaderLength-1]) {
+	case kdfScrypt:
+		params := make([]byte, scryptParamsLength)
+		if _, err := io.ReadFull(r, params); err != nil {
+			return nil, nil, fmt.Errorf("malformed scrypt parameters")
+		}
+		headerBytes = append(headerBytes, params...)
+	case kdfWrappedKey:
+		length := make([]byte, wrappedKeyLengthLength)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, nil, fmt.Errorf("malformed wrapped key")
+		}
+
+		wrappedKey := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(r, wrappedKey); err != nil {
+			return nil, nil, fmt.Errorf("malformed wrapped key")
+		}
+		headerBytes = append(headerBytes, length...)
+		headerBytes = append(headerBytes, wrappedKey...)
+	}
+
+	header, _, err := parseEnvelope(headerBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return headerBytes, header, nil
+}
+
+// FormatVersion returns the version of the envelope format the ciphertext
+// is written in. Zero is returned for data not written in the envelope
+// format, that is for ciphertexts produced before the envelope format has
+// been introduced or for data that is not encrypted at all.
+func FormatVersion(data []byte) int {
+	if !isEnvelope(data) || len(data) <= envelopeMagicLength {
+		return 0
+	}
+
+	return int(data[envelopeMagicLength])
+}
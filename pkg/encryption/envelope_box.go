@@ -0,0 +1,172 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// envelopeBox encrypts each plaintext with its own random data key wrapped by
+// the key provider.
+type envelopeBox struct {
+	provider KeyProvider
+}
+
+// NewEnvelopeBox uses XChaCha20 and Poly1305 to encrypt and decrypt each
+// plaintext with its own random data key. The data key is wrapped by the
+// key provider and stored in the ciphertext envelope so the master key of the
+// provider is never used to encrypt the data directly.
+//
+// The returned box implements StreamBox as well and decrypts ciphertexts
+// produced by its encrypting writer.
+func NewEnvelopeBox(provider KeyProvider) AEADBox {
+	return &envelopeBox{provider}
+}
+
+// Encrypt takes the input plaintext and encrypts it with a new data key.
+func (eb *envelopeBox) Encrypt(plaintext []byte) ([]byte, error) {
+	return eb.EncryptWithAD(plaintext, nil)
+}
+
+// Decrypt takes the input ciphertext and decrypts it.
+func (eb *envelopeBox) Decrypt(ciphertext []byte) ([]byte, error) {
+	return eb.DecryptWithAD(ciphertext, nil)
+}
+
+// EncryptWithAD works as Encrypt but additionally authenticates the provided
+// additional data.
+func (eb *envelopeBox) EncryptWithAD(
+	plaintext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header, dataKey, err := eb.newDataKey(cipherXChaCha20Poly1305)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealAEAD(
+		cipherXChaCha20Poly1305,
+		dataKey,
+		header,
+		plaintext,
+		additionalData,
+	)
+}
+
+// DecryptWithAD takes the input ciphertext and decrypts it. The additional
+// data has to be the same as the one provided for encryption.
+func (eb *envelopeBox) DecryptWithAD(
+	ciphertext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header, payload, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := eb.unwrapDataKey(header)
+	if err != nil {
+		return nil, err
+	}
+
+	headerBytes := ciphertext[:len(ciphertext)-len(payload)]
+
+	switch header.cipher {
+	case cipherXChaCha20Poly1305Stream:
+		return decryptStream(dataKey, headerBytes, payload, additionalData)
+	default:
+		return openAEAD(header.cipher, dataKey, headerBytes, payload, additionalData)
+	}
+}
+
+// NewEncryptingWriter returns a writer encrypting all the data written to it
+// with a new data key and writing the ciphertext to the provided writer. The
+// writer must be closed to write the final chunk of the stream.
+func (eb *envelopeBox) NewEncryptingWriter(
+	w io.Writer,
+	additionalData []byte,
+) (io.WriteCloser, error) {
+	header, dataKey, err := eb.newDataKey(cipherXChaCha20Poly1305Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEncryptingWriter(w, dataKey, header, additionalData)
+}
+
+// NewDecryptingReader returns a reader decrypting the ciphertext read from
+// the provided reader. The additional data has to be the same as the one
+// provided for encryption.
+func (eb *envelopeBox) NewDecryptingReader(
+	r io.Reader,
+	additionalData []byte,
+) (io.Reader, error) {
+	headerBytes, header, err := readEnvelopeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.cipher != cipherXChaCha20Poly1305Stream {
+		return nil, fmt.Errorf("ciphertext is not a stream")
+	}
+
+	dataKey, err := eb.unwrapDataKey(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecryptingReader(r, dataKey, headerBytes, additionalData)
+}
+
+// newDataKey generates a new random data key and returns it along with the
+// envelope header for the given cipher carrying the wrapped data key.
+func (eb *envelopeBox) newDataKey(
+	cipher cipherID,
+) ([]byte, *[KeyLength]byte, error) {
+	dataKey := &[KeyLength]byte{}
+	if _, err := io.ReadFull(rand.Reader, dataKey[:]); err != nil {
+		return nil, nil, fmt.Errorf("could not generate data key [%v]", err)
+	}
+
+	wrappedKey, err := eb.provider.WrapKey(dataKey[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not wrap data key [%v]", err)
+	}
+
+	if len(wrappedKey) > maxWrappedKeyLength {
+		return nil, nil, fmt.Errorf(
+			"wrapped data key is too long; has [%v] bytes",
+			len(wrappedKey),
+		)
+	}
+
+	header := &envelopeHeader{
+		cipher:     cipher,
+		kdf:        kdfWrappedKey,
+		wrappedKey: wrappedKey,
+	}
+
+	return header.marshal(), dataKey, nil
+}
+
+func (eb *envelopeBox) unwrapDataKey(
+	header *envelopeHeader,
+) (*[KeyLength]byte, error) {
+	if header.kdf != kdfWrappedKey {
+		return nil, fmt.Errorf("ciphertext is not encrypted with a data key")
+	}
+
+	unwrapped, err := eb.provider.UnwrapKey(header.wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key [%v]", err)
+	}
+
+	if len(unwrapped) != KeyLength {
+		return nil, fmt.Errorf("unwrapped data key has invalid length")
+	}
+
+	dataKey := &[KeyLength]byte{}
+	copy(dataKey[:], unwrapped)
+
+	return dataKey, nil
+}
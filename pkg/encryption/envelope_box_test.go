@@ -0,0 +1,98 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEnvelopeBoxEncryptDecrypt(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+	additionalData := []byte("0x424242/membership")
+
+	hsm := NewSoftwareHSM()
+	hsm.GenerateKey("master")
+
+	provider, err := NewHSMKeyProvider(hsm, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box := NewEnvelopeBox(provider)
+
+	encrypted1, err := box.EncryptWithAD(msg, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted2, err := box.EncryptWithAD(msg, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header1, _, _ := parseEnvelope(encrypted1)
+	header2, _, _ := parseEnvelope(encrypted2)
+	if bytes.Equal(header1.wrappedKey, header2.wrappedKey) {
+		t.Fatal("expected each ciphertext to have its own data key")
+	}
+
+	decrypted, err := box.DecryptWithAD(encrypted1, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, decrypted) {
+		t.Fatalf(
+			"unexpected message\nexpected: %v\nactual:   %v",
+			msg,
+			decrypted,
+		)
+	}
+
+	_, err = box.DecryptWithAD(encrypted1, []byte("0x777777/membership"))
+	if err == nil {
+		t.Fatal("expected decryption with other associated data to fail")
+	}
+
+	// data key can not be unwrapped with other master key
+	otherHSM := NewSoftwareHSM()
+	otherHSM.GenerateKey("master")
+	otherProvider, _ := NewHSMKeyProvider(otherHSM, "master")
+
+	_, err = NewEnvelopeBox(otherProvider).DecryptWithAD(encrypted1, additionalData)
+	if err == nil {
+		t.Fatal("expected decryption with other master key to fail")
+	}
+}
+
+func TestEnvelopeBoxStream(t *testing.T) {
+	hsm := NewSoftwareHSM()
+	hsm.GenerateKey("master")
+
+	provider, err := NewHSMKeyProvider(hsm, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box := NewEnvelopeBox(provider)
+
+	msg := randomBytes(t, 2*streamChunkSize+1)
+	encrypted := encryptStream(t, box.(StreamBox), msg)
+
+	reader, err := box.(StreamBox).NewDecryptingReader(
+		bytes.NewReader(encrypted),
+		streamTestAdditionalData,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, decrypted) {
+		t.Fatal("unexpected decrypted stream")
+	}
+}
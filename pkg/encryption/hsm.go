@@ -0,0 +1,181 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ObjectHandle identifies an object, such as a key, in a hardware security
+// module session, like CK_OBJECT_HANDLE in PKCS#11.
+type ObjectHandle uint64
+
+// HardwareSecurityModule is the minimal subset of PKCS#11 operations needed
+// to wrap and unwrap data keys with a secret key that never leaves the
+// hardware security module. Implementations are expected to be thin adapters
+// over a PKCS#11 session with the AES-GCM mechanism (CKM_AES_GCM).
+type HardwareSecurityModule interface {
+	// FindKey returns the handle of the secret key with the given label,
+	// like C_FindObjects with the CKA_LABEL template.
+	FindKey(label string) (ObjectHandle, error)
+	// Encrypt encrypts the plaintext with the key, like C_Encrypt.
+	// The returned ciphertext includes everything needed for decryption
+	// except the key, e.g. the initialization vector.
+	Encrypt(key ObjectHandle, plaintext []byte) ([]byte, error)
+	// Decrypt decrypts the ciphertext with the key, like C_Decrypt.
+	Decrypt(key ObjectHandle, ciphertext []byte) ([]byte, error)
+}
+
+// hsmKeyProvider wraps data keys with a key kept in a hardware security
+// module.
+type hsmKeyProvider struct {
+	hsm HardwareSecurityModule
+	key ObjectHandle
+}
+
+// NewHSMKeyProvider creates a key provider wrapping data keys with the key
+// with the given label kept in the hardware security module.
+func NewHSMKeyProvider(
+	hsm HardwareSecurityModule,
+	keyLabel string,
+) (KeyProvider, error) {
+	key, err := hsm.FindKey(keyLabel)
+	if err != nil {
+		return nil, fmt.Errorf("could not find key [%v]: [%v]", keyLabel, err)
+	}
+
+	return &hsmKeyProvider{
+		hsm: hsm,
+		key: key,
+	}, nil
+}
+
+func (hkp *hsmKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return hkp.hsm.Encrypt(hkp.key, dataKey)
+}
+
+func (hkp *hsmKeyProvider) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return hkp.hsm.Decrypt(hkp.key, wrappedKey)
+}
+
+// SoftwareHSM is a software stand-in for a hardware security module keeping
+// AES-256 keys in memory. It is meant for development and testing only since
+// it gives none of the guarantees of a hardware security module.
+type SoftwareHSM struct {
+	mutex   sync.RWMutex
+	keys    map[ObjectHandle][]byte
+	labels  map[string]ObjectHandle
+	nextKey ObjectHandle
+}
+
+// NewSoftwareHSM creates a new software stand-in for a hardware security
+// module with no keys.
+func NewSoftwareHSM() *SoftwareHSM {
+	return &SoftwareHSM{
+		keys:    make(map[ObjectHandle][]byte),
+		labels:  make(map[string]ObjectHandle),
+		nextKey: 1,
+	}
+}
+
+// GenerateKey generates a new random AES-256 key with the given label.
+func (sh *SoftwareHSM) GenerateKey(label string) (ObjectHandle, error) {
+	key := make([]byte, KeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return 0, fmt.Errorf("could not generate key [%v]", err)
+	}
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if _, exists := sh.labels[label]; exists {
+		return 0, fmt.Errorf("key with label [%v] already exists", label)
+	}
+
+	handle := sh.nextKey
+	sh.nextKey++
+
+	sh.keys[handle] = key
+	sh.labels[label] = handle
+
+	return handle, nil
+}
+
+// FindKey returns the handle of the key with the given label.
+func (sh *SoftwareHSM) FindKey(label string) (ObjectHandle, error) {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	handle, ok := sh.labels[label]
+	if !ok {
+		return 0, fmt.Errorf("no key with label [%v]", label)
+	}
+
+	return handle, nil
+}
+
+// Encrypt encrypts the plaintext with the key using AES-GCM. The ciphertext
+// is prefixed with the random initialization vector.
+func (sh *SoftwareHSM) Encrypt(
+	key ObjectHandle,
+	plaintext []byte,
+) ([]byte, error) {
+	aead, err := sh.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("could not generate initialization vector [%v]", err)
+	}
+
+	return aead.Seal(iv, iv, plaintext, nil), nil
+}
+
+// Decrypt decrypts the ciphertext produced by Encrypt with the key.
+func (sh *SoftwareHSM) Decrypt(
+	key ObjectHandle,
+	ciphertext []byte,
+) ([]byte, error) {
+	aead, err := sh.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	plaintext, err := aead.Open(
+		nil,
+		ciphertext[:aead.NonceSize()],
+		ciphertext[aead.NonceSize():],
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed")
+	}
+
+	return plaintext, nil
+}
+
+func (sh *SoftwareHSM) aead(handle ObjectHandle) (cipher.AEAD, error) {
+	sh.mutex.RLock()
+	key, ok := sh.keys[handle]
+	sh.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("invalid key handle [%v]", handle)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,131 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps data keys with a master key the provider has
+// access to. It lets to encrypt each piece of data with its own random data
+// key stored along with the data in a wrapped form, without the master key
+// ever being exposed to the code encrypting the data.
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the master key.
+	WrapKey(dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts the data key wrapped with the master key.
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// masterKeyProvider wraps data keys with a master key held in memory.
+type masterKeyProvider struct {
+	box AEADBox
+}
+
+func newMasterKeyProvider(masterKey [KeyLength]byte) *masterKeyProvider {
+	return &masterKeyProvider{
+		box: NewXChaCha20Poly1305Box(masterKey),
+	}
+}
+
+func (mkp *masterKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return mkp.box.Encrypt(dataKey)
+}
+
+func (mkp *masterKeyProvider) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return mkp.box.Decrypt(wrappedKey)
+}
+
+// NewKeyFileProvider creates a key provider using the master key read from
+// the file under the provided path. The file should contain the 32 bytes long
+// master key encoded as a hexadecimal string and should be readable only by
+// the operator.
+func NewKeyFileProvider(path string) (KeyProvider, error) {
+	// #nosec G304 (file path provided as taint input)
+	// This line opens the key file from the path provided by the operator.
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the key file [%v]", err)
+	}
+
+	masterKey, err := decodeMasterKey(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file [%v]: [%v]", path, err)
+	}
+
+	return newMasterKeyProvider(masterKey), nil
+}
+
+// GenerateKeyFile generates a new random master key and writes it to the
+// file under the provided path in the format expected by NewKeyFileProvider.
+// Existing file is never overwritten.
+func GenerateKeyFile(path string) error {
+	var masterKey [KeyLength]byte
+	if _, err := io.ReadFull(rand.Reader, masterKey[:]); err != nil {
+		return fmt.Errorf("could not generate the master key [%v]", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create the key file [%v]", err)
+	}
+
+	_, err = file.WriteString(hex.EncodeToString(masterKey[:]) + "\n")
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write the key file [%v]", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("could not sync the key file [%v]", err)
+	}
+
+	return file.Close()
+}
+
+// NewEnvironmentKeyProvider creates a key provider using the master key read
+// from the environment variable with the provided name. The variable should
+// contain the 32 bytes long master key encoded as a hexadecimal string.
+func NewEnvironmentKeyProvider(variable string) (KeyProvider, error) {
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return nil, fmt.Errorf("environment variable [%v] is not set", variable)
+	}
+
+	masterKey, err := decodeMasterKey(value)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid key in environment variable [%v]: [%v]",
+			variable,
+			err,
+		)
+	}
+
+	return newMasterKeyProvider(masterKey), nil
+}
+
+func decodeMasterKey(encoded string) ([KeyLength]byte, error) {
+	var masterKey [KeyLength]byte
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return masterKey, fmt.Errorf("master key is not a hexadecimal string")
+	}
+
+	if len(decoded) != KeyLength {
+		return masterKey, fmt.Errorf(
+			"master key must be [%v] bytes long; has [%v]",
+			KeyLength,
+			len(decoded),
+		)
+	}
+
+	copy(masterKey[:], decoded)
+
+	return masterKey, nil
+}
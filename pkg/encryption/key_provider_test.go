@@ -0,0 +1,169 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testKeyVariable = "KEEP_TEST_MASTER_KEY"
+
+var testMasterKey = bytes.Repeat([]byte{0x42}, KeyLength)
+
+func TestKeyProvidersWrapUnwrap(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "key-provider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyFilePath := filepath.Join(tempDir, "master.key")
+	if err := GenerateKeyFile(keyFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFileProvider, err := NewKeyFileProvider(keyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(testKeyVariable, hex.EncodeToString(testMasterKey))
+	defer os.Unsetenv(testKeyVariable)
+
+	environmentProvider, err := NewEnvironmentKeyProvider(testKeyVariable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsm := NewSoftwareHSM()
+	if _, err := hsm.GenerateKey("master"); err != nil {
+		t.Fatal(err)
+	}
+
+	hsmProvider, err := NewHSMKeyProvider(hsm, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = map[string]struct {
+		provider KeyProvider
+	}{
+		"key file": {
+			provider: keyFileProvider,
+		},
+		"environment variable": {
+			provider: environmentProvider,
+		},
+		"hardware security module": {
+			provider: hsmProvider,
+		},
+	}
+
+	dataKey := bytes.Repeat([]byte{0x07}, KeyLength)
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			wrappedKey, err := test.provider.WrapKey(dataKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(wrappedKey, dataKey) {
+				t.Fatal("wrapped key contains the data key")
+			}
+
+			unwrappedKey, err := test.provider.UnwrapKey(wrappedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(dataKey, unwrappedKey) {
+				t.Fatalf(
+					"unexpected unwrapped key\nexpected: %v\nactual:   %v",
+					dataKey,
+					unwrappedKey,
+				)
+			}
+
+			wrappedKey[len(wrappedKey)-1] ^= 0x01
+			if _, err := test.provider.UnwrapKey(wrappedKey); err == nil {
+				t.Fatal("expected unwrapping of tampered key to fail")
+			}
+		})
+	}
+}
+
+func TestGenerateKeyFile_RefuseOverwrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "key-provider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyFilePath := filepath.Join(tempDir, "master.key")
+	if err := GenerateKeyFile(keyFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateKeyFile(keyFilePath); err == nil {
+		t.Fatal("expected existing key file not to be overwritten")
+	}
+}
+
+func TestNewEnvironmentKeyProvider_InvalidKey(t *testing.T) {
+	var tests = map[string]struct {
+		value         *string
+		expectedError error
+	}{
+		"not set": {
+			value: nil,
+			expectedError: fmt.Errorf(
+				"environment variable [%v] is not set",
+				testKeyVariable,
+			),
+		},
+		"not hexadecimal": {
+			value: stringPointer("not a key"),
+			expectedError: fmt.Errorf(
+				"invalid key in environment variable [%v]: "+
+					"[master key is not a hexadecimal string]",
+				testKeyVariable,
+			),
+		},
+		"too short": {
+			value: stringPointer("4242"),
+			expectedError: fmt.Errorf(
+				"invalid key in environment variable [%v]: "+
+					"[master key must be [32] bytes long; has [2]]",
+				testKeyVariable,
+			),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			if test.value != nil {
+				os.Setenv(testKeyVariable, *test.value)
+				defer os.Unsetenv(testKeyVariable)
+			}
+
+			_, err := NewEnvironmentKeyProvider(testKeyVariable)
+			if !reflect.DeepEqual(test.expectedError, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: %v\nactual:   %v",
+					test.expectedError,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
@@ -0,0 +1,417 @@
+package encryption
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptParams are the cost parameters of the scrypt key derivation function.
+type ScryptParams struct {
+	// LogN is the base-2 logarithm of the CPU/memory cost parameter N.
+	LogN uint8
+	// R is the block size parameter.
+	R uint32
+	// P is the parallelization parameter.
+	P uint32
+}
+
+// DefaultScryptParams are the scrypt parameters recommended for interactive
+// logins. Deriving a key takes roughly 100ms and 32MB of memory.
+var DefaultScryptParams = ScryptParams{LogN: 15, R: 8, P: 1}
+
+// passwordBoxCipher is the cipher used by the password box for encryption.
+const passwordBoxCipher = cipherXChaCha20Poly1305
+
+// Scrypt parameters are read from the ciphertext header which is not
+// authenticated before the key is derived. The limits below bound the memory
+// and time of key derivation so that a tampered header can not exhaust the
+// memory or make the decryption spin for a very long time.
+const (
+	maxScryptLogN = 22
+	maxScryptR    = 32
+	maxScryptP    = 16
+	// maxScryptMemory limits the memory used by scrypt, that is 128*r*N
+	// bytes.
+	maxScryptMemory = 256 << 20
+)
+
+func (sp ScryptParams) validate() error {
+	if sp.LogN == 0 || sp.LogN > maxScryptLogN {
+		return fmt.Errorf("invalid scrypt log2(N) [%v]", sp.LogN)
+	}
+
+	if sp.R == 0 || sp.R > maxScryptR {
+		return fmt.Errorf("invalid scrypt r [%v]", sp.R)
+	}
+
+	if sp.P == 0 || sp.P > maxScryptP {
+		return fmt.Errorf("invalid scrypt p [%v]", sp.P)
+	}
+
+	if memory := 128 * uint64(sp.R) << sp.LogN; memory > maxScryptMemory {
+		return fmt.Errorf(
+			"scrypt parameters require [%v] bytes of memory; "+
+				"at most [%v] bytes allowed",
+			memory,
+			maxScryptMemory,
+		)
+	}
+
+	return nil
+}
+
+// passwordBox is used to encrypt and decrypt a plaintext with a key derived
+// from a password.
+type passwordBox struct {
+	password []byte
+	params   ScryptParams
+
+	// header and key used for encryption, created on the first encryption
+	encryptionMutex  sync.Mutex
+	encryptionHeader envelopeHeader
+	encryptionKey    *[KeyLength]byte
+
+	// recently used keys, by salt and scrypt parameters
+	derivedKeys *derivedKeyCache
+}
+
+// NewPasswordBox uses XChaCha20 and Poly1305 to encrypt and decrypt the
+// plaintext with a key derived from the password with scrypt using the
+// default parameters. The salt and scrypt parameters are stored in the
+// ciphertext envelope.
+//
+// Ciphertexts produced with the XSalsa20 and Poly1305 secretbox are still
+// decrypted, including ones produced before the password-based key derivation
+// has been introduced, encrypted with a SHA-256 hash of the password used
+// as the key. Secretbox does not authenticate any associated data so for
+// such ciphertexts the associated data is ignored.
+//
+// The returned box implements StreamBox as well and decrypts ciphertexts
+// produced by its encrypting writer.
+func NewPasswordBox(password string) AEADBox {
+	return NewPasswordBoxWithParams(password, DefaultScryptParams)
+}
+
+// NewPasswordBoxWithParams works as NewPasswordBox but lets to specify scrypt
+// parameters used for encryption.
+func NewPasswordBoxWithParams(password string, params ScryptParams) AEADBox {
+	return &passwordBox{
+		password:    []byte(password),
+		params:      params,
+		derivedKeys: newDerivedKeyCache(derivedKeyCacheSize),
+	}
+}
+
+// Encrypt takes the input plaintext and uses XChaCha20 and Poly1305 to encrypt
+// the plaintext with the password-derived key. The key is derived only once,
+// with a random salt, and reused for subsequent encryptions.
+func (pb *passwordBox) Encrypt(plaintext []byte) ([]byte, error) {
+	return pb.EncryptWithAD(plaintext, nil)
+}
+
+// Decrypt takes the input ciphertext and decrypts it.
+func (pb *passwordBox) Decrypt(ciphertext []byte) ([]byte, error) {
+	return pb.DecryptWithAD(ciphertext, nil)
+}
+
+// EncryptWithAD works as Encrypt but additionally authenticates the provided
+// additional data.
+func (pb *passwordBox) EncryptWithAD(
+	plaintext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	header, key, err := pb.encryptionParams(passwordBoxCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealAEAD(
+		passwordBoxCipher,
+		key,
+		header,
+		plaintext,
+		additionalData,
+	)
+}
+
+// DecryptWithAD takes the input ciphertext and decrypts it. The additional
+// data has to be the same as the one provided for encryption unless the
+// ciphertext has been produced with secretbox.
+func (pb *passwordBox) DecryptWithAD(
+	ciphertext []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	if !isEnvelope(ciphertext) {
+		return openSecretbox(ciphertext, pb.legacyKey())
+	}
+
+	header, payload, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *[KeyLength]byte
+	switch header.kdf {
+	case kdfNone:
+		// Key box with a SHA-256 hash of the password used as the key.
+		key = pb.legacyKey()
+	default:
+		key, err = pb.deriveKey(header.salt, header.scrypt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	headerBytes := ciphertext[:len(ciphertext)-len(payload)]
+
+	var plaintext []byte
+	switch header.cipher {
+	case cipherSecretbox:
+		plaintext, err = openSecretbox(payload, key)
+	case cipherXChaCha20Poly1305Stream:
+		plaintext, err = decryptStream(key, headerBytes, payload, additionalData)
+	default:
+		plaintext, err = openAEAD(
+			header.cipher,
+			key,
+			headerBytes,
+			payload,
+			additionalData,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if header.kdf != kdfNone {
+		pb.cacheKey(header.salt, header.scrypt, key)
+	}
+
+	return plaintext, nil
+}
+
+// NewEncryptingWriter returns a writer encrypting all the data written to it
+// with the password-derived key and writing the ciphertext to the provided
+// writer. The writer must be closed to write the final chunk of the stream.
+func (pb *passwordBox) NewEncryptingWriter(
+	w io.Writer,
+	additionalData []byte,
+) (io.WriteCloser, error) {
+	header, key, err := pb.encryptionParams(cipherXChaCha20Poly1305Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEncryptingWriter(w, key, header, additionalData)
+}
+
+// NewDecryptingReader returns a reader decrypting the ciphertext read from
+// the provided reader with the password-derived key. The additional data has
+// to be the same as the one provided for encryption.
+func (pb *passwordBox) NewDecryptingReader(
+	r io.Reader,
+	additionalData []byte,
+) (io.Reader, error) {
+	headerBytes, header, err := readEnvelopeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.cipher != cipherXChaCha20Poly1305Stream {
+		return nil, fmt.Errorf("ciphertext is not a stream")
+	}
+
+	if header.kdf != kdfScrypt {
+		return newDecryptingReader(r, pb.legacyKey(), headerBytes, additionalData)
+	}
+
+	key, err := pb.deriveKey(header.salt, header.scrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newDecryptingReader(r, key, headerBytes, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyCachingReader{
+		reader: reader,
+		cacheKey: func() {
+			pb.cacheKey(header.salt, header.scrypt, key)
+		},
+	}, nil
+}
+
+// keyCachingReader caches the key used to decrypt the stream once the first
+// chunk of the stream is authenticated.
+type keyCachingReader struct {
+	reader   io.Reader
+	cacheKey func()
+	cached   bool
+}
+
+func (kcr *keyCachingReader) Read(p []byte) (int, error) {
+	n, err := kcr.reader.Read(p)
+	if !kcr.cached && (err == nil || err == io.EOF) {
+		kcr.cacheKey()
+		kcr.cached = true
+	}
+	return n, err
+}
+
+// legacyKey returns the key used to encrypt data with the password before
+// the password-based key derivation has been introduced.
+func (pb *passwordBox) legacyKey() *[KeyLength]byte {
+	key := sha256.Sum256(pb.password)
+	return &key
+}
+
+// encryptionParams returns the envelope header for the given cipher and the
+// key used for encryption. The key is derived on the first call.
+func (pb *passwordBox) encryptionParams(
+	cipher cipherID,
+) ([]byte, *[KeyLength]byte, error) {
+	pb.encryptionMutex.Lock()
+	defer pb.encryptionMutex.Unlock()
+
+	if pb.encryptionKey == nil {
+		salt := make([]byte, scryptSaltLength)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, fmt.Errorf("could not generate salt [%v]", err)
+		}
+
+		key, err := pb.deriveKey(salt, pb.params)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the key derived for encryption is known to be correct
+		pb.cacheKey(salt, pb.params, key)
+
+		pb.encryptionHeader = envelopeHeader{
+			kdf:    kdfScrypt,
+			salt:   salt,
+			scrypt: pb.params,
+		}
+		pb.encryptionKey = key
+	}
+
+	header := pb.encryptionHeader
+	header.cipher = cipher
+
+	return header.marshal(), pb.encryptionKey, nil
+}
+
+// deriveKey derives the key from the password with scrypt unless the key
+// for the given salt and parameters has been recently used.
+func (pb *passwordBox) deriveKey(
+	salt []byte,
+	params ScryptParams,
+) (*[KeyLength]byte, error) {
+	if key, ok := pb.derivedKeys.get(derivedKeyID(salt, params)); ok {
+		return key, nil
+	}
+
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	derived, err := scrypt.Key(
+		pb.password,
+		salt,
+		1<<params.LogN,
+		int(params.R),
+		int(params.P),
+		KeyLength,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed [%v]", err)
+	}
+
+	key := &[KeyLength]byte{}
+	copy(key[:], derived)
+
+	return key, nil
+}
+
+// cacheKey caches the derived key so that the expensive derivation does not
+// happen again for the given salt and parameters. Salt and parameters come
+// from the ciphertext header which is not authenticated so the key should be
+// cached only once the ciphertext has been authenticated with it.
+func (pb *passwordBox) cacheKey(
+	salt []byte,
+	params ScryptParams,
+	key *[KeyLength]byte,
+) {
+	pb.derivedKeys.add(derivedKeyID(salt, params), key)
+}
+
+func derivedKeyID(salt []byte, params ScryptParams) string {
+	return fmt.Sprintf("%x/%v/%v/%v", salt, params.LogN, params.R, params.P)
+}
+
+// derivedKeyCacheSize is the maximum number of derived keys cached by the
+// password box. Data encrypted with the same box share the salt so only a
+// few keys are expected to be in use at the same time.
+const derivedKeyCacheSize = 8
+
+// derivedKeyCache keeps the most recently used derived keys evicting the
+// least recently used one once the capacity is exceeded.
+type derivedKeyCache struct {
+	mutex    sync.Mutex
+	capacity int
+	keys     map[string]*list.Element
+	order    *list.List
+}
+
+type derivedKeyEntry struct {
+	id  string
+	key *[KeyLength]byte
+}
+
+func newDerivedKeyCache(capacity int) *derivedKeyCache {
+	return &derivedKeyCache{
+		capacity: capacity,
+		keys:     make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (dkc *derivedKeyCache) get(id string) (*[KeyLength]byte, bool) {
+	dkc.mutex.Lock()
+	defer dkc.mutex.Unlock()
+
+	element, ok := dkc.keys[id]
+	if !ok {
+		return nil, false
+	}
+
+	dkc.order.MoveToFront(element)
+
+	return element.Value.(*derivedKeyEntry).key, true
+}
+
+func (dkc *derivedKeyCache) add(id string, key *[KeyLength]byte) {
+	dkc.mutex.Lock()
+	defer dkc.mutex.Unlock()
+
+	if element, ok := dkc.keys[id]; ok {
+		dkc.order.MoveToFront(element)
+		return
+	}
+
+	dkc.keys[id] = dkc.order.PushFront(&derivedKeyEntry{id: id, key: key})
+
+	if dkc.order.Len() > dkc.capacity {
+		oldest := dkc.order.Back()
+		dkc.order.Remove(oldest)
+		delete(dkc.keys, oldest.Value.(*derivedKeyEntry).id)
+	}
+}
@@ -0,0 +1,270 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// testScryptParams keep the key derivation fast in tests.
+var testScryptParams = ScryptParams{LogN: 10, R: 8, P: 1}
+
+func TestPasswordBoxEncryptDecrypt(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	encrypted, err := box.Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err := parseEnvelope(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.kdf != kdfScrypt || header.scrypt != testScryptParams {
+		t.Fatalf("unexpected envelope header: [%+v]", header)
+	}
+
+	// a new box has to derive the key from parameters in the envelope
+	otherBox := NewPasswordBox(string(accountPassword))
+
+	decrypted, err := otherBox.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, decrypted) {
+		t.Fatalf(
+			"unexpected message\nexpected: %v\nactual:   %v",
+			msg,
+			decrypted,
+		)
+	}
+}
+
+func TestPasswordBoxDecryptLegacyCiphertext(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+	key := sha256.Sum256(accountPassword)
+
+	var nonce [NonceSize]byte
+	bare := secretbox.Seal(nonce[:], msg, &nonce, &key)
+
+	keyBoxEncrypted, err := NewBox(key).Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	var tests = map[string]struct {
+		ciphertext []byte
+	}{
+		"bare ciphertext": {
+			ciphertext: bare,
+		},
+		"key box envelope": {
+			ciphertext: keyBoxEncrypted,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			decrypted, err := box.Decrypt(test.ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(msg, decrypted) {
+				t.Fatalf(
+					"unexpected message\nexpected: %v\nactual:   %v",
+					msg,
+					decrypted,
+				)
+			}
+		})
+	}
+}
+
+func TestPasswordBoxWrongPassword(t *testing.T) {
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewPasswordBox("wrong").Decrypt(encrypted)
+	if err == nil {
+		t.Fatal("expected decryption with wrong password to fail")
+	}
+}
+
+func TestPasswordBoxRefuseExcessiveScryptParams(t *testing.T) {
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log2(N) follows the magic, version, cipher id, KDF id and salt
+	encrypted[envelopeHeaderLength+scryptSaltLength] = maxScryptLogN + 1
+
+	_, err = NewPasswordBox(string(accountPassword)).Decrypt(encrypted)
+	if err == nil {
+		t.Fatal("expected excessive scrypt parameters to be refused")
+	}
+}
+
+func TestPasswordBoxRefuseTamperedScryptParams(t *testing.T) {
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	encrypted, err := box.Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// scrypt parameters follow the magic, version, cipher id, KDF id and salt
+	paramsOffset := envelopeHeaderLength + scryptSaltLength
+
+	var tests = map[string]ScryptParams{
+		"huge r":           {LogN: 22, R: 1 << 24, P: 1},
+		"excessive r":      {LogN: 10, R: maxScryptR + 1, P: 1},
+		"excessive p":      {LogN: 10, R: 8, P: 1 << 29},
+		"excessive memory": {LogN: 22, R: 8, P: 1},
+		"zero r":           {LogN: 10, R: 0, P: 1},
+		"zero p":           {LogN: 10, R: 8, P: 0},
+	}
+
+	for testName, params := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tampered := make([]byte, len(encrypted))
+			copy(tampered, encrypted)
+
+			tampered[paramsOffset] = params.LogN
+			binary.BigEndian.PutUint32(tampered[paramsOffset+1:], params.R)
+			binary.BigEndian.PutUint32(tampered[paramsOffset+5:], params.P)
+
+			_, err := NewPasswordBox(string(accountPassword)).Decrypt(tampered)
+			if err == nil {
+				t.Fatal("expected tampered scrypt parameters to be refused")
+			}
+		})
+	}
+}
+
+func TestPasswordBoxAssociatedData(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+
+	box := NewPasswordBoxWithParams(string(accountPassword), testScryptParams)
+
+	encrypted, err := box.EncryptWithAD(msg, []byte("0x424242/membership"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := box.DecryptWithAD(encrypted, []byte("0x424242/membership"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, decrypted) {
+		t.Fatalf(
+			"unexpected message\nexpected: %v\nactual:   %v",
+			msg,
+			decrypted,
+		)
+	}
+
+	_, err = box.DecryptWithAD(encrypted, []byte("0x777777/membership"))
+	if err == nil {
+		t.Fatal("expected decryption with other associated data to fail")
+	}
+}
+
+func TestPasswordBoxCacheKeyOnlyWhenAuthenticated(t *testing.T) {
+	encrypted, err := NewPasswordBoxWithParams(
+		string(accountPassword),
+		testScryptParams,
+	).Encrypt([]byte("Keep Calm and Carry On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, err := parseEnvelope(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := derivedKeyID(header.salt, header.scrypt)
+
+	box := NewPasswordBox(string(accountPassword)).(*passwordBox)
+
+	tampered := make([]byte, len(encrypted))
+	copy(tampered, encrypted)
+	tampered[len(tampered)-1] ^= 0x01
+
+	_, err = box.Decrypt(tampered)
+	if err == nil {
+		t.Fatal("expected decryption of tampered ciphertext to fail")
+	}
+
+	if _, ok := box.derivedKeys.get(keyID); ok {
+		t.Fatal("key has been cached for unauthenticated ciphertext")
+	}
+
+	_, err = box.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := box.derivedKeys.get(keyID); !ok {
+		t.Fatal("key has not been cached for authenticated ciphertext")
+	}
+}
+
+func TestPasswordBoxBoundedKeyCache(t *testing.T) {
+	box := NewPasswordBox(string(accountPassword)).(*passwordBox)
+
+	keyIDs := make([]string, derivedKeyCacheSize+2)
+	for i := range keyIDs {
+		// each box encrypts with a key derived with its own salt
+		encrypted, err := NewPasswordBoxWithParams(
+			string(accountPassword),
+			testScryptParams,
+		).Encrypt([]byte("Keep Calm and Carry On"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, _, err := parseEnvelope(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyIDs[i] = derivedKeyID(header.salt, header.scrypt)
+
+		if _, err := box.Decrypt(encrypted); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cached := box.derivedKeys.order.Len(); cached != derivedKeyCacheSize {
+		t.Fatalf(
+			"unexpected number of cached keys\nexpected: [%v]\nactual:   [%v]",
+			derivedKeyCacheSize,
+			cached,
+		)
+	}
+
+	// the least recently used keys have been evicted
+	for i, keyID := range keyIDs {
+		_, ok := box.derivedKeys.get(keyID)
+		if expected := i >= 2; ok != expected {
+			t.Errorf("key [%v] cached [%v]; expected [%v]", i, ok, expected)
+		}
+	}
+}
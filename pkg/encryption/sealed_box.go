@@ -0,0 +1,218 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+	naclbox "golang.org/x/crypto/nacl/box"
+)
+
+// PublicKeyLength represents the byte size of the public and private key
+// used by sealed boxes.
+const PublicKeyLength = 32
+
+// PublicKey is a Curve25519 public key of the sealed box recipient.
+type PublicKey [PublicKeyLength]byte
+
+// PrivateKey is a Curve25519 private key of the sealed box recipient.
+type PrivateKey [PublicKeyLength]byte
+
+// GenerateKeyPair generates a new random key pair to be used with sealed
+// boxes.
+func GenerateKeyPair() (*PublicKey, *PrivateKey, error) {
+	publicKey, privateKey, err := naclbox.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate key pair [%v]", err)
+	}
+
+	return (*PublicKey)(publicKey), (*PrivateKey)(privateKey), nil
+}
+
+// PublicKey returns the public key matching the private key.
+func (pk *PrivateKey) PublicKey() *PublicKey {
+	publicKey := &PublicKey{}
+	curve25519.ScalarBaseMult(
+		(*[PublicKeyLength]byte)(publicKey),
+		(*[PublicKeyLength]byte)(pk),
+	)
+	return publicKey
+}
+
+// Marshal serializes the public key to bytes.
+func (pk *PublicKey) Marshal() []byte {
+	return append([]byte{}, pk[:]...)
+}
+
+// UnmarshalPublicKey deserializes the public key from bytes.
+func UnmarshalPublicKey(bytes []byte) (*PublicKey, error) {
+	if len(bytes) != PublicKeyLength {
+		return nil, fmt.Errorf(
+			"public key must be [%v] bytes long; has [%v]",
+			PublicKeyLength,
+			len(bytes),
+		)
+	}
+
+	publicKey := &PublicKey{}
+	copy(publicKey[:], bytes)
+
+	return publicKey, nil
+}
+
+// MarshalText serializes the public key to a hexadecimal string.
+func (pk *PublicKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(pk[:])), nil
+}
+
+// UnmarshalText deserializes the public key from a hexadecimal string.
+func (pk *PublicKey) UnmarshalText(text []byte) error {
+	return unmarshalHexKey("public key", text, pk[:])
+}
+
+// Marshal serializes the private key to bytes.
+func (pk *PrivateKey) Marshal() []byte {
+	return append([]byte{}, pk[:]...)
+}
+
+// UnmarshalPrivateKey deserializes the private key from bytes.
+func UnmarshalPrivateKey(bytes []byte) (*PrivateKey, error) {
+	if len(bytes) != PublicKeyLength {
+		return nil, fmt.Errorf(
+			"private key must be [%v] bytes long; has [%v]",
+			PublicKeyLength,
+			len(bytes),
+		)
+	}
+
+	privateKey := &PrivateKey{}
+	copy(privateKey[:], bytes)
+
+	return privateKey, nil
+}
+
+// MarshalText serializes the private key to a hexadecimal string.
+func (pk *PrivateKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(pk[:])), nil
+}
+
+// UnmarshalText deserializes the private key from a hexadecimal string.
+func (pk *PrivateKey) UnmarshalText(text []byte) error {
+	return unmarshalHexKey("private key", text, pk[:])
+}
+
+func unmarshalHexKey(keyType string, text []byte, key []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("%v is not a hexadecimal string", keyType)
+	}
+
+	if len(decoded) != len(key) {
+		return fmt.Errorf(
+			"%v must be [%v] bytes long; has [%v]",
+			keyType,
+			len(key),
+			len(decoded),
+		)
+	}
+
+	copy(key, decoded)
+
+	return nil
+}
+
+// sealedBox is used to decrypt ciphertexts sealed for the owner of the
+// private key.
+type sealedBox struct {
+	privateKey *PrivateKey
+	publicKey  *PublicKey
+}
+
+// NewSealedBox uses Curve25519, XSalsa20 and Poly1305 to encrypt the plaintext
+// for the recipient with their public key and to decrypt ciphertexts sealed
+// for the owner of the private key. The ciphertext format is compatible with
+// libsodium's crypto_box_seal.
+func NewSealedBox(privateKey *PrivateKey) SealedBox {
+	return &sealedBox{
+		privateKey: privateKey,
+		publicKey:  privateKey.PublicKey(),
+	}
+}
+
+// Seal encrypts the plaintext for the recipient with their public key.
+func (sb *sealedBox) Seal(plaintext []byte, recipient *PublicKey) ([]byte, error) {
+	return Seal(plaintext, recipient)
+}
+
+// Open decrypts the ciphertext sealed for the owner of the private key.
+func (sb *sealedBox) Open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < PublicKeyLength+naclbox.Overhead {
+		return nil, fmt.Errorf("sealed box decryption failed")
+	}
+
+	ephemeralPublicKey := &PublicKey{}
+	copy(ephemeralPublicKey[:], ciphertext[:PublicKeyLength])
+
+	nonce, err := sealedBoxNonce(ephemeralPublicKey, sb.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := naclbox.Open(
+		nil,
+		ciphertext[PublicKeyLength:],
+		nonce,
+		(*[PublicKeyLength]byte)(ephemeralPublicKey),
+		(*[PublicKeyLength]byte)(sb.privateKey),
+	)
+	if !ok {
+		return nil, fmt.Errorf("sealed box decryption failed")
+	}
+
+	return plaintext, nil
+}
+
+// Seal encrypts the plaintext for the recipient with their public key using
+// a new ephemeral key pair. Only the recipient is able to decrypt the
+// ciphertext; the sender is not able to decrypt it and remains anonymous.
+func Seal(plaintext []byte, recipient *PublicKey) ([]byte, error) {
+	ephemeralPublicKey, ephemeralPrivateKey, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := sealedBoxNonce(ephemeralPublicKey, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return naclbox.Seal(
+		ephemeralPublicKey.Marshal(),
+		plaintext,
+		nonce,
+		(*[PublicKeyLength]byte)(recipient),
+		(*[PublicKeyLength]byte)(ephemeralPrivateKey),
+	), nil
+}
+
+// sealedBoxNonce computes the nonce as BLAKE2b of the ephemeral and the
+// recipient public key, as libsodium's crypto_box_seal does.
+func sealedBoxNonce(
+	ephemeralPublicKey *PublicKey,
+	recipient *PublicKey,
+) (*[NonceSize]byte, error) {
+	hash, err := blake2b.New(NonceSize, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute nonce [%v]", err)
+	}
+
+	hash.Write(ephemeralPublicKey[:])
+	hash.Write(recipient[:])
+
+	nonce := &[NonceSize]byte{}
+	copy(nonce[:], hash.Sum(nil))
+
+	return nonce, nil
+}
@@ -0,0 +1,135 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+
+	publicKey, privateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := Seal(msg, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := NewSealedBox(privateKey).Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, opened) {
+		t.Fatalf(
+			"unexpected message\nexpected: %v\nactual:   %v",
+			msg,
+			opened,
+		)
+	}
+}
+
+func TestSealedBoxRefuseOpen(t *testing.T) {
+	msg := []byte("Keep Calm and Carry On")
+
+	publicKey, privateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherPrivateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := NewSealedBox(otherPrivateKey).Seal(msg, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	var tests = map[string]struct {
+		privateKey *PrivateKey
+		ciphertext []byte
+	}{
+		"other recipient": {
+			privateKey: otherPrivateKey,
+			ciphertext: sealed,
+		},
+		"tampered ciphertext": {
+			privateKey: privateKey,
+			ciphertext: tampered,
+		},
+		"truncated ciphertext": {
+			privateKey: privateKey,
+			ciphertext: sealed[:PublicKeyLength],
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := NewSealedBox(test.privateKey).Open(test.ciphertext)
+			if err == nil {
+				t.Fatal("expected opening to fail")
+			}
+		})
+	}
+}
+
+func TestKeySerialization(t *testing.T) {
+	publicKey, privateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(publicKey, privateKey.PublicKey()) {
+		t.Fatal("public key does not match the private key")
+	}
+
+	unmarshalledPublicKey, err := UnmarshalPublicKey(publicKey.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(publicKey, unmarshalledPublicKey) {
+		t.Fatal("unexpected unmarshalled public key")
+	}
+
+	unmarshalledPrivateKey, err := UnmarshalPrivateKey(privateKey.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(privateKey, unmarshalledPrivateKey) {
+		t.Fatal("unexpected unmarshalled private key")
+	}
+
+	type keys struct {
+		PublicKey  *PublicKey
+		PrivateKey *PrivateKey
+	}
+
+	encoded, err := json.Marshal(&keys{publicKey, privateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &keys{}
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&keys{publicKey, privateKey}, decoded) {
+		t.Fatalf("unexpected decoded keys: [%s]", encoded)
+	}
+
+	_, err = UnmarshalPublicKey([]byte{0x01})
+	if err == nil {
+		t.Fatal("expected error for too short public key")
+	}
+}
@@ -0,0 +1,295 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The stream is encrypted with XChaCha20 and Poly1305 in chunks of
+// streamChunkSize bytes of plaintext, each one authenticated separately.
+// The stream has the following layout:
+//
+//	envelope header | nonce prefix (19 bytes) | chunk | ... | final chunk
+//
+// Nonce of each chunk consists of the nonce prefix, random for each stream,
+// the 4 bytes long chunk counter and the final chunk flag byte. The counter
+// protects against reordering chunks and the final chunk flag against
+// truncating the stream at the chunk boundary. The final chunk may be empty.
+// Envelope header is authenticated along with each chunk.
+const (
+	streamChunkSize         = 64 * 1024
+	streamNoncePrefixLength = chacha20poly1305.NonceSizeX - 5
+)
+
+// NewEncryptingWriter returns a writer encrypting all the data written to it
+// with the key and writing the ciphertext to the provided writer. The writer
+// must be closed to write the final chunk of the stream.
+func (sb *streamBox) NewEncryptingWriter(
+	w io.Writer,
+	additionalData []byte,
+) (io.WriteCloser, error) {
+	header := &envelopeHeader{cipher: cipherXChaCha20Poly1305Stream, kdf: kdfNone}
+
+	return newEncryptingWriter(w, &sb.key, header.marshal(), additionalData)
+}
+
+// NewDecryptingReader returns a reader decrypting the ciphertext read from
+// the provided reader with the key. The additional data has to be the same as
+// the one provided for encryption.
+func (sb *streamBox) NewDecryptingReader(
+	r io.Reader,
+	additionalData []byte,
+) (io.Reader, error) {
+	headerBytes, header, err := readEnvelopeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.kdf != kdfNone {
+		return nil, fmt.Errorf(
+			"ciphertext is encrypted with a password-derived key",
+		)
+	}
+
+	if header.cipher != cipherXChaCha20Poly1305Stream {
+		return nil, fmt.Errorf("ciphertext is not a stream")
+	}
+
+	return newDecryptingReader(r, &sb.key, headerBytes, additionalData)
+}
+
+// decryptStream decrypts the whole stream payload following the envelope
+// header.
+func decryptStream(
+	key *[KeyLength]byte,
+	header []byte,
+	payload []byte,
+	additionalData []byte,
+) ([]byte, error) {
+	reader, err := newDecryptingReader(
+		bytes.NewReader(payload),
+		key,
+		header,
+		additionalData,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+type encryptingWriter struct {
+	writer         io.Writer
+	aead           cipher.AEAD
+	additionalData []byte
+	noncePrefix    []byte
+	counter        uint32
+
+	// plaintext not encrypted yet; it is encrypted only once more data are
+	// written or the writer is closed so that the final chunk is known
+	buffer []byte
+	sealed []byte
+	closed bool
+}
+
+func newEncryptingWriter(
+	w io.Writer,
+	key *[KeyLength]byte,
+	header []byte,
+	additionalData []byte,
+) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("key encryption failed [%v]", err)
+	}
+
+	noncePrefix := make([]byte, streamNoncePrefixLength)
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return nil, fmt.Errorf("key encryption failed [%v]", err)
+	}
+
+	if _, err := w.Write(concat(header, noncePrefix)); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		writer:         w,
+		aead:           aead,
+		additionalData: concat(header, additionalData),
+		noncePrefix:    noncePrefix,
+		buffer:         make([]byte, 0, streamChunkSize),
+		sealed:         make([]byte, 0, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("write to closed encrypting writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buffer) == streamChunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(ew.buffer[len(ew.buffer):streamChunkSize], p)
+		ew.buffer = ew.buffer[:len(ew.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close encrypts and writes the final chunk of the stream. It does not close
+// the underlying writer.
+func (ew *encryptingWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+
+	return ew.flush(true)
+}
+
+func (ew *encryptingWriter) flush(final bool) error {
+	nonce, err := streamChunkNonce(ew.noncePrefix, ew.counter, final)
+	if err != nil {
+		return err
+	}
+
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], nonce, ew.buffer, ew.additionalData)
+	if _, err := ew.writer.Write(ew.sealed); err != nil {
+		return err
+	}
+
+	ew.buffer = ew.buffer[:0]
+	ew.counter++
+
+	return nil
+}
+
+type decryptingReader struct {
+	reader         *bufio.Reader
+	aead           cipher.AEAD
+	additionalData []byte
+	noncePrefix    []byte
+	counter        uint32
+
+	chunk     []byte
+	plaintext []byte
+	finished  bool
+}
+
+func newDecryptingReader(
+	r io.Reader,
+	key *[KeyLength]byte,
+	header []byte,
+	additionalData []byte,
+) (io.Reader, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("symmetric key decryption failed [%v]", err)
+	}
+
+	noncePrefix := make([]byte, streamNoncePrefixLength)
+	if _, err := io.ReadFull(r, noncePrefix); err != nil {
+		return nil, fmt.Errorf("stream truncated; missing nonce prefix")
+	}
+
+	return &decryptingReader{
+		reader:         bufio.NewReader(r),
+		aead:           aead,
+		additionalData: concat(header, additionalData),
+		noncePrefix:    noncePrefix,
+		chunk:          make([]byte, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.plaintext) == 0 {
+		if dr.finished {
+			return 0, io.EOF
+		}
+
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.plaintext)
+	dr.plaintext = dr.plaintext[n:]
+
+	return n, nil
+}
+
+func (dr *decryptingReader) readChunk() error {
+	final := false
+
+	n, err := io.ReadFull(dr.reader, dr.chunk)
+	switch err {
+	case nil:
+		// full chunk is the final one only if nothing follows it
+		if _, err := dr.reader.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		return fmt.Errorf("stream truncated; missing final chunk")
+	default:
+		return err
+	}
+
+	nonce, err := streamChunkNonce(dr.noncePrefix, dr.counter, final)
+	if err != nil {
+		return err
+	}
+
+	dr.plaintext, err = dr.aead.Open(
+		dr.chunk[:0],
+		nonce,
+		dr.chunk[:n],
+		dr.additionalData,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"symmetric key decryption failed for stream chunk [%v]",
+			dr.counter,
+		)
+	}
+
+	dr.counter++
+	dr.finished = final
+
+	return nil
+}
+
+func streamChunkNonce(prefix []byte, counter uint32, final bool) ([]byte, error) {
+	if counter == ^uint32(0) {
+		return nil, fmt.Errorf("maximum stream length exceeded")
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixLength:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce, nil
+}
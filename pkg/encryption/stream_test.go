@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var streamTestAdditionalData = []byte("0x424242/snapshot")
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	boxes := map[string]AEADBox{
+		"XChaCha20-Poly1305 box": NewXChaCha20Poly1305Box(
+			sha256.Sum256(accountPassword),
+		),
+		"password box": NewPasswordBoxWithParams(
+			string(accountPassword),
+			testScryptParams,
+		),
+	}
+
+	sizes := map[string]int{
+		"empty":                0,
+		"single byte":          1,
+		"less than chunk":      streamChunkSize - 1,
+		"exactly one chunk":    streamChunkSize,
+		"more than chunk":      streamChunkSize + 1,
+		"multiple chunks":      3*streamChunkSize + 5,
+		"exactly three chunks": 3 * streamChunkSize,
+	}
+
+	for boxName, box := range boxes {
+		for sizeName, size := range sizes {
+			t.Run(boxName+"/"+sizeName, func(t *testing.T) {
+				msg := randomBytes(t, size)
+
+				encrypted := encryptStream(t, box.(StreamBox), msg)
+
+				reader, err := box.(StreamBox).NewDecryptingReader(
+					bytes.NewReader(encrypted),
+					streamTestAdditionalData,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				decrypted, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(msg, decrypted) {
+					t.Fatalf("unexpected decrypted stream of [%v] bytes", size)
+				}
+
+				// stream ciphertext can be decrypted as a whole as well
+				decrypted, err = box.DecryptWithAD(
+					encrypted,
+					streamTestAdditionalData,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(msg, decrypted) {
+					t.Fatalf("unexpected decrypted ciphertext of [%v] bytes", size)
+				}
+			})
+		}
+	}
+}
+
+func TestStreamRefuseTampered(t *testing.T) {
+	box := NewXChaCha20Poly1305Box(sha256.Sum256(accountPassword))
+
+	msg := randomBytes(t, 2*streamChunkSize+10)
+	encrypted := encryptStream(t, box.(StreamBox), msg)
+
+	headerLength := envelopeHeaderLength + streamNoncePrefixLength
+	chunkLength := streamChunkSize + 16
+
+	var tests = map[string]struct {
+		ciphertext     []byte
+		additionalData []byte
+	}{
+		"truncated at chunk boundary": {
+			ciphertext:     encrypted[:headerLength+2*chunkLength],
+			additionalData: streamTestAdditionalData,
+		},
+		"truncated inside chunk": {
+			ciphertext:     encrypted[:headerLength+chunkLength+100],
+			additionalData: streamTestAdditionalData,
+		},
+		"truncated final chunk": {
+			ciphertext:     encrypted[:len(encrypted)-1],
+			additionalData: streamTestAdditionalData,
+		},
+		"reordered chunks": {
+			ciphertext: concat(
+				concat(
+					encrypted[:headerLength],
+					encrypted[headerLength+chunkLength:headerLength+2*chunkLength],
+				),
+				concat(
+					encrypted[headerLength:headerLength+chunkLength],
+					encrypted[headerLength+2*chunkLength:],
+				),
+			),
+			additionalData: streamTestAdditionalData,
+		},
+		"modified chunk": {
+			ciphertext: func() []byte {
+				modified := concat(encrypted, nil)
+				modified[headerLength+10] ^= 0x01
+				return modified
+			}(),
+			additionalData: streamTestAdditionalData,
+		},
+		"other additional data": {
+			ciphertext:     encrypted,
+			additionalData: []byte("0x777777/snapshot"),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reader, err := box.(StreamBox).NewDecryptingReader(
+				bytes.NewReader(test.ciphertext),
+				test.additionalData,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ioutil.ReadAll(reader)
+			if err == nil {
+				t.Fatal("expected decryption of tampered stream to fail")
+			}
+		})
+	}
+}
+
+func encryptStream(t *testing.T, box StreamBox, msg []byte) []byte {
+	var encrypted bytes.Buffer
+
+	writer, err := box.NewEncryptingWriter(&encrypted, streamTestAdditionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write in pieces not aligned with chunks; the reader is wrapped to hide
+	// its WriteTo method that would write everything at once
+	_, err = io.CopyBuffer(
+		writer,
+		struct{ io.Reader }{bytes.NewReader(msg)},
+		make([]byte, 1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted.Bytes()
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
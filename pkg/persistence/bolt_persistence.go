@@ -0,0 +1,950 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltOpenTimeout = 5 * time.Second
+
+// boltMetadataBucket keeps the metadata of the store, separately from the
+// storage area buckets.
+const boltMetadataBucket = ".metadata"
+
+// boltFormatKey is the key of the storage format in the metadata bucket.
+var boltFormatKey = []byte("format")
+
+// NewBoltHandle creates data persistence handle backed by an embedded bbolt
+// key-value store kept in a single file under the provided path. The file is
+// created if it does not exist. The handle follows the same directory and
+// name namespacing, as well as current, archive and snapshot semantics as
+// the on-disk handle. The returned handle implements io.Closer and should be
+// closed when it is no longer used.
+func NewBoltHandle(path string) (Handle, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not open the store [%v]: [%v]", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, area := range []string{
+			currentDir,
+			archiveDir,
+			snapshotDir,
+			quarantineDir,
+		} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(area)); err != nil {
+				return err
+			}
+		}
+		return migrateBoltChecksumFormat(tx)
+	})
+	if err != nil {
+		if closeErr := db.Close(); closeErr != nil {
+			logger.Errorf("could not close the store [%v]: [%v]", path, closeErr)
+		}
+		return nil, fmt.Errorf("could not initialize the store: [%v]", err)
+	}
+
+	snapshotSuffixGenerator := func() string {
+		return snapshotSuffix(time.Now())
+	}
+
+	return &boltPersistence{
+		db:                      db,
+		snapshotSuffixGenerator: snapshotSuffixGenerator,
+	}, nil
+}
+
+// boltPersistence keeps each storage area in a separate top-level bucket.
+// Each directory is a nested bucket of the area bucket and each piece of data
+// is a key in the directory bucket.
+type boltPersistence struct {
+	db *bolt.DB
+
+	snapshotMutex           sync.Mutex
+	snapshotSuffixGenerator func() string
+}
+
+func (bp *boltPersistence) Close() error {
+	return bp.db.Close()
+}
+
+func (bp *boltPersistence) Save(data []byte, directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		return putInBucket(tx, currentDir, directory, name, addChecksum(data))
+	})
+}
+
+func (bp *boltPersistence) Snapshot(data []byte, directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	snapshotSuffix := bp.snapshotSuffixGenerator()
+
+	maxSnapshotNameLength := maxFileNameLength - len(snapshotSuffix)
+	if len(name) > maxSnapshotNameLength {
+		return fmt.Errorf(
+			"the maximum file name length of [%v] exceeded for [%v]",
+			maxSnapshotNameLength,
+			name,
+		)
+	}
+
+	err = validatePathSegment("file", name)
+	if err != nil {
+		return err
+	}
+
+	bp.snapshotMutex.Lock()
+	defer bp.snapshotMutex.Unlock()
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(snapshotDir)).Bucket([]byte(directory))
+
+		// very unlikely but better fail than overwrite an existing snapshot
+		if bucket != nil && bucket.Get([]byte(name+snapshotSuffix)) != nil {
+			return fmt.Errorf(
+				"could not create unique snapshot; " +
+					"snapshot name collision has been detected",
+			)
+		}
+
+		return putInBucket(
+			tx,
+			snapshotDir,
+			directory,
+			name+snapshotSuffix,
+			addChecksum(data),
+		)
+	})
+}
+
+func (bp *boltPersistence) Begin() (Transaction, error) {
+	return newBufferedTransaction(func(staged []*stagedData) error {
+		return bp.db.Update(func(tx *bolt.Tx) error {
+			for _, data := range staged {
+				err := putInBucket(
+					tx,
+					currentDir,
+					data.directory,
+					data.name,
+					addChecksum(data.data),
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}), nil
+}
+
+func (bp *boltPersistence) ReadAll(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	return bp.readAll(currentDir, newReadOptions(options))
+}
+
+func (bp *boltPersistence) ReadArchived(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	return bp.readAll(archiveDir, newReadOptions(options))
+}
+
+func (bp *boltPersistence) Archive(directory string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		return moveBucket(tx, currentDir, archiveDir, directory)
+	})
+}
+
+func (bp *boltPersistence) Unarchive(directory string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(archiveDir)).Bucket([]byte(directory)) == nil {
+			return fmt.Errorf("directory [%v] is not archived", directory)
+		}
+
+		return moveBucket(tx, archiveDir, currentDir, directory)
+	})
+}
+
+func (bp *boltPersistence) Read(directory, name string) ([]byte, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := bp.get(currentDir, directory, name)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not read [%v] from directory [%v]: [%v]",
+			name,
+			directory,
+			err,
+		)
+	}
+
+	return data, nil
+}
+
+func (bp *boltPersistence) Delete(directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(currentDir)).Bucket([]byte(directory))
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return fmt.Errorf(
+				"could not delete [%v] from directory [%v]: [no such data]",
+				name,
+				directory,
+			)
+		}
+
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (bp *boltPersistence) List(directory string) ([]string, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+
+	err = bp.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(currentDir)).Bucket([]byte(directory))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key, value []byte) error {
+			names = append(names, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (bp *boltPersistence) ListSnapshots(
+	directory string,
+	name string,
+) ([]SnapshotDescriptor, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots map[string][]*snapshotDescriptor
+	err = bp.db.View(func(tx *bolt.Tx) error {
+		snapshots = bp.readSnapshots(tx, directory)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := make([]SnapshotDescriptor, len(snapshots[name]))
+	for i, snapshot := range snapshots[name] {
+		descriptors[i] = snapshot
+	}
+
+	return descriptors, nil
+}
+
+func (bp *boltPersistence) RestoreSnapshot(
+	directory string,
+	name string,
+	timestamp time.Time,
+) error {
+	snapshots, err := bp.ListSnapshots(directory, name)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if !snapshot.Timestamp().Equal(timestamp) {
+			continue
+		}
+
+		data, err := snapshot.Content()
+		if err != nil {
+			return fmt.Errorf("could not read snapshot: [%v]", err)
+		}
+
+		return bp.Save(data, directory, name)
+	}
+
+	return fmt.Errorf(
+		"no snapshot of [%v] in directory [%v] taken at [%v]",
+		name,
+		directory,
+		timestamp,
+	)
+}
+
+func (bp *boltPersistence) PruneSnapshots(policy *SnapshotRetentionPolicy) error {
+	if policy == nil {
+		return errNoRetentionPolicy
+	}
+
+	bp.snapshotMutex.Lock()
+	defer bp.snapshotMutex.Unlock()
+
+	now := time.Now()
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		areaBucket := tx.Bucket([]byte(snapshotDir))
+
+		for _, directory := range bucketDirectories(areaBucket) {
+			bucket := areaBucket.Bucket([]byte(directory))
+
+			for _, snapshots := range bp.readSnapshots(tx, directory) {
+				for i, snapshot := range snapshots {
+					position := len(snapshots) - 1 - i
+					if policy.retains(position, snapshot.timestamp, now) {
+						continue
+					}
+
+					err := bucket.Delete([]byte(snapshot.snapshotName))
+					if err != nil {
+						return fmt.Errorf(
+							"could not remove snapshot [%v/%v]: [%v]",
+							directory,
+							snapshot.snapshotName,
+							err,
+						)
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// readSnapshots reads all snapshots from the given directory and groups them
+// by the name of the data snapshotted, just like the on-disk handle does.
+func (bp *boltPersistence) readSnapshots(
+	tx *bolt.Tx,
+	directory string,
+) map[string][]*snapshotDescriptor {
+	snapshots := make(map[string][]*snapshotDescriptor)
+
+	bucket := tx.Bucket([]byte(snapshotDir)).Bucket([]byte(directory))
+	if bucket == nil {
+		return snapshots
+	}
+
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		name, timestamp, ok := parseSnapshotFileName(string(key))
+		if !ok {
+			continue
+		}
+
+		// capture shared loop variable for the closure
+		snapshotName := string(key)
+
+		snapshots[name] = append(snapshots[name], &snapshotDescriptor{
+			dataDescriptor: dataDescriptor{
+				name:      name,
+				directory: directory,
+				readFunc: func() ([]byte, error) {
+					return bp.get(snapshotDir, directory, snapshotName)
+				},
+			},
+			timestamp:    timestamp,
+			snapshotName: snapshotName,
+		})
+	}
+
+	for _, nameSnapshots := range snapshots {
+		sort.Slice(nameSnapshots, func(i, j int) bool {
+			return nameSnapshots[i].timestamp.Before(nameSnapshots[j].timestamp)
+		})
+	}
+
+	return snapshots
+}
+
+// readAll outputs all data from the given area as DataDescriptors following
+// the same contract as the on-disk handle. Keys are collected in a single
+// read transaction and the content is read lazily in a separate transaction
+// so that slow consumers do not keep the read transaction open.
+func (bp *boltPersistence) readAll(
+	area string,
+	options *readOptions,
+) (<-chan DataDescriptor, <-chan error) {
+	return readDescriptors(options, func(
+		emit func(DataDescriptor) bool,
+		emitError func(error) bool,
+	) {
+		descriptors := make([]*dataDescriptor, 0)
+
+		err := bp.db.View(func(tx *bolt.Tx) error {
+			areaBucket := tx.Bucket([]byte(area))
+
+			return areaBucket.ForEach(func(directoryKey, value []byte) error {
+				// nested buckets have nil values
+				if value != nil {
+					return nil
+				}
+
+				directory := string(directoryKey)
+				if !options.matches(directory) {
+					return nil
+				}
+
+				return areaBucket.Bucket(directoryKey).ForEach(
+					func(nameKey, _ []byte) error {
+						// capture shared loop variable for the closure
+						name := string(nameKey)
+
+						descriptors = append(descriptors, &dataDescriptor{
+							name:      name,
+							directory: directory,
+							readFunc: func() ([]byte, error) {
+								return bp.get(area, directory, name)
+							},
+						})
+						return nil
+					},
+				)
+			})
+		})
+		if err != nil {
+			emitError(fmt.Errorf(
+				"could not read the [%v] area: [%v]",
+				area,
+				err,
+			))
+			return
+		}
+
+		for _, descriptor := range descriptors {
+			if !emit(descriptor) {
+				return
+			}
+		}
+	})
+}
+
+func (bp *boltPersistence) ReadEntries() (<-chan EntryDescriptor, <-chan error) {
+	entryChannel := make(chan EntryDescriptor)
+	errorChannel := make(chan error)
+
+	go func() {
+		defer close(entryChannel)
+		defer close(errorChannel)
+
+		entries := make([]*entryDescriptor, 0)
+
+		err := bp.db.View(func(tx *bolt.Tx) error {
+			for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+				areaBucket := tx.Bucket([]byte(area))
+
+				for _, directory := range bucketDirectories(areaBucket) {
+					cursor := areaBucket.Bucket([]byte(directory)).Cursor()
+					for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+						// capture shared loop variables for the closure
+						area := area
+						directory := directory
+						storedName := string(key)
+
+						entries = append(entries, newEntryDescriptor(
+							area,
+							directory,
+							storedName,
+							func() ([]byte, error) {
+								return bp.get(area, directory, storedName)
+							},
+						))
+					}
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			errorChannel <- fmt.Errorf("could not read the store: [%v]", err)
+			return
+		}
+
+		for _, entry := range entries {
+			entryChannel <- entry
+		}
+	}()
+
+	return entryChannel, errorChannel
+}
+
+func (bp *boltPersistence) WriteEntry(key string, data []byte) error {
+	area, directory, storedName, err := parseEntryKey(key)
+	if err != nil {
+		return err
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		return putInBucket(tx, area, directory, storedName, addChecksum(data))
+	})
+}
+
+func (bp *boltPersistence) get(area, directory, name string) ([]byte, error) {
+	var data []byte
+
+	err := bp.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(area)).Bucket([]byte(directory))
+		if bucket == nil {
+			return fmt.Errorf("no such directory")
+		}
+
+		value := bucket.Get([]byte(name))
+		if value == nil {
+			return fmt.Errorf("no such data")
+		}
+
+		// values returned by bbolt are valid only for the life
+		// of the transaction
+		data = copyBytes(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyChecksum(data)
+}
+
+func (bp *boltPersistence) Verify() <-chan error {
+	errorChannel := make(chan error)
+
+	go func() {
+		defer close(errorChannel)
+
+		for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+			corrupted, err := bp.quarantineArea(area)
+			if err != nil {
+				errorChannel <- fmt.Errorf(
+					"could not verify the [%v] area: [%v]",
+					area,
+					err,
+				)
+				continue
+			}
+
+			for _, key := range corrupted {
+				errorChannel <- fmt.Errorf(
+					"corrupted data [%v/%v] moved to [%v/%v]",
+					area,
+					key,
+					quarantineDir,
+					area,
+				)
+			}
+		}
+	}()
+
+	return errorChannel
+}
+
+// quarantineArea verifies checksums of all data from the given storage area
+// and moves corrupted data to the quarantine bucket keeping the same
+// directory structure. Keys of the data moved to the quarantine are returned.
+func (bp *boltPersistence) quarantineArea(area string) ([]string, error) {
+	corrupted := make([]string, 0)
+
+	err := bp.db.Update(func(tx *bolt.Tx) error {
+		areaBucket := tx.Bucket([]byte(area))
+
+		for _, directory := range bucketDirectories(areaBucket) {
+			directoryKey := []byte(directory)
+			bucket := areaBucket.Bucket(directoryKey)
+
+			corruptedNames := make([][]byte, 0)
+			err := bucket.ForEach(func(nameKey, data []byte) error {
+				if _, err := verifyChecksum(data); err != nil {
+					corruptedNames = append(corruptedNames, nameKey)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(corruptedNames) == 0 {
+				continue
+			}
+
+			quarantineBucket, err := tx.Bucket([]byte(quarantineDir)).
+				CreateBucketIfNotExists([]byte(area))
+			if err != nil {
+				return err
+			}
+
+			quarantineDirBucket, err := quarantineBucket.
+				CreateBucketIfNotExists(directoryKey)
+			if err != nil {
+				return err
+			}
+
+			for _, nameKey := range corruptedNames {
+				err := quarantineDirBucket.Put(nameKey, bucket.Get(nameKey))
+				if err != nil {
+					return err
+				}
+
+				// keys are deleted after the iteration since modifying
+				// the bucket while iterating over it is not allowed
+				if err := bucket.Delete(nameKey); err != nil {
+					return err
+				}
+
+				corrupted = append(corrupted, directory+"/"+string(nameKey))
+			}
+		}
+
+		return nil
+	})
+
+	return corrupted, err
+}
+
+// migrateBoltChecksumFormat adds checksums to all the data persisted before
+// checksums were introduced and records the checksum format in the metadata
+// bucket. Stores with the checksum format already recorded are left as they
+// are.
+func migrateBoltChecksumFormat(tx *bolt.Tx) error {
+	metadata, err := tx.CreateBucketIfNotExists([]byte(boltMetadataBucket))
+	if err != nil {
+		return err
+	}
+
+	if format := metadata.Get(boltFormatKey); format != nil {
+		if string(format) != checksumFormat {
+			return fmt.Errorf("unsupported storage format [%s]", format)
+		}
+
+		return nil
+	}
+
+	for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+		areaBucket := tx.Bucket([]byte(area))
+
+		for _, directory := range bucketDirectories(areaBucket) {
+			bucket := areaBucket.Bucket([]byte(directory))
+
+			legacyNames := make([][]byte, 0)
+			err := bucket.ForEach(func(nameKey, data []byte) error {
+				if !hasChecksum(data) {
+					legacyNames = append(legacyNames, nameKey)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// keys are updated after the iteration since modifying
+			// the bucket while iterating over it is not allowed
+			for _, nameKey := range legacyNames {
+				data := addChecksum(bucket.Get(nameKey))
+				if err := bucket.Put(nameKey, data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return metadata.Put(boltFormatKey, []byte(checksumFormat))
+}
+
+// bucketDirectories returns names of all directories in the given area
+// bucket.
+func bucketDirectories(areaBucket *bolt.Bucket) []string {
+	directories := make([]string, 0)
+
+	cursor := areaBucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		// nested buckets have nil values
+		if value == nil {
+			directories = append(directories, string(key))
+		}
+	}
+
+	return directories
+}
+
+func putInBucket(tx *bolt.Tx, area, directory, name string, data []byte) error {
+	bucket, err := tx.Bucket([]byte(area)).CreateBucketIfNotExists(
+		[]byte(directory),
+	)
+	if err != nil {
+		return fmt.Errorf("error occurred while creating a dir: [%v]", err)
+	}
+
+	// bbolt does not distinguish between nil and missing values
+	if data == nil {
+		data = []byte{}
+	}
+
+	return bucket.Put([]byte(name), data)
+}
+
+// moveBucket moves the entire directory between the provided areas. If the
+// directory already exists in the target area, data are appended to it
+// overwriting data with the same names.
+func moveBucket(tx *bolt.Tx, fromArea, toArea, directory string) error {
+	fromBucket := tx.Bucket([]byte(fromArea)).Bucket([]byte(directory))
+	if fromBucket == nil {
+		return fmt.Errorf("directory [%v] does not exist", directory)
+	}
+
+	toBucket, err := tx.Bucket([]byte(toArea)).CreateBucketIfNotExists(
+		[]byte(directory),
+	)
+	if err != nil {
+		return fmt.Errorf("error occurred while creating a dir: [%v]", err)
+	}
+
+	err = fromBucket.ForEach(func(key, value []byte) error {
+		return toBucket.Put(key, value)
+	})
+	if err != nil {
+		return fmt.Errorf("error occurred while moving a dir: [%v]", err)
+	}
+
+	return tx.Bucket([]byte(fromArea)).DeleteBucket([]byte(directory))
+}
+
+// MigrateDiskToBolt imports all the data from the on-disk storage kept under
+// the provided data directory into the bbolt store kept under the provided
+// store path. Data from current, archive and snapshot storage are imported
+// as they are, snapshots keep their original timestamps. Data staged in
+// transactions committed but not applied before a crash are imported as if
+// the transactions were applied. Data persisted before checksums were
+// introduced are imported along with their checksums.
+//
+// The data directory is locked for the time of the migration so that no
+// other process is able to use it; apart from the lock file, the data
+// directory is not modified. Data already existing in the store under the
+// same names are overwritten so the migration can be safely repeated if
+// interrupted.
+func MigrateDiskToBolt(dataDir string, storePath string) error {
+	_, err := lockDataDirectory(dataDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unlockDataDirectory(dataDir); err != nil {
+			logger.Errorf("could not unlock data directory: [%v]", err)
+		}
+	}()
+
+	checksummed, err := hasChecksumFormat(dataDir)
+	if err != nil {
+		return err
+	}
+
+	handle, err := NewBoltHandle(storePath)
+	if err != nil {
+		return err
+	}
+
+	store := handle.(*boltPersistence)
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Errorf("could not close the store [%v]: [%v]", storePath, err)
+		}
+	}()
+
+	for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+		err := store.importDiskArea(
+			area,
+			fmt.Sprintf("%s/%s", dataDir, area),
+			!checksummed,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// transactions are imported in the same order as they are applied when
+	// the on-disk handle is created
+	journalPath := fmt.Sprintf("%s/%s", dataDir, journalDir)
+
+	transactions, err := ioutil.ReadDir(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			journalPath,
+			err,
+		)
+	}
+
+	for _, transaction := range transactions {
+		transactionPath := fmt.Sprintf("%s/%s", journalPath, transaction.Name())
+
+		if isNonExistingFile(
+			fmt.Sprintf("%s/%s", transactionPath, transactionCommitMarker),
+		) {
+			continue
+		}
+
+		err := store.importDiskArea(
+			currentDir,
+			fmt.Sprintf("%s/%s", transactionPath, transactionDataDir),
+			false,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importDiskArea imports all the directories from the given on-disk path to
+// the given storage area. If requested, checksums are added to the data
+// stored without them.
+func (bp *boltPersistence) importDiskArea(
+	area string,
+	areaPath string,
+	addMissingChecksums bool,
+) error {
+	dirs, err := ioutil.ReadDir(areaPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			areaPath,
+			err,
+		)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		err := bp.importDiskDirectory(
+			area,
+			areaPath,
+			dir.Name(),
+			addMissingChecksums,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importDiskDirectory imports all files from the given on-disk directory in
+// a single transaction.
+func (bp *boltPersistence) importDiskDirectory(
+	area string,
+	areaPath string,
+	directory string,
+	addMissingChecksums bool,
+) error {
+	dirPath := fmt.Sprintf("%s/%s", areaPath, directory)
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			dirPath,
+			err,
+		)
+	}
+
+	return bp.db.Update(func(tx *bolt.Tx) error {
+		for _, file := range files {
+			if file.IsDir() || isTempFile(file.Name()) {
+				continue
+			}
+
+			data, err := read(fmt.Sprintf("%s/%s", dirPath, file.Name()))
+			if err != nil {
+				return fmt.Errorf(
+					"could not read [%v] from directory [%v]: [%v]",
+					file.Name(),
+					dirPath,
+					err,
+				)
+			}
+
+			if addMissingChecksums && !hasChecksum(data) {
+				data = addChecksum(data)
+			}
+
+			err = putInBucket(tx, area, directory, file.Name(), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		logger.Infof(
+			"imported [%v] entries from directory [%v]",
+			len(files),
+			dirPath,
+		)
+
+		return nil
+	})
+}
@@ -0,0 +1,510 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltHandle(t *testing.T) (Handle, func()) {
+	tempDir, err := ioutil.TempDir("", "bolt-persistence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := NewBoltHandle(fmt.Sprintf("%s/store.db", tempDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handle, func() {
+		handle.(*boltPersistence).Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestBoltPersistence_SaveReadListDelete(t *testing.T) {
+	handle, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := handle.Save(bytesToTest, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle.Save(bytesToTest, dirName1, fileName12)
+	handle.Save([]byte{}, dirName2, fileName21)
+
+	content, err := handle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytesToTest, content) {
+		t.Fatalf(
+			"unexpected content\nexpected: [%v]\nactual:   [%v]",
+			bytesToTest,
+			content,
+		)
+	}
+
+	content, err = handle.Read(dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("expected empty content; has [%v]", content)
+	}
+
+	names, err := handle.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{fileName11, fileName12}, names) {
+		t.Fatalf("unexpected names: [%v]", names)
+	}
+
+	err = handle.Delete(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = handle.Read(dirName1, fileName11)
+	if err == nil {
+		t.Fatalf("expected error for deleted data")
+	}
+
+	err = handle.Delete(dirName1, fileName11)
+	if err == nil {
+		t.Fatalf("expected error for non-existing data")
+	}
+}
+
+func TestBoltPersistence_RefuseSave(t *testing.T) {
+	handle, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := handle.Save(bytesToTest, notAllowedName, fileName11)
+	if err == nil || errDirectoryNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errDirectoryNameLength,
+			err,
+		)
+	}
+
+	err = handle.Save(bytesToTest, dirName1, notAllowedName)
+	if err == nil || errFileNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errFileNameLength,
+			err,
+		)
+	}
+}
+
+func TestBoltPersistence_ArchiveAndUnarchive(t *testing.T) {
+	handle, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	handle.Save([]byte{1}, dirName1, fileName11)
+	handle.Save([]byte{2}, dirName2, fileName21)
+
+	err := handle.Archive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, errors := readAllDescriptors(handle.ReadAll())
+	for _, err := range errors {
+		t.Fatal(err)
+	}
+	if len(current) != 1 || current[0].Directory() != dirName2 {
+		t.Fatalf("only [%v] directory should remain non-archived", dirName2)
+	}
+
+	// append to the archive
+	handle.Save([]byte{3}, dirName1, fileName12)
+	err = handle.Archive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archived, errors := readAllDescriptors(handle.ReadArchived())
+	for _, err := range errors {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 {
+		t.Fatalf("expected [2] archived descriptors; has [%v]", len(archived))
+	}
+
+	content, err := archived[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{3}, content) {
+		t.Fatalf("unexpected archived content: [%v]", content)
+	}
+
+	err = handle.Unarchive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := handle.List(dirName1)
+	if !reflect.DeepEqual([]string{fileName11, fileName12}, names) {
+		t.Fatalf("unexpected names: [%v]", names)
+	}
+
+	err = handle.Unarchive(dirName1)
+	expectedError := fmt.Errorf("directory [%v] is not archived", dirName1)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+}
+
+func TestBoltPersistence_Snapshots(t *testing.T) {
+	handle, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	now := time.Now()
+
+	counter := 0
+	handle.(*boltPersistence).snapshotSuffixGenerator = func() string {
+		counter++
+		// snapshots taken 5, 4, 3, 2 and 1 hour ago
+		return snapshotSuffix(now.Add(time.Duration(counter-6) * time.Hour))
+	}
+
+	for i := 0; i < 5; i++ {
+		err := handle.Snapshot([]byte{byte(i)}, dirName1, fileName11)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := handle.ListSnapshots(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 5 {
+		t.Fatalf("expected [5] snapshots; has [%v]", len(snapshots))
+	}
+
+	err = handle.RestoreSnapshot(dirName1, fileName11, snapshots[1].Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := handle.Read(dirName1, fileName11)
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf("unexpected restored content: [%v]", content)
+	}
+
+	err = handle.PruneSnapshots(&SnapshotRetentionPolicy{KeepLast: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, _ = handle.ListSnapshots(dirName1, fileName11)
+	if len(snapshots) != 2 {
+		t.Fatalf("expected [2] snapshots; has [%v]", len(snapshots))
+	}
+
+	content, _ = snapshots[0].Content()
+	if !bytes.Equal([]byte{3}, content) {
+		t.Fatalf("unexpected retained snapshot content: [%v]", content)
+	}
+}
+
+func TestMigrateDiskToBolt(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bolt-migration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	diskHandle, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diskHandle.(*diskPersistence).snapshotSuffixGenerator = func() string {
+		return ".1583837153000"
+	}
+
+	diskHandle.Save([]byte{1}, dirName1, fileName11)
+	diskHandle.Save([]byte{2}, dirName2, fileName21)
+	diskHandle.Archive(dirName2)
+	diskHandle.Snapshot([]byte{3}, dirName1, fileName11)
+
+	// simulate a crash right after the transaction has been committed but
+	// before it has been applied
+	transaction, err := diskHandle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{4}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = write(
+		fmt.Sprintf(
+			"%s/%s",
+			transaction.(*diskTransaction).path,
+			transactionCommitMarker,
+		),
+		[]byte{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = diskHandle.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := fmt.Sprintf("%s/store.db", tempDir)
+
+	err = MigrateDiskToBolt(tempDir, storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data directory is not modified and the lock is released
+	if !isNonExistingFile(
+		fmt.Sprintf("%s/%s/%s/%s", tempDir, currentDir, dirName1, fileName12),
+	) {
+		t.Fatal("transaction should not be applied to the data directory")
+	}
+
+	if isNonExistingFile(transaction.(*diskTransaction).path) {
+		t.Fatal("transaction should stay in the journal")
+	}
+
+	status, err := CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Locked {
+		t.Fatalf("unexpected lock status: [%+v]", status)
+	}
+
+	boltHandle, err := NewBoltHandle(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltHandle.(*boltPersistence).Close()
+
+	content, err := boltHandle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf("unexpected migrated content: [%v]", content)
+	}
+
+	content, err = boltHandle.Read(dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{4}, content) {
+		t.Fatalf("unexpected migrated transaction content: [%v]", content)
+	}
+
+	archived, _ := readAllDescriptors(boltHandle.ReadArchived())
+	if len(archived) != 1 || archived[0].Directory() != dirName2 {
+		t.Fatalf("[%v] directory should be archived", dirName2)
+	}
+
+	snapshots, err := boltHandle.ListSnapshots(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected [1] snapshot; has [%v]", len(snapshots))
+	}
+
+	expectedTimestamp := time.Unix(1583837153, 0)
+	if !expectedTimestamp.Equal(snapshots[0].Timestamp()) {
+		t.Fatalf(
+			"unexpected snapshot timestamp\nexpected: [%v]\nactual:   [%v]",
+			expectedTimestamp,
+			snapshots[0].Timestamp(),
+		)
+	}
+}
+
+func TestMigrateDiskToBolt_LegacyData(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bolt-migration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// data directory written before checksums were introduced
+	dirPath := fmt.Sprintf("%s/%s/%s", tempDir, currentDir, dirName1)
+	err = os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		fmt.Sprintf("%s/%s", dirPath, fileName11),
+		[]byte{1},
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := fmt.Sprintf("%s/store.db", tempDir)
+
+	err = MigrateDiskToBolt(tempDir, storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isNonExistingFile(fmt.Sprintf("%s/%s", tempDir, formatFileName)) {
+		t.Fatal("data directory should not be migrated to checksummed format")
+	}
+
+	boltHandle, err := NewBoltHandle(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltHandle.(*boltPersistence).Close()
+
+	content, err := boltHandle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf("unexpected migrated content: [%v]", content)
+	}
+}
+
+func TestBoltPersistence_Verify(t *testing.T) {
+	handle, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	handle.Save(bytesToTest, dirName1, fileName11)
+	handle.Save(bytesToTest, dirName1, fileName12)
+
+	err := handle.(*boltPersistence).db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(currentDir)).Bucket([]byte(dirName1))
+
+		corrupted := copyBytes(bucket.Get([]byte(fileName11)))
+		corrupted[len(corrupted)-1] ^= 0x01
+
+		return bucket.Put([]byte(fileName11), corrupted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = handle.Read(dirName1, fileName11)
+	if err == nil {
+		t.Fatal("expected checksum mismatch error")
+	}
+
+	var errors []error
+	for err := range handle.Verify() {
+		errors = append(errors, err)
+	}
+
+	if len(errors) != 1 {
+		t.Fatalf("expected [1] error; has [%v]: [%v]", len(errors), errors)
+	}
+
+	names, _ := handle.List(dirName1)
+	if !reflect.DeepEqual([]string{fileName12}, names) {
+		t.Fatalf("only [%v] should remain non-archived", fileName12)
+	}
+}
+
+func TestBoltPersistence_MigrateLegacyData(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bolt-persistence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storePath := fmt.Sprintf("%s/store.db", tempDir)
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	writeLegacyData := func() {
+		db, err := bolt.Open(storePath, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			area, err := tx.CreateBucketIfNotExists([]byte(currentDir))
+			if err != nil {
+				return err
+			}
+			bucket, err := area.CreateBucketIfNotExists([]byte(dirName1))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(fileName11), bytesToTest)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLegacyData()
+
+	handle, err := NewBoltHandle(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := handle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytesToTest, data) {
+		t.Fatalf(
+			"unexpected data\nexpected: [%v]\nactual:   [%v]",
+			bytesToTest,
+			data,
+		)
+	}
+
+	handle.(*boltPersistence).Close()
+
+	// once migrated, data without checksum are no longer considered legacy
+	writeLegacyData()
+
+	handle, err = NewBoltHandle(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(*boltPersistence).Close()
+
+	_, err = handle.Read(dirName1, fileName11)
+	if err == nil {
+		t.Fatal("expected missing checksum header error")
+	}
+}
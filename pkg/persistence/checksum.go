@@ -0,0 +1,136 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checksumMagic marks data stored along with its checksum.
+var checksumMagic = []byte("keepcs01")
+
+const checksumHeaderLength = 8 + sha256.Size
+
+// checksumFormat is the storage format marker recorded by handles once all
+// their data are stored along with checksums. Data persisted before
+// checksums were introduced are migrated once, when the handle is created
+// for the storage without the marker; from then on, data without the
+// checksum header are considered corrupted.
+const checksumFormat = "keepcs01"
+
+// addChecksum prepends the provided data with the checksum header consisting
+// of the checksum magic and SHA-256 of the data.
+func addChecksum(data []byte) []byte {
+	checksum := sha256.Sum256(data)
+
+	result := make([]byte, 0, checksumHeaderLength+len(data))
+	result = append(result, checksumMagic...)
+	result = append(result, checksum[:]...)
+	result = append(result, data...)
+
+	return result
+}
+
+// hasChecksum returns true if the stored data starts with the checksum magic.
+func hasChecksum(stored []byte) bool {
+	return bytes.HasPrefix(stored, checksumMagic)
+}
+
+// verifyChecksum verifies the checksum of the stored data and returns the
+// data without the checksum header.
+func verifyChecksum(stored []byte) ([]byte, error) {
+	if !hasChecksum(stored) {
+		return nil, fmt.Errorf("data corrupted; checksum header is missing")
+	}
+
+	if len(stored) < checksumHeaderLength {
+		return nil, fmt.Errorf("data corrupted; checksum header is truncated")
+	}
+
+	expectedChecksum := stored[len(checksumMagic):checksumHeaderLength]
+	data := stored[checksumHeaderLength:]
+
+	checksum := sha256.Sum256(data)
+	if !bytes.Equal(expectedChecksum, checksum[:]) {
+		return nil, fmt.Errorf("data corrupted; checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// writeWithChecksum writes the checksum header followed by data produced by
+// the provided function to the file. The checksum is known only once all
+// the data are written, so the space for the header is reserved first and
+// the header is written at the end.
+func writeWithChecksum(file *os.File, produce func(io.Writer) error) error {
+	if _, err := file.Write(make([]byte, checksumHeaderLength)); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	buffered := bufio.NewWriter(file)
+
+	if err := produce(io.MultiWriter(buffered, hash)); err != nil {
+		return err
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, checksumHeaderLength)
+	header = append(header, checksumMagic...)
+	header = append(header, hash.Sum(nil)...)
+
+	_, err := file.WriteAt(header, 0)
+	return err
+}
+
+// readVerifiedStream passes the data stored in the file without the checksum
+// header to the provided function as a stream. The checksum is computed as
+// the data is read and verified once the function returns; the checksum
+// mismatch takes precedence over the error returned by the function since
+// the function most probably failed because of the corrupted data.
+func readVerifiedStream(filePath string, consume func(io.Reader) error) error {
+	// #nosec G304 (file path provided as taint input)
+	// This line opens a file from the predefined storage.
+	// There is no user input.
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	defer closeFile(file)
+
+	header := make([]byte, checksumHeaderLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if !hasChecksum(header[:n]) {
+		return fmt.Errorf("data corrupted; checksum header is missing")
+	}
+	if n < checksumHeaderLength {
+		return fmt.Errorf("data corrupted; checksum header is truncated")
+	}
+
+	hash := sha256.New()
+	reader := io.TeeReader(bufio.NewReader(file), hash)
+
+	consumeErr := consume(reader)
+
+	// the data not consumed by the function is covered by the checksum too
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[len(checksumMagic):], hash.Sum(nil)) {
+		return fmt.Errorf("data corrupted; checksum mismatch")
+	}
+
+	return consumeErr
+}
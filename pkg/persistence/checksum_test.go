@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	data := []byte{115, 111, 109, 101, 10}
+
+	verified, err := verifyChecksum(addChecksum(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, verified) {
+		t.Fatalf(
+			"unexpected data\nexpected: [%v]\nactual:   [%v]",
+			data,
+			verified,
+		)
+	}
+}
+
+func TestChecksumMissingHeader(t *testing.T) {
+	_, err := verifyChecksum([]byte{115, 111, 109, 101, 10})
+	if err == nil {
+		t.Fatal("expected missing header error")
+	}
+}
+
+func TestChecksumCorruptedMagic(t *testing.T) {
+	stored := addChecksum([]byte{115, 111, 109, 101, 10})
+	stored[0] ^= 0x01
+
+	_, err := verifyChecksum(stored)
+	if err == nil {
+		t.Fatal("expected missing header error")
+	}
+}
+
+func TestChecksumCorruptedData(t *testing.T) {
+	stored := addChecksum([]byte{115, 111, 109, 101, 10})
+	stored[len(stored)-1] ^= 0x01
+
+	_, err := verifyChecksum(stored)
+	if err == nil {
+		t.Fatal("expected checksum mismatch error")
+	}
+
+	_, err = verifyChecksum(stored[:checksumHeaderLength-1])
+	if err == nil {
+		t.Fatal("expected truncated header error")
+	}
+}
@@ -1,5 +1,7 @@
 package persistence
 
+import "time"
+
 // dataDescriptor is the simplest possible implementation of DataDescriptor
 // interface that can be used by a storage when reading data.
 type dataDescriptor struct {
@@ -19,3 +21,18 @@ func (dd *dataDescriptor) Directory() string {
 func (dd *dataDescriptor) Content() ([]byte, error) {
 	return dd.readFunc()
 }
+
+// snapshotDescriptor is the simplest possible implementation of
+// SnapshotDescriptor interface that can be used by a storage when reading
+// snapshots.
+type snapshotDescriptor struct {
+	dataDescriptor
+	timestamp time.Time
+	// name of the snapshot in the storage, it consists of the name of
+	// the data snapshotted and the snapshot suffix
+	snapshotName string
+}
+
+func (sd *snapshotDescriptor) Timestamp() time.Time {
+	return sd.timestamp
+}
@@ -2,8 +2,12 @@ package persistence
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,17 +16,57 @@ const (
 	currentDir  = "current"
 	archiveDir  = "archive"
 	snapshotDir = "snapshot"
+	// quarantineDir keeps corrupted data detected during verification;
+	// data in this directory is never returned from any read function.
+	quarantineDir = "quarantine"
 
 	maxFileNameLength = 128
+
+	// tempFilePrefix is the prefix of temporary files data is written to
+	// before they are atomically moved to their final location.
+	tempFilePrefix = ".tmp-"
+
+	// formatFileName is the name of the file in the data directory recording
+	// the storage format of the data.
+	formatFileName = ".format"
 )
 
-// NewDiskHandle creates on-disk data persistence handle
+// NewDiskHandle creates on-disk data persistence handle. The data directory
+// is exclusively locked so that no other process is able to use it at the
+// same time. Handles created in the same process for the same directory share
+// the lock which is held until all of them are closed or the process exits.
+// The returned handle implements io.Closer and should be closed when it is no
+// longer used.
 func NewDiskHandle(path string) (Handle, error) {
+	return NewDiskHandleWithConfig(path, &DiskConfig{})
+}
+
+// NewDiskHandleWithConfig creates on-disk data persistence handle just like
+// NewDiskHandle but additionally enforces the quota and the minimum free disk
+// space from the provided config. Writes exceeding the quota or leaving less
+// free disk space than configured are refused before anything is written.
+func NewDiskHandleWithConfig(path string, config *DiskConfig) (Handle, error) {
 	err := checkStoragePermission(path)
 	if err != nil {
 		return nil, err
 	}
 
+	firstHandle, err := lockDataDirectory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lock is released if the handle could not be created
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		if err := unlockDataDirectory(path); err != nil {
+			logger.Errorf("could not unlock data directory: [%v]", err)
+		}
+	}()
+
 	err = ensureDirectoryExists(path, currentDir)
 	if err != nil {
 		return nil, err
@@ -38,13 +82,42 @@ func NewDiskHandle(path string) (Handle, error) {
 		return nil, err
 	}
 
+	err = ensureDirectoryExists(path, quarantineDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ensureDirectoryExists(path, journalDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the recovery is done only by the first handle of this process as
+	// other handles would mistake the temporary files and transactions of
+	// that handle for the ones interrupted by a crash
+	if firstHandle {
+		err = recoverDataDirectory(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	usage, err := newDiskUsage(path)
+	if err != nil {
+		return nil, err
+	}
+
 	snapshotSuffixGenerator := func() string {
-		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
-		return fmt.Sprintf(".%d", timestamp)
+		return snapshotSuffix(time.Now())
 	}
 
+	created = true
+
 	return &diskPersistence{
 		dataDir:                 path,
+		config:                  config,
+		usage:                   usage,
+		availableSpaceFunc:      availableSpace,
 		snapshotSuffixGenerator: snapshotSuffixGenerator,
 	}, nil
 }
@@ -52,43 +125,123 @@ func NewDiskHandle(path string) (Handle, error) {
 type diskPersistence struct {
 	dataDir string
 
+	config             *DiskConfig
+	usage              *diskUsage
+	availableSpaceFunc func(path string) (uint64, error)
+
 	snapshotMutex           sync.Mutex
 	snapshotSuffixGenerator func() string
+
+	// transactionMutex is held for writing while a committed transaction is
+	// applied to the current storage area and for reading by all other
+	// operations reading or moving data of the current storage area so that
+	// they never observe a partially applied transaction.
+	transactionMutex sync.RWMutex
+
+	closeOnce sync.Once
+}
+
+// Close releases the lock of the data directory held by the handle. The
+// handle should not be used once it is closed.
+func (ds *diskPersistence) Close() error {
+	var err error
+	ds.closeOnce.Do(func() {
+		err = unlockDataDirectory(ds.dataDir)
+	})
+	return err
+}
+
+// recoverDataDirectory brings the data directory left by a crashed process
+// to the consistent state and migrates it to the current storage format.
+func recoverDataDirectory(path string) error {
+	// temporary files left behind by writes interrupted by a crash are never
+	// going to be completed, we can safely remove them
+	for _, storageDir := range []string{currentDir, archiveDir, snapshotDir} {
+		err := removeTempFiles(fmt.Sprintf("%s/%s", path, storageDir))
+		if err != nil {
+			return err
+		}
+	}
+
+	// transactions interrupted by a crash are either completed or discarded
+	// depending on whether they have been committed
+	err := recoverJournal(path)
+	if err != nil {
+		return err
+	}
+
+	return migrateChecksumFormat(path)
 }
 
 func (ds *diskPersistence) Save(data []byte, dirName, fileName string) error {
-	if len(dirName) > maxFileNameLength {
-		return fmt.Errorf(
-			"the maximum directory name length of [%v] exceeded for [%v]",
-			maxFileNameLength,
-			dirName,
-		)
+	return ds.save(dirName, fileName, func(filePath string) error {
+		return ds.write(currentDir, filePath, addChecksum(data))
+	})
+}
+
+// saveStream works as Save but the data is produced by the provided function
+// writing to the stream so that the data is never held in memory as a whole.
+func (ds *diskPersistence) saveStream(
+	dirName string,
+	fileName string,
+	produce func(io.Writer) error,
+) error {
+	return ds.save(dirName, fileName, func(filePath string) error {
+		return ds.writeStream(currentDir, filePath, produce)
+	})
+}
+
+func (ds *diskPersistence) save(
+	dirName string,
+	fileName string,
+	writeFunc func(filePath string) error,
+) error {
+	err := validateDirectoryName(dirName)
+	if err != nil {
+		return err
 	}
 
-	if len(fileName) > maxFileNameLength {
-		return fmt.Errorf(
-			"the maximum file name length of [%v] exceeded for [%v]",
-			maxFileNameLength,
-			fileName,
-		)
+	err = validateFileName(fileName)
+	if err != nil {
+		return err
 	}
 
 	dirPath := ds.getStorageCurrentDirPath()
-	err := ensureDirectoryExists(dirPath, dirName)
+	err = ensureDirectoryExists(dirPath, dirName)
 	if err != nil {
 		return err
 	}
 
-	return write(fmt.Sprintf("%s/%s/%s", dirPath, dirName, fileName), data)
+	return writeFunc(fmt.Sprintf("%s/%s/%s", dirPath, dirName, fileName))
 }
 
 func (ds *diskPersistence) Snapshot(data []byte, dirName, fileName string) error {
-	if len(dirName) > maxFileNameLength {
-		return fmt.Errorf(
-			"the maximum directory name length of [%v] exceeded for [%v]",
-			maxFileNameLength,
-			dirName,
-		)
+	return ds.snapshot(dirName, fileName, func(filePath string) error {
+		return ds.write(snapshotDir, filePath, addChecksum(data))
+	})
+}
+
+// snapshotStream works as Snapshot but the data is produced by the provided
+// function writing to the stream so that the data is never held in memory
+// as a whole.
+func (ds *diskPersistence) snapshotStream(
+	dirName string,
+	fileName string,
+	produce func(io.Writer) error,
+) error {
+	return ds.snapshot(dirName, fileName, func(filePath string) error {
+		return ds.writeStream(snapshotDir, filePath, produce)
+	})
+}
+
+func (ds *diskPersistence) snapshot(
+	dirName string,
+	fileName string,
+	writeFunc func(filePath string) error,
+) error {
+	err := validateDirectoryName(dirName)
+	if err != nil {
+		return err
 	}
 
 	snapshotSuffix := ds.snapshotSuffixGenerator()
@@ -102,11 +255,16 @@ func (ds *diskPersistence) Snapshot(data []byte, dirName, fileName string) error
 		)
 	}
 
+	err = validatePathSegment("file", fileName)
+	if err != nil {
+		return err
+	}
+
 	ds.snapshotMutex.Lock()
 	defer ds.snapshotMutex.Unlock()
 
 	dirPath := fmt.Sprintf("%s/%s", ds.dataDir, snapshotDir)
-	err := ensureDirectoryExists(dirPath, dirName)
+	err = ensureDirectoryExists(dirPath, dirName)
 	if err != nil {
 		return err
 	}
@@ -121,7 +279,187 @@ func (ds *diskPersistence) Snapshot(data []byte, dirName, fileName string) error
 		)
 	}
 
-	return write(filePath, data)
+	return writeFunc(filePath)
+}
+
+func (ds *diskPersistence) ListSnapshots(
+	directory string,
+	name string,
+) ([]SnapshotDescriptor, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := ds.readSnapshots(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := make([]SnapshotDescriptor, len(snapshots[name]))
+	for i, snapshot := range snapshots[name] {
+		descriptors[i] = snapshot
+	}
+
+	return descriptors, nil
+}
+
+func (ds *diskPersistence) RestoreSnapshot(
+	directory string,
+	name string,
+	timestamp time.Time,
+) error {
+	snapshots, err := ds.ListSnapshots(directory, name)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if !snapshot.Timestamp().Equal(timestamp) {
+			continue
+		}
+
+		data, err := snapshot.Content()
+		if err != nil {
+			return fmt.Errorf("could not read snapshot: [%v]", err)
+		}
+
+		return ds.Save(data, directory, name)
+	}
+
+	return fmt.Errorf(
+		"no snapshot of [%v] in directory [%v] taken at [%v]",
+		name,
+		directory,
+		timestamp,
+	)
+}
+
+func (ds *diskPersistence) PruneSnapshots(policy *SnapshotRetentionPolicy) error {
+	if policy == nil {
+		return errNoRetentionPolicy
+	}
+
+	ds.snapshotMutex.Lock()
+	defer ds.snapshotMutex.Unlock()
+
+	dirPath := fmt.Sprintf("%s/%s", ds.dataDir, snapshotDir)
+
+	dirs, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			dirPath,
+			err,
+		)
+	}
+
+	now := time.Now()
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		snapshots, err := ds.readSnapshots(dir.Name())
+		if err != nil {
+			return err
+		}
+
+		for _, nameSnapshots := range snapshots {
+			for i, snapshot := range nameSnapshots {
+				position := len(nameSnapshots) - 1 - i
+				if policy.retains(position, snapshot.timestamp, now) {
+					continue
+				}
+
+				filePath := fmt.Sprintf(
+					"%s/%s/%s",
+					dirPath,
+					dir.Name(),
+					snapshot.snapshotName,
+				)
+
+				size := fileSize(filePath)
+
+				err := os.Remove(filePath)
+				if err != nil {
+					return fmt.Errorf(
+						"could not remove snapshot [%v]: [%v]",
+						filePath,
+						err,
+					)
+				}
+
+				ds.usage.add(snapshotDir, -size)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSnapshots reads all snapshots from the given directory and groups them
+// by the name of the data snapshotted. Snapshots in each group are ordered
+// from the oldest to the most recent one. Snapshot files which names do not
+// carry the timestamp are ignored.
+func (ds *diskPersistence) readSnapshots(
+	directory string,
+) (map[string][]*snapshotDescriptor, error) {
+	dirPath := fmt.Sprintf("%s/%s/%s", ds.dataDir, snapshotDir, directory)
+
+	snapshots := make(map[string][]*snapshotDescriptor)
+
+	files, err := ioutil.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return snapshots, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			dirPath,
+			err,
+		)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || isTempFile(file.Name()) {
+			continue
+		}
+
+		name, timestamp, ok := parseSnapshotFileName(file.Name())
+		if !ok {
+			continue
+		}
+
+		// capture shared loop variable for the closure
+		filePath := fmt.Sprintf("%s/%s", dirPath, file.Name())
+
+		snapshots[name] = append(snapshots[name], &snapshotDescriptor{
+			dataDescriptor: dataDescriptor{
+				name:      name,
+				directory: directory,
+				readFunc: func() ([]byte, error) {
+					return readVerified(filePath)
+				},
+			},
+			timestamp:    timestamp,
+			snapshotName: file.Name(),
+		})
+	}
+
+	for _, nameSnapshots := range snapshots {
+		sort.Slice(nameSnapshots, func(i, j int) bool {
+			return nameSnapshots[i].timestamp.Before(nameSnapshots[j].timestamp)
+		})
+	}
+
+	return snapshots, nil
 }
 
 func isNonExistingFile(filePath string) bool {
@@ -129,161 +467,881 @@ func isNonExistingFile(filePath string) bool {
 	return os.IsNotExist(err)
 }
 
-func (ds *diskPersistence) ReadAll() (<-chan DataDescriptor, <-chan error) {
-	return readAll(ds.getStorageCurrentDirPath())
+// ReadAll lists the data with the transaction lock held so the listing never
+// contains only a part of the data saved in a transaction. The content of
+// the data is read only when requested, without the lock held, so it
+// reflects all transactions committed until then; the content of different
+// data may come from before and after the same transaction.
+func (ds *diskPersistence) ReadAll(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	return readAll(
+		ds.getStorageCurrentDirPath(),
+		newReadOptions(options),
+		ds.transactionMutex.RLocker(),
+	)
+}
+
+func (ds *diskPersistence) ReadArchived(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	return readAll(
+		fmt.Sprintf("%s/%s", ds.dataDir, archiveDir),
+		newReadOptions(options),
+		nil,
+	)
 }
 
 func (ds *diskPersistence) Archive(directory string) error {
-	if len(directory) > maxFileNameLength {
-		return fmt.Errorf(
-			"the maximum directory name length of [%v] exceeded for [%v]",
-			maxFileNameLength,
-			directory,
-		)
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
 	}
 
-	from := fmt.Sprintf("%s/%s/%s", ds.dataDir, currentDir, directory)
-	to := fmt.Sprintf("%s/%s/%s", ds.dataDir, archiveDir, directory)
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
 
-	return moveAll(from, to)
+	return ds.moveDirectory(currentDir, archiveDir, directory)
 }
 
-func (ds *diskPersistence) getStorageCurrentDirPath() string {
-	return fmt.Sprintf("%s/%s", ds.dataDir, currentDir)
+func (ds *diskPersistence) Unarchive(directory string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
+
+	from := fmt.Sprintf("%s/%s/%s", ds.dataDir, archiveDir, directory)
+	if isNonExistingFile(from) {
+		return fmt.Errorf("directory [%v] is not archived", directory)
+	}
+
+	return ds.moveDirectory(archiveDir, currentDir, directory)
 }
 
-func checkStoragePermission(dirBasePath string) error {
-	_, err := ioutil.ReadDir(dirBasePath)
+// moveDirectory moves all the files of the directory from one storage area
+// to another one.
+func (ds *diskPersistence) moveDirectory(
+	fromArea string,
+	toArea string,
+	directory string,
+) error {
+	from := fmt.Sprintf("%s/%s/%s", ds.dataDir, fromArea, directory)
+	to := fmt.Sprintf("%s/%s/%s", ds.dataDir, toArea, directory)
+
+	// files in the target directory may be overwritten by the moved ones so
+	// the usage of both directories is computed again once they are moved
+	sizeBefore, err := directorySize(from)
 	if err != nil {
-		return fmt.Errorf("cannot read from the storage directory: [%v]", err)
+		return fmt.Errorf("could not compute directory size: [%v]", err)
+	}
+	targetSizeBefore, err := directorySize(to)
+	if err != nil {
+		return fmt.Errorf("could not compute directory size: [%v]", err)
 	}
 
-	tempFile, err := ioutil.TempFile(dirBasePath, "write-test.*.tmp")
+	moveErr := moveAll(from, to)
+
+	sizeAfter, err := directorySize(from)
 	if err != nil {
-		return fmt.Errorf("cannot write to the storage directory: [%v]", err)
+		logger.Errorf("could not compute directory size: [%v]", err)
+	}
+	targetSizeAfter, err := directorySize(to)
+	if err != nil {
+		logger.Errorf("could not compute directory size: [%v]", err)
 	}
 
-	defer os.RemoveAll(tempFile.Name())
+	ds.usage.add(fromArea, sizeAfter-sizeBefore)
+	ds.usage.add(toArea, targetSizeAfter-targetSizeBefore)
 
-	return nil
+	return moveErr
 }
 
-func ensureDirectoryExists(dirBasePath, newDirName string) error {
-	dirPath := fmt.Sprintf("%s/%s", dirBasePath, newDirName)
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		err = os.Mkdir(dirPath, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("error occurred while creating a dir: [%v]", err)
-		}
+func (ds *diskPersistence) Read(directory, name string) ([]byte, error) {
+	filePath, err := ds.getCurrentFilePath(directory, name)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
+
+	data, err := readVerified(filePath)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not read [%v] from directory [%v]: [%v]",
+			name,
+			directory,
+			err,
+		)
+	}
+
+	return data, nil
 }
 
-// create and write data to a file
-func write(filePath string, data []byte) error {
-	writeFile, err := os.Create(filePath)
+// readStream works as Read but the data is passed to the provided function
+// as a stream so that the stored data is never held in memory as a whole.
+// The checksum is verified once the stream is consumed and the read fails
+// if it does not match, even if the function succeeded.
+func (ds *diskPersistence) readStream(
+	directory string,
+	name string,
+	consume func(io.Reader) error,
+) error {
+	filePath, err := ds.getCurrentFilePath(directory, name)
 	if err != nil {
 		return err
 	}
 
-	defer closeFile(writeFile)
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
 
-	_, err = writeFile.Write(data)
+	err = readVerifiedStream(filePath, consume)
 	if err != nil {
-		return err
+		return fmt.Errorf(
+			"could not read [%v] from directory [%v]: [%v]",
+			name,
+			directory,
+			err,
+		)
 	}
 
-	err = writeFile.Sync()
+	return nil
+}
+
+func (ds *diskPersistence) Delete(directory, name string) error {
+	filePath, err := ds.getCurrentFilePath(directory, name)
 	if err != nil {
 		return err
 	}
 
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
+
+	size := fileSize(filePath)
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not delete [%v] from directory [%v]: [%v]",
+			name,
+			directory,
+			err,
+		)
+	}
+
+	ds.usage.add(currentDir, -size)
+
 	return nil
 }
 
-// read a file from a file system
-func read(filePath string) ([]byte, error) {
-	// #nosec G304 (file path provided as taint input)
-	// This line opens a file from the predefined storage.
-	// There is no user input.
-	readFile, err := os.Open(filePath)
+func (ds *diskPersistence) List(directory string) ([]string, error) {
+	err := validateDirectoryName(directory)
 	if err != nil {
 		return nil, err
 	}
 
-	defer closeFile(readFile)
+	dirPath := fmt.Sprintf("%s/%s", ds.getStorageCurrentDirPath(), directory)
 
-	data, err := ioutil.ReadAll(readFile)
+	ds.transactionMutex.RLock()
+	defer ds.transactionMutex.RUnlock()
+
+	files, err := ioutil.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			dirPath,
+			err,
+		)
 	}
 
-	return data, nil
-}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || isTempFile(file.Name()) {
+			continue
+		}
 
-func closeFile(file *os.File) {
-	err := file.Close()
-	if err != nil {
-		logger.Errorf("could not close file [%v]: [%v]", file.Name(), err)
+		names = append(names, file.Name())
 	}
+
+	return names, nil
 }
 
-// readAll reads all files from the provided directoryPath and outputs them
-// as DataDescriptors into the first returned output channel. All errors
-// occurred during file system reading are sent to the second output channel
-// returned from this function. The output can be later processed using
-// pipeline pattern. This function is non-blocking and returned channels are
-// not buffered. Channels are closed when there is no more to be read.
-func readAll(directoryPath string) (<-chan DataDescriptor, <-chan error) {
-	dataChannel := make(chan DataDescriptor)
+func (ds *diskPersistence) Verify() <-chan error {
 	errorChannel := make(chan error)
 
 	go func() {
-		defer close(dataChannel)
 		defer close(errorChannel)
 
-		files, err := ioutil.ReadDir(directoryPath)
-		if err != nil {
-			errorChannel <- fmt.Errorf(
-				"could not read the directory [%v]: [%v]",
-				directoryPath,
+		for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+			ds.verifyArea(area, errorChannel)
+		}
+	}()
+
+	return errorChannel
+}
+
+// verifyArea verifies checksums of all files from the given storage area.
+// Corrupted files are moved to the quarantine and reported to the provided
+// error channel along with all errors occurred during file system reading.
+func (ds *diskPersistence) verifyArea(area string, errorChannel chan<- error) {
+	areaPath := fmt.Sprintf("%s/%s", ds.dataDir, area)
+
+	dirs, err := ioutil.ReadDir(areaPath)
+	if err != nil {
+		errorChannel <- fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			areaPath,
+			err,
+		)
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		dirPath := fmt.Sprintf("%s/%s", areaPath, dir.Name())
+
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			errorChannel <- fmt.Errorf(
+				"could not read the directory [%v]: [%v]",
+				dirPath,
 				err,
 			)
+			continue
 		}
 
 		for _, file := range files {
-			if file.IsDir() {
-				dir, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", directoryPath, file.Name()))
+			if file.IsDir() || isTempFile(file.Name()) {
+				continue
+			}
+
+			filePath := fmt.Sprintf("%s/%s", dirPath, file.Name())
+
+			data, err := read(filePath)
+			if err != nil {
+				errorChannel <- fmt.Errorf(
+					"could not read file [%v]: [%v]",
+					filePath,
+					err,
+				)
+				continue
+			}
+
+			if _, err := verifyChecksum(data); err == nil {
+				continue
+			}
+
+			errorChannel <- ds.quarantine(area, dir.Name(), file.Name())
+		}
+	}
+}
+
+// quarantine moves the corrupted file from the given storage area to the
+// quarantine keeping the same directory structure.
+func (ds *diskPersistence) quarantine(area, directory, name string) error {
+	quarantineAreaPath := fmt.Sprintf("%s/%s", ds.dataDir, quarantineDir)
+
+	err := ensureDirectoryExists(quarantineAreaPath, area)
+	if err != nil {
+		return err
+	}
+
+	err = ensureDirectoryExists(
+		fmt.Sprintf("%s/%s", quarantineAreaPath, area),
+		directory,
+	)
+	if err != nil {
+		return err
+	}
+
+	from := fmt.Sprintf("%s/%s/%s/%s", ds.dataDir, area, directory, name)
+	to := fmt.Sprintf("%s/%s/%s/%s", quarantineAreaPath, area, directory, name)
+
+	replacedSize := fileSize(to)
+	size := fileSize(from)
+
+	err = os.Rename(from, to)
+	if err != nil {
+		return fmt.Errorf(
+			"corrupted file [%v] detected but could not be quarantined: [%v]",
+			from,
+			err,
+		)
+	}
+
+	ds.usage.move(area, quarantineDir, size)
+	ds.usage.add(quarantineDir, -replacedSize)
+
+	return fmt.Errorf("corrupted file [%v] moved to [%v]", from, to)
+}
+
+func (ds *diskPersistence) ReadEntries() (<-chan EntryDescriptor, <-chan error) {
+	entryChannel := make(chan EntryDescriptor)
+	errorChannel := make(chan error)
+
+	go func() {
+		defer close(entryChannel)
+		defer close(errorChannel)
+
+		for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+			areaPath := fmt.Sprintf("%s/%s", ds.dataDir, area)
+
+			dirs, err := ioutil.ReadDir(areaPath)
+			if err != nil {
+				errorChannel <- fmt.Errorf(
+					"could not read the directory [%v]: [%v]",
+					areaPath,
+					err,
+				)
+				continue
+			}
+
+			for _, dir := range dirs {
+				if !dir.IsDir() {
+					continue
+				}
+
+				dirPath := fmt.Sprintf("%s/%s", areaPath, dir.Name())
+
+				files, err := ioutil.ReadDir(dirPath)
 				if err != nil {
 					errorChannel <- fmt.Errorf(
-						"could not read the directory [%s/%s]: [%v]",
-						directoryPath,
-						file.Name(),
+						"could not read the directory [%v]: [%v]",
+						dirPath,
 						err,
 					)
+					continue
 				}
 
-				for _, dirFile := range dir {
-					// capture shared loop variables for the closure
-					dirName := file.Name()
-					fileName := dirFile.Name()
-
-					readFunc := func() ([]byte, error) {
-						return read(fmt.Sprintf(
-							"%s/%s/%s",
-							directoryPath,
-							dirName,
-							fileName,
-						))
+				for _, file := range files {
+					if file.IsDir() || isTempFile(file.Name()) {
+						continue
 					}
-					dataChannel <- &dataDescriptor{fileName, dirName, readFunc}
+
+					// capture shared loop variable for the closure
+					filePath := fmt.Sprintf("%s/%s", dirPath, file.Name())
+
+					entryChannel <- newEntryDescriptor(
+						area,
+						dir.Name(),
+						file.Name(),
+						func() ([]byte, error) {
+							return readVerified(filePath)
+						},
+					)
 				}
 			}
 		}
 	}()
 
-	return dataChannel, errorChannel
+	return entryChannel, errorChannel
+}
+
+func (ds *diskPersistence) WriteEntry(key string, data []byte) error {
+	area, directory, storedName, err := parseEntryKey(key)
+	if err != nil {
+		return err
+	}
+
+	areaPath := fmt.Sprintf("%s/%s", ds.dataDir, area)
+	path := fmt.Sprintf("%s/%s/%s", areaPath, directory, storedName)
+
+	// the key has been already validated but as the entry may come from
+	// an untrusted source, make sure it is written exactly two levels below
+	// the storage area
+	if filepath.Dir(filepath.Dir(filepath.Clean(path))) != filepath.Clean(areaPath) {
+		return fmt.Errorf("entry key [%v] points outside of the storage area", key)
+	}
+
+	err = ensureDirectoryExists(areaPath, directory)
+	if err != nil {
+		return err
+	}
+
+	return ds.write(area, path, addChecksum(data))
+}
+
+func (ds *diskPersistence) getStorageCurrentDirPath() string {
+	return fmt.Sprintf("%s/%s", ds.dataDir, currentDir)
+}
+
+func (ds *diskPersistence) getCurrentFilePath(
+	directory string,
+	name string,
+) (string, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return "", err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"%s/%s/%s",
+		ds.getStorageCurrentDirPath(),
+		directory,
+		name,
+	), nil
+}
+
+func validateDirectoryName(directory string) error {
+	if len(directory) > maxFileNameLength {
+		return fmt.Errorf(
+			"the maximum directory name length of [%v] exceeded for [%v]",
+			maxFileNameLength,
+			directory,
+		)
+	}
+
+	return validatePathSegment("directory", directory)
+}
+
+func validateFileName(name string) error {
+	if len(name) > maxFileNameLength {
+		return fmt.Errorf(
+			"the maximum file name length of [%v] exceeded for [%v]",
+			maxFileNameLength,
+			name,
+		)
+	}
+
+	return validatePathSegment("file", name)
+}
+
+// validatePathSegment ensures the directory or the file name refers to
+// a single entry of the file system so that it can not point outside of
+// the storage area.
+func validatePathSegment(kind string, segment string) error {
+	if segment == "" || segment == "." || segment == ".." ||
+		strings.ContainsAny(segment, `/\`) {
+		return fmt.Errorf("invalid %v name [%v]", kind, segment)
+	}
+
+	return nil
+}
+
+func checkStoragePermission(dirBasePath string) error {
+	_, err := ioutil.ReadDir(dirBasePath)
+	if err != nil {
+		return fmt.Errorf("cannot read from the storage directory: [%v]", err)
+	}
+
+	tempFile, err := ioutil.TempFile(dirBasePath, "write-test.*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write to the storage directory: [%v]", err)
+	}
+
+	defer os.RemoveAll(tempFile.Name())
+
+	return nil
+}
+
+func ensureDirectoryExists(dirBasePath, newDirName string) error {
+	dirPath := fmt.Sprintf("%s/%s", dirBasePath, newDirName)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		err = os.Mkdir(dirPath, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("error occurred while creating a dir: [%v]", err)
+		}
+	}
+
+	return nil
+}
+
+// write data to a file in a crash-safe way; data is written to a temporary
+// file in the same directory first and, once it is synced, the temporary
+// file is atomically renamed to the target file path. A crash at any point
+// leaves either the previous or the new content under the target file path,
+// never a partially written file.
+func write(filePath string, data []byte) error {
+	return writeFile(filePath, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// writeStream atomically writes data produced by the provided function to
+// the file along with their checksum.
+func writeStream(filePath string, produce func(io.Writer) error) error {
+	return writeFile(filePath, func(file *os.File) error {
+		return writeWithChecksum(file, produce)
+	})
+}
+
+// writeFile atomically writes the file with the provided function. The
+// function writes to a temporary file which is moved to the final location
+// only once all the data are written and synced.
+func writeFile(
+	filePath string,
+	writeFunc func(file *os.File) error,
+) (err error) {
+	dirPath := filepath.Dir(filePath)
+
+	tempFile, err := ioutil.TempFile(
+		dirPath,
+		tempFilePrefix+filepath.Base(filePath)+".*",
+	)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// the temporary file has not been renamed, we need to clean it up
+		if err != nil {
+			removeFile(tempFile.Name())
+		}
+	}()
+
+	err = writeFunc(tempFile)
+	if err != nil {
+		closeFile(tempFile)
+		return err
+	}
+
+	err = tempFile.Sync()
+	if err != nil {
+		closeFile(tempFile)
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempFile.Name(), filePath)
+	if err != nil {
+		return err
+	}
+
+	// rename is durable only once the directory entry is synced
+	return syncDirectory(dirPath)
+}
+
+func syncDirectory(dirPath string) error {
+	// #nosec G304 (file path provided as taint input)
+	// This line opens a directory from the predefined storage.
+	// There is no user input.
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+
+	defer closeFile(dir)
+
+	return dir.Sync()
+}
+
+func isTempFile(fileName string) bool {
+	return strings.HasPrefix(fileName, tempFilePrefix)
+}
+
+// removeTempFiles removes all temporary files left behind by interrupted
+// writes in all the directories of the provided storage directory.
+func removeTempFiles(storageDirPath string) error {
+	dirs, err := ioutil.ReadDir(storageDirPath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			storageDirPath,
+			err,
+		)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		dirPath := fmt.Sprintf("%s/%s", storageDirPath, dir.Name())
+
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return fmt.Errorf(
+				"could not read the directory [%v]: [%v]",
+				dirPath,
+				err,
+			)
+		}
+
+		for _, file := range files {
+			if !isTempFile(file.Name()) {
+				continue
+			}
+
+			filePath := fmt.Sprintf("%s/%s", dirPath, file.Name())
+			logger.Warningf("removing leftover temporary file [%v]", filePath)
+
+			err := os.Remove(filePath)
+			if err != nil {
+				return fmt.Errorf(
+					"could not remove temporary file [%v]: [%v]",
+					filePath,
+					err,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateChecksumFormat adds checksums to all the data persisted before
+// checksums were introduced and records the checksum format in the data
+// directory. Data directories with the checksum format already recorded are
+// left as they are.
+func migrateChecksumFormat(dataDir string) error {
+	checksummed, err := hasChecksumFormat(dataDir)
+	if err != nil {
+		return err
+	}
+
+	if checksummed {
+		return nil
+	}
+
+	for _, area := range []string{currentDir, archiveDir, snapshotDir} {
+		areaPath := fmt.Sprintf("%s/%s", dataDir, area)
+
+		dirs, err := ioutil.ReadDir(areaPath)
+		if err != nil {
+			return fmt.Errorf(
+				"could not read the directory [%v]: [%v]",
+				areaPath,
+				err,
+			)
+		}
+
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+
+			dirPath := fmt.Sprintf("%s/%s", areaPath, dir.Name())
+
+			files, err := ioutil.ReadDir(dirPath)
+			if err != nil {
+				return fmt.Errorf(
+					"could not read the directory [%v]: [%v]",
+					dirPath,
+					err,
+				)
+			}
+
+			for _, file := range files {
+				if file.IsDir() || isTempFile(file.Name()) {
+					continue
+				}
+
+				filePath := fmt.Sprintf("%s/%s", dirPath, file.Name())
+
+				data, err := read(filePath)
+				if err != nil {
+					return fmt.Errorf(
+						"could not read file [%v]: [%v]",
+						filePath,
+						err,
+					)
+				}
+
+				if hasChecksum(data) {
+					continue
+				}
+
+				err = write(filePath, addChecksum(data))
+				if err != nil {
+					return fmt.Errorf(
+						"could not add checksum to file [%v]: [%v]",
+						filePath,
+						err,
+					)
+				}
+			}
+		}
+	}
+
+	logger.Infof("migrated data directory [%v] to checksummed format", dataDir)
+
+	return write(
+		fmt.Sprintf("%s/%s", dataDir, formatFileName),
+		[]byte(checksumFormat),
+	)
+}
+
+// hasChecksumFormat returns true if the checksum format is recorded in the
+// data directory, that is, if all the data in the directory are stored along
+// with their checksums.
+func hasChecksumFormat(dataDir string) (bool, error) {
+	format, err := read(fmt.Sprintf("%s/%s", dataDir, formatFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read storage format: [%v]", err)
+	}
+
+	if string(format) != checksumFormat {
+		return false, fmt.Errorf("unsupported storage format [%s]", format)
+	}
+
+	return true, nil
+}
+
+func removeFile(filePath string) {
+	err := os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorf("could not remove file [%v]: [%v]", filePath, err)
+	}
+}
+
+// read a file from a file system
+func read(filePath string) ([]byte, error) {
+	// #nosec G304 (file path provided as taint input)
+	// This line opens a file from the predefined storage.
+	// There is no user input.
+	readFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeFile(readFile)
+
+	data, err := ioutil.ReadAll(readFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// read a file from a file system and verify its checksum
+func readVerified(filePath string) ([]byte, error) {
+	data, err := read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyChecksum(data)
+}
+
+func closeFile(file *os.File) {
+	err := file.Close()
+	if err != nil {
+		logger.Errorf("could not close file [%v]: [%v]", file.Name(), err)
+	}
+}
+
+// readAll reads all files from the provided directoryPath and outputs them
+// as DataDescriptors into the first returned output channel. All errors
+// occurred during file system reading are sent to the second output channel
+// returned from this function. The output can be later processed using
+// pipeline pattern. This function is non-blocking and returned channels are
+// not buffered. Channels are closed when there is no more to be read. If the
+// listing lock is provided, it is held while the files are listed; the
+// listed files are emitted once the lock is released so that slow readers
+// do not block writers.
+func readAll(
+	directoryPath string,
+	options *readOptions,
+	listingLock sync.Locker,
+) (<-chan DataDescriptor, <-chan error) {
+	return readDescriptors(options, func(
+		emit func(DataDescriptor) bool,
+		emitError func(error) bool,
+	) {
+		descriptors, errors := listAll(directoryPath, options, listingLock)
+
+		for _, err := range errors {
+			if !emitError(err) {
+				return
+			}
+		}
+
+		for _, descriptor := range descriptors {
+			if !emit(descriptor) {
+				return
+			}
+		}
+	})
+}
+
+func listAll(
+	directoryPath string,
+	options *readOptions,
+	listingLock sync.Locker,
+) ([]DataDescriptor, []error) {
+	if listingLock != nil {
+		listingLock.Lock()
+		defer listingLock.Unlock()
+	}
+
+	descriptors := make([]DataDescriptor, 0)
+	errors := make([]error, 0)
+
+	files, err := ioutil.ReadDir(directoryPath)
+	if err != nil {
+		errors = append(errors, fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			directoryPath,
+			err,
+		))
+		return descriptors, errors
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || !options.matches(file.Name()) {
+			continue
+		}
+
+		dir, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", directoryPath, file.Name()))
+		if err != nil {
+			errors = append(errors, fmt.Errorf(
+				"could not read the directory [%s/%s]: [%v]",
+				directoryPath,
+				file.Name(),
+				err,
+			))
+			continue
+		}
+
+		for _, dirFile := range dir {
+			// skip files which are still being written
+			if dirFile.IsDir() || isTempFile(dirFile.Name()) {
+				continue
+			}
+
+			// capture shared loop variables for the closure
+			dirName := file.Name()
+			fileName := dirFile.Name()
+
+			readFunc := func() ([]byte, error) {
+				return readVerified(fmt.Sprintf(
+					"%s/%s/%s",
+					directoryPath,
+					dirName,
+					fileName,
+				))
+			}
+			descriptors = append(
+				descriptors,
+				&dataDescriptor{fileName, dirName, readFunc},
+			)
+		}
+	}
+
+	return descriptors, errors
 }
 
 func moveAll(directoryFromPath, directoryToPath string) error {
@@ -320,7 +1378,7 @@ func moveAll(directoryFromPath, directoryToPath string) error {
 	}
 	err = os.RemoveAll(directoryFromPath)
 	if err != nil {
-		return fmt.Errorf("error occurred while removing archived dir: [%v]", err)
+		return fmt.Errorf("error occurred while removing moved dir: [%v]", err)
 	}
 
 	return nil
@@ -9,14 +9,16 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 var (
 	dataDir = "./"
 
-	dirCurrent  = "current"
-	dirArchive  = "archive"
-	dirSnapshot = "snapshot"
+	dirCurrent    = "current"
+	dirArchive    = "archive"
+	dirSnapshot   = "snapshot"
+	dirQuarantine = "quarantine"
 
 	dirName1   = "0x424242"
 	fileName11 = "file11"
@@ -25,9 +27,13 @@ var (
 	dirName2   = "0x777777"
 	fileName21 = "file21"
 
-	pathToCurrent  = fmt.Sprintf("%s/%s", dataDir, dirCurrent)
-	pathToArchive  = fmt.Sprintf("%s/%s", dataDir, dirArchive)
-	pathToSnapshot = fmt.Sprintf("%s/%s", dataDir, dirSnapshot)
+	pathToCurrent    = fmt.Sprintf("%s/%s", dataDir, dirCurrent)
+	pathToArchive    = fmt.Sprintf("%s/%s", dataDir, dirArchive)
+	pathToSnapshot   = fmt.Sprintf("%s/%s", dataDir, dirSnapshot)
+	pathToQuarantine = fmt.Sprintf("%s/%s", dataDir, dirQuarantine)
+	pathToJournal    = fmt.Sprintf("%s/%s", dataDir, journalDir)
+	pathToLock       = fmt.Sprintf("%s/%s", dataDir, lockFileName)
+	pathToFormat     = fmt.Sprintf("%s/%s", dataDir, formatFileName)
 
 	errExpectedRead  = fmt.Errorf("cannot read from the storage directory: ")
 	errExpectedWrite = fmt.Errorf("cannot write to the storage directory: ")
@@ -42,9 +48,25 @@ var (
 )
 
 func cleanup() {
+	abandonHandles(dataDir)
 	os.RemoveAll(pathToCurrent)
 	os.RemoveAll(pathToArchive)
 	os.RemoveAll(pathToSnapshot)
+	os.RemoveAll(pathToQuarantine)
+	os.RemoveAll(pathToJournal)
+	os.Remove(pathToLock)
+	os.Remove(pathToFormat)
+}
+
+// abandonHandles releases the data directory lock shared by all the handles
+// created so far just like it is released when the process crashes. The
+// abandoned handles must not be used anymore.
+func abandonHandles(dataDir string) {
+	for {
+		if err := unlockDataDirectory(dataDir); err != nil {
+			return
+		}
+	}
 }
 
 func TestDiskPersistence_Save(t *testing.T) {
@@ -484,8 +506,8 @@ func TestDiskPersistence_AppendToArchive(t *testing.T) {
 	diskPersistence.Save(bytesToTest, dirName1, fileName12)
 	diskPersistence.Archive(dirName1)
 
-	diskPersistence.Save(bytesToTest, dirName1, "/file13")
-	diskPersistence.Save(bytesToTest, dirName1, "/file14")
+	diskPersistence.Save(bytesToTest, dirName1, "file13")
+	diskPersistence.Save(bytesToTest, dirName1, "file14")
 	diskPersistence.Archive(dirName1)
 
 	if _, err := os.Stat(pathMoveFrom); !os.IsNotExist(err) {
@@ -499,3 +521,817 @@ func TestDiskPersistence_AppendToArchive(t *testing.T) {
 
 	cleanup()
 }
+
+func TestDiskPersistence_Read(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileContent, err := diskPersistence.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(bytesToTest, fileContent) {
+		t.Errorf(
+			"unexpected file content\nexpected: [%v]\nactual:   [%v]\n",
+			bytesToTest,
+			fileContent,
+		)
+	}
+
+	_, err = diskPersistence.Read(dirName1, fileName12)
+	if err == nil {
+		t.Fatalf("expected error for non-existing file")
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_RefuseRead(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	_, err := diskPersistence.Read(notAllowedName, fileName11)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if errDirectoryNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errDirectoryNameLength.Error(),
+			err.Error(),
+		)
+	}
+
+	_, err = diskPersistence.Read(dirName1, notAllowedName)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if errFileNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errFileNameLength.Error(),
+			err.Error(),
+		)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_Delete(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Save(bytesToTest, dirName1, fileName12)
+
+	err := diskPersistence.Delete(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathToFile := fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName11)
+	if _, err := os.Stat(pathToFile); !os.IsNotExist(err) {
+		t.Fatalf("file [%+v] was supposed to be removed", pathToFile)
+	}
+
+	pathToFile = fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName12)
+	if _, err := os.Stat(pathToFile); os.IsNotExist(err) {
+		t.Fatalf("file [%+v] was not supposed to be removed", pathToFile)
+	}
+
+	err = diskPersistence.Delete(dirName1, fileName11)
+	if err == nil {
+		t.Fatalf("expected error for non-existing file")
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_List(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Save(bytesToTest, dirName1, fileName12)
+	diskPersistence.Save(bytesToTest, dirName2, fileName21)
+
+	names, err := diskPersistence.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{fileName11, fileName12}
+	if !reflect.DeepEqual(expectedNames, names) {
+		t.Fatalf(
+			"unexpected names\nexpected: [%v]\nactual:   [%v]",
+			expectedNames,
+			names,
+		)
+	}
+
+	names, err = diskPersistence.List("0x999999")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 0 {
+		t.Fatalf("expected no names for non-existing directory; has [%v]", names)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_RefusePathTraversal(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Archive(dirName1)
+
+	archivedFile := fmt.Sprintf("%s/%s/%s", pathToArchive, dirName1, fileName11)
+
+	var tests = map[string]struct {
+		directory string
+		name      string
+	}{
+		"parent directory": {
+			directory: "..",
+			name:      dirArchive,
+		},
+		"directory outside of the storage area": {
+			directory: "../" + dirArchive + "/" + dirName1,
+			name:      fileName11,
+		},
+		"directory with backslash": {
+			directory: `..\` + dirArchive,
+			name:      fileName11,
+		},
+		"current directory": {
+			directory: ".",
+			name:      dirName1,
+		},
+		"empty directory": {
+			directory: "",
+			name:      dirName1,
+		},
+		"name outside of the directory": {
+			directory: dirName1,
+			name:      "../../" + dirArchive + "/" + dirName1 + "/" + fileName11,
+		},
+		"parent name": {
+			directory: dirName1,
+			name:      "..",
+		},
+		"empty name": {
+			directory: dirName1,
+			name:      "",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			if _, err := diskPersistence.Read(test.directory, test.name); err == nil {
+				t.Errorf("expected read error")
+			}
+
+			if err := diskPersistence.Delete(test.directory, test.name); err == nil {
+				t.Errorf("expected delete error")
+			}
+
+			if err := diskPersistence.Save(bytesToTest, test.directory, test.name); err == nil {
+				t.Errorf("expected save error")
+			}
+
+			if err := diskPersistence.Snapshot(bytesToTest, test.directory, test.name); err == nil {
+				t.Errorf("expected snapshot error")
+			}
+
+			if test.directory == dirName1 {
+				return
+			}
+
+			if _, err := diskPersistence.List(test.directory); err == nil {
+				t.Errorf("expected list error")
+			}
+		})
+	}
+
+	if _, err := os.Stat(archivedFile); os.IsNotExist(err) {
+		t.Fatalf("file [%+v] was not supposed to be removed", archivedFile)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_SaveLeavesNoTempFiles(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite an existing file
+	err = diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", pathToCurrent, dirName1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].Name() != fileName11 {
+		t.Fatalf("expected only [%v] file in the directory", fileName11)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_RemoveLeftoverTempFiles(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+
+	// simulate a write interrupted by a crash
+	tempFilePath := fmt.Sprintf(
+		"%s/%s/%s",
+		pathToCurrent,
+		dirName1,
+		tempFilePrefix+fileName12+".123",
+	)
+	err := ioutil.WriteFile(tempFilePath, bytesToTest[:2], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := diskPersistence.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{fileName11}, names) {
+		t.Fatalf("temporary file should not be listed; has [%v]", names)
+	}
+
+	dataChannel, errChannel := diskPersistence.ReadAll()
+	go func() {
+		for range errChannel {
+		}
+	}()
+
+	descriptorsCount := 0
+	for range dataChannel {
+		descriptorsCount++
+	}
+	if descriptorsCount != 1 {
+		t.Fatalf("expected [1] descriptor; has [%v]", descriptorsCount)
+	}
+
+	// simulate a crash leaving the temporary file behind
+	abandonHandles(dataDir)
+
+	_, err = NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tempFilePath); !os.IsNotExist(err) {
+		t.Fatalf("file [%+v] was supposed to be removed", tempFilePath)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_Unarchive(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	pathArchived := fmt.Sprintf("%s/%s", pathToArchive, dirName1)
+	pathUnarchived := fmt.Sprintf("%s/%s", pathToCurrent, dirName1)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Archive(dirName1)
+
+	err := diskPersistence.Unarchive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(pathArchived); !os.IsNotExist(err) {
+		t.Fatalf("Dir [%+v] was supposed to be moved", pathArchived)
+	}
+
+	if _, err := os.Stat(pathUnarchived); os.IsNotExist(err) {
+		t.Fatalf("Dir [%+v] was supposed to be created", pathUnarchived)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_UnarchiveMergeWithCurrent(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	pathArchived := fmt.Sprintf("%s/%s", pathToArchive, dirName1)
+	pathUnarchived := fmt.Sprintf("%s/%s", pathToCurrent, dirName1)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Archive(dirName1)
+	diskPersistence.Save(bytesToTest, dirName1, fileName12)
+
+	err := diskPersistence.Unarchive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(pathArchived); !os.IsNotExist(err) {
+		t.Fatalf("Dir [%+v] was supposed to be removed", pathArchived)
+	}
+
+	files, _ := ioutil.ReadDir(pathUnarchived)
+	if len(files) != 2 {
+		t.Fatalf("Number of all files was supposed to be [%+v]", 2)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_RefuseUnarchive(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	err := diskPersistence.Unarchive(notAllowedName)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if errDirectoryNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errDirectoryNameLength.Error(),
+			err.Error(),
+		)
+	}
+
+	err = diskPersistence.Unarchive(dirName1)
+
+	expectedError := fmt.Errorf("directory [%v] is not archived", dirName1)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_ReadArchived(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+	diskPersistence.Save(bytesToTest, dirName1, fileName12)
+	diskPersistence.Save(bytesToTest, dirName2, fileName21)
+	diskPersistence.Archive(dirName1)
+
+	dataChannel, errChannel := diskPersistence.ReadArchived()
+
+	var descriptors []DataDescriptor
+	var errors []error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for e := range errChannel {
+			errors = append(errors, e)
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for d := range dataChannel {
+			descriptors = append(descriptors, d)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+
+	for err := range errors {
+		t.Fatal(err)
+	}
+
+	if len(descriptors) != 2 {
+		t.Fatalf(
+			"Number of descriptors does not match\nExpected: [%v]\nActual:   [%v]",
+			2,
+			len(descriptors),
+		)
+	}
+
+	for _, descriptor := range descriptors {
+		if descriptor.Directory() != dirName1 {
+			t.Errorf(
+				"unexpected directory\nexpected: [%v]\nactual:   [%v]\n",
+				dirName1,
+				descriptor.Directory(),
+			)
+		}
+
+		fileContent, err := descriptor.Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(bytesToTest, fileContent) {
+			t.Errorf(
+				"unexpected file content\nexpected: [%v]\nactual:   [%v]\n",
+				bytesToTest,
+				fileContent,
+			)
+		}
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_ListSnapshots(t *testing.T) {
+	diskHandle, _ := NewDiskHandle(dataDir)
+
+	counter := 10
+	diskHandle.(*diskPersistence).snapshotSuffixGenerator = func() string {
+		counter--
+		return fmt.Sprintf(".%d", counter)
+	}
+
+	for i := 0; i < 3; i++ {
+		err := diskHandle.Snapshot([]byte{byte(i)}, dirName1, fileName11)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskHandle.Snapshot([]byte{0xFF}, dirName1, fileName12)
+
+	snapshots, err := diskHandle.ListSnapshots(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 3 {
+		t.Fatalf("expected [3] snapshots; has [%v]", len(snapshots))
+	}
+
+	// suffixes are decreasing so the last snapshot taken is the oldest one
+	for i, snapshot := range snapshots {
+		expectedTimestamp := time.Unix(0, int64(7+i)*int64(time.Millisecond))
+		if !expectedTimestamp.Equal(snapshot.Timestamp()) {
+			t.Errorf(
+				"unexpected timestamp of snapshot [%v]\nexpected: [%v]\nactual:   [%v]",
+				i,
+				expectedTimestamp,
+				snapshot.Timestamp(),
+			)
+		}
+
+		if snapshot.Name() != fileName11 {
+			t.Errorf(
+				"unexpected name of snapshot [%v]\nexpected: [%v]\nactual:   [%v]",
+				i,
+				fileName11,
+				snapshot.Name(),
+			)
+		}
+
+		content, err := snapshot.Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedContent := []byte{byte(2 - i)}
+		if !bytes.Equal(expectedContent, content) {
+			t.Errorf(
+				"unexpected content of snapshot [%v]\nexpected: [%v]\nactual:   [%v]",
+				i,
+				expectedContent,
+				content,
+			)
+		}
+	}
+
+	snapshots, err = diskHandle.ListSnapshots(dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 0 {
+		t.Fatalf("expected no snapshots; has [%v]", len(snapshots))
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_RestoreSnapshot(t *testing.T) {
+	diskHandle, _ := NewDiskHandle(dataDir)
+
+	counter := 0
+	diskHandle.(*diskPersistence).snapshotSuffixGenerator = func() string {
+		counter++
+		return fmt.Sprintf(".%d", counter)
+	}
+
+	diskHandle.Snapshot([]byte{1}, dirName1, fileName11)
+	diskHandle.Snapshot([]byte{2}, dirName1, fileName11)
+	diskHandle.Save([]byte{3}, dirName1, fileName11)
+
+	err := diskHandle.RestoreSnapshot(
+		dirName1,
+		fileName11,
+		time.Unix(0, int64(time.Millisecond)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := diskHandle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf(
+			"unexpected restored content\nexpected: [%v]\nactual:   [%v]",
+			[]byte{1},
+			content,
+		)
+	}
+
+	err = diskHandle.RestoreSnapshot(
+		dirName1,
+		fileName11,
+		time.Unix(0, 5*int64(time.Millisecond)),
+	)
+	if err == nil {
+		t.Fatalf("expected error for non-existing snapshot")
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_PruneSnapshots(t *testing.T) {
+	diskHandle, _ := NewDiskHandle(dataDir)
+
+	now := time.Now()
+
+	counter := 0
+	diskHandle.(*diskPersistence).snapshotSuffixGenerator = func() string {
+		counter++
+		// snapshots taken 5, 4, 3, 2 and 1 hour ago
+		return snapshotSuffix(now.Add(time.Duration(counter-6) * time.Hour))
+	}
+
+	for i := 0; i < 5; i++ {
+		diskHandle.Snapshot([]byte{byte(i)}, dirName1, fileName11)
+	}
+
+	err := diskHandle.PruneSnapshots(&SnapshotRetentionPolicy{KeepLast: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, _ := diskHandle.ListSnapshots(dirName1, fileName11)
+	if len(snapshots) != 4 {
+		t.Fatalf("expected [4] snapshots; has [%v]", len(snapshots))
+	}
+
+	err = diskHandle.PruneSnapshots(
+		&SnapshotRetentionPolicy{MaxAge: 150 * time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, _ = diskHandle.ListSnapshots(dirName1, fileName11)
+	if len(snapshots) != 2 {
+		t.Fatalf("expected [2] snapshots; has [%v]", len(snapshots))
+	}
+
+	content, _ := snapshots[0].Content()
+	if !bytes.Equal([]byte{3}, content) {
+		t.Fatalf(
+			"unexpected content of the oldest snapshot retained\n"+
+				"expected: [%v]\nactual:   [%v]",
+			[]byte{3},
+			content,
+		)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_DetectCorruptedData(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+
+	pathToFile := fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName11)
+	corruptFile(t, pathToFile)
+
+	_, err := diskPersistence.Read(dirName1, fileName11)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error; has [%v]", err)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_DetectCorruptedMagic(t *testing.T) {
+	diskPersistence, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskPersistence.Save(bytesToTest, dirName1, fileName11)
+
+	pathToFile := fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName11)
+
+	content, err := ioutil.ReadFile(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0x01
+	err = ioutil.WriteFile(pathToFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = diskPersistence.Read(dirName1, fileName11)
+	if err == nil || !strings.Contains(err.Error(), "checksum header is missing") {
+		t.Fatalf("expected missing checksum header error; has [%v]", err)
+	}
+
+	var errors []error
+	for err := range diskPersistence.Verify() {
+		errors = append(errors, err)
+	}
+
+	if len(errors) != 1 {
+		t.Fatalf("expected [1] error; has [%v]: [%v]", len(errors), errors)
+	}
+
+	quarantinedFile := fmt.Sprintf(
+		"%s/%s/%s/%s",
+		pathToQuarantine,
+		dirCurrent,
+		dirName1,
+		fileName11,
+	)
+	if _, err := os.Stat(quarantinedFile); os.IsNotExist(err) {
+		t.Fatalf("file [%+v] was supposed to be quarantined", quarantinedFile)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_MigrateLegacyData(t *testing.T) {
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+	pathToFile := fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName11)
+
+	writeLegacyFile := func() {
+		err := os.MkdirAll(fmt.Sprintf("%s/%s", pathToCurrent, dirName1), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(pathToFile, bytesToTest, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLegacyFile()
+
+	diskPersistence, err := NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := diskPersistence.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytesToTest, data) {
+		t.Fatalf(
+			"unexpected data\nexpected: [%v]\nactual:   [%v]",
+			bytesToTest,
+			data,
+		)
+	}
+
+	format, err := ioutil.ReadFile(pathToFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(format) != checksumFormat {
+		t.Fatalf("unexpected storage format [%s]", format)
+	}
+
+	// once migrated, data without checksum are no longer considered legacy
+	writeLegacyFile()
+
+	diskPersistence, err = NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = diskPersistence.Read(dirName1, fileName11)
+	if err == nil || !strings.Contains(err.Error(), "checksum header is missing") {
+		t.Fatalf("expected missing checksum header error; has [%v]", err)
+	}
+
+	cleanup()
+}
+
+func TestDiskPersistence_Verify(t *testing.T) {
+	diskHandle, _ := NewDiskHandle(dataDir)
+
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	diskHandle.(*diskPersistence).snapshotSuffixGenerator = func() string {
+		return ".1"
+	}
+
+	diskHandle.Save(bytesToTest, dirName1, fileName11)
+	diskHandle.Save(bytesToTest, dirName1, fileName12)
+	diskHandle.Save(bytesToTest, dirName2, fileName21)
+	diskHandle.Archive(dirName2)
+	diskHandle.Snapshot(bytesToTest, dirName1, fileName11)
+
+	corruptFile(t, fmt.Sprintf("%s/%s/%s", pathToCurrent, dirName1, fileName11))
+	corruptFile(t, fmt.Sprintf("%s/%s/%s", pathToArchive, dirName2, fileName21))
+
+	var errors []error
+	for err := range diskHandle.Verify() {
+		errors = append(errors, err)
+	}
+
+	if len(errors) != 2 {
+		t.Fatalf("expected [2] errors; has [%v]: [%v]", len(errors), errors)
+	}
+
+	quarantinedFiles := []string{
+		fmt.Sprintf("%s/%s/%s/%s", pathToQuarantine, dirCurrent, dirName1, fileName11),
+		fmt.Sprintf("%s/%s/%s/%s", pathToQuarantine, dirArchive, dirName2, fileName21),
+	}
+	for _, pathToFile := range quarantinedFiles {
+		if _, err := os.Stat(pathToFile); os.IsNotExist(err) {
+			t.Fatalf("file [%+v] was supposed to be quarantined", pathToFile)
+		}
+	}
+
+	descriptors, readErrors := readAllDescriptors(diskHandle.ReadAll())
+	for _, err := range readErrors {
+		t.Fatal(err)
+	}
+
+	if len(descriptors) != 1 || descriptors[0].Name() != fileName12 {
+		t.Fatalf("only [%v] should remain non-archived", fileName12)
+	}
+
+	for err := range diskHandle.Verify() {
+		t.Fatalf("unexpected error on the second verification: [%v]", err)
+	}
+
+	cleanup()
+}
+
+func corruptFile(t *testing.T, pathToFile string) {
+	content, err := ioutil.ReadFile(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content[len(content)-1] ^= 0x01
+
+	err = ioutil.WriteFile(pathToFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,494 @@
+package persistence
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	// journalDir keeps the data staged in transactions which have not been
+	// fully applied yet. Each transaction has its own directory in the
+	// journal keeping the staged data in the same directory structure as in
+	// the current storage area.
+	journalDir = "journal"
+
+	transactionDirPrefix = "tx-"
+	transactionDataDir   = "data"
+	// transactionCommitMarker is written to the transaction directory once
+	// all the data has been staged. Transactions with the marker are applied
+	// and transactions without the marker are discarded during the recovery.
+	transactionCommitMarker = "committed"
+	// transactionReplacedDir keeps the files replaced by the data staged in
+	// the transaction while it is being applied so that applying can be
+	// rolled back if it fails in the middle.
+	transactionReplacedDir = "replaced"
+)
+
+// diskTransaction stages the data in the journal and moves them to the
+// current storage area once committed.
+type diskTransaction struct {
+	ds   *diskPersistence
+	path string
+
+	mutex    sync.Mutex
+	finished bool
+}
+
+func (ds *diskPersistence) Begin() (Transaction, error) {
+	path, err := ioutil.TempDir(
+		fmt.Sprintf("%s/%s", ds.dataDir, journalDir),
+		transactionDirPrefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create transaction journal: [%v]", err)
+	}
+
+	err = ensureDirectoryExists(path, transactionDataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskTransaction{
+		ds:   ds,
+		path: path,
+	}, nil
+}
+
+func (dt *diskTransaction) Save(data []byte, directory, name string) error {
+	return dt.save(directory, name, func(filePath string) error {
+		return dt.ds.write(journalDir, filePath, addChecksum(data))
+	})
+}
+
+// saveStream works as Save but the data is produced by the provided function
+// writing to the stream so that the data is never held in memory as a whole.
+func (dt *diskTransaction) saveStream(
+	directory string,
+	name string,
+	produce func(io.Writer) error,
+) error {
+	return dt.save(directory, name, func(filePath string) error {
+		return dt.ds.writeStream(journalDir, filePath, produce)
+	})
+}
+
+func (dt *diskTransaction) save(
+	directory string,
+	name string,
+	writeFunc func(filePath string) error,
+) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.finished {
+		return errTransactionFinished
+	}
+
+	dataPath := fmt.Sprintf("%s/%s", dt.path, transactionDataDir)
+	err = ensureDirectoryExists(dataPath, directory)
+	if err != nil {
+		return err
+	}
+
+	// staged data is accounted in the usage of the journal right away so
+	// that the commit does not exceed the quota
+	return writeFunc(fmt.Sprintf("%s/%s/%s", dataPath, directory, name))
+}
+
+func (dt *diskTransaction) Commit() error {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.finished {
+		return errTransactionFinished
+	}
+
+	dt.finished = true
+
+	// if the transaction could not be marked as committed, it is discarded
+	// right away so that the staged data do not take the space until the
+	// handle is created again
+	err := dt.markCommitted()
+	if err != nil {
+		if discardErr := dt.discard(); discardErr != nil {
+			logger.Errorf(
+				"could not discard transaction [%v]: [%v]",
+				dt.path,
+				discardErr,
+			)
+		}
+
+		return err
+	}
+
+	dt.ds.transactionMutex.Lock()
+	defer dt.ds.transactionMutex.Unlock()
+
+	stagedSize, err := directorySize(dt.path)
+	if err != nil {
+		logger.Errorf("could not compute transaction size: [%v]", err)
+	}
+
+	applier := &transactionApplier{
+		dataDir:         dt.ds.dataDir,
+		transactionPath: dt.path,
+	}
+
+	replacedSize, err := applier.apply()
+	if err != nil {
+		// none of the data may stay visible so the files applied so far are
+		// moved back to the journal and the transaction is discarded; if it
+		// is not possible, the transaction stays committed and is completed
+		// once the handle is created again
+		if rollbackErr := applier.rollback(); rollbackErr != nil {
+			return fmt.Errorf(
+				"could not apply transaction: [%v]; could not roll it back, "+
+					"it will be completed once the handle is created again: [%v]",
+				err,
+				rollbackErr,
+			)
+		}
+
+		if discardErr := dt.discard(); discardErr != nil {
+			logger.Errorf(
+				"could not discard transaction [%v]: [%v]",
+				dt.path,
+				discardErr,
+			)
+		}
+
+		return fmt.Errorf("could not apply transaction: [%v]", err)
+	}
+
+	dt.ds.usage.move(journalDir, currentDir, stagedSize)
+	dt.ds.usage.add(currentDir, -replacedSize)
+
+	return nil
+}
+
+func (dt *diskTransaction) Rollback() error {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.finished {
+		return errTransactionFinished
+	}
+
+	dt.finished = true
+
+	return dt.discard()
+}
+
+// markCommitted makes all the staged data durable and writes the commit
+// marker to the transaction directory.
+func (dt *diskTransaction) markCommitted() error {
+	// directories created for the staged data have to be durable before
+	// the transaction is marked as committed
+	err := syncDirectory(fmt.Sprintf("%s/%s", dt.path, transactionDataDir))
+	if err != nil {
+		return fmt.Errorf("could not sync transaction journal: [%v]", err)
+	}
+
+	err = syncDirectory(fmt.Sprintf("%s/%s", dt.ds.dataDir, journalDir))
+	if err != nil {
+		return fmt.Errorf("could not sync transaction journal: [%v]", err)
+	}
+
+	err = write(
+		fmt.Sprintf("%s/%s", dt.path, transactionCommitMarker),
+		[]byte{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not mark transaction as committed: [%v]", err)
+	}
+
+	return nil
+}
+
+// discard removes the transaction directory from the journal and releases
+// the space reserved for the staged data. The commit marker is removed first
+// so that the transaction removed only in part is never applied.
+func (dt *diskTransaction) discard() error {
+	size, err := directorySize(dt.path)
+	if err != nil {
+		return fmt.Errorf("could not compute transaction size: [%v]", err)
+	}
+
+	err = os.RemoveAll(fmt.Sprintf("%s/%s", dt.path, transactionCommitMarker))
+	if err != nil {
+		return fmt.Errorf("could not remove commit marker: [%v]", err)
+	}
+
+	err = os.RemoveAll(dt.path)
+	if err != nil {
+		return fmt.Errorf("could not remove transaction journal: [%v]", err)
+	}
+
+	dt.ds.usage.add(journalDir, -size)
+
+	return nil
+}
+
+// transactionApplier moves all the data staged in the committed transaction
+// to the current storage area and removes the transaction from the journal.
+// Files replaced by the staged data are moved to the transaction directory
+// before they are replaced so that applying can be rolled back. Applying is
+// idempotent so the transaction interrupted in the middle of being applied
+// can be applied again.
+type transactionApplier struct {
+	dataDir         string
+	transactionPath string
+
+	applied []*appliedFile
+}
+
+// appliedFile is a file moved from the transaction to the current storage
+// area.
+type appliedFile struct {
+	stagedPath string
+	targetPath string
+	// replacedPath is the path the replaced file has been moved to; empty
+	// if the file did not replace any other file
+	replacedPath string
+	moved        bool
+}
+
+// apply applies the transaction and returns the total size of the files
+// replaced by the staged data.
+func (ta *transactionApplier) apply() (int64, error) {
+	dataPath := fmt.Sprintf("%s/%s", ta.transactionPath, transactionDataDir)
+	replacedPath := fmt.Sprintf(
+		"%s/%s",
+		ta.transactionPath,
+		transactionReplacedDir,
+	)
+	currentPath := fmt.Sprintf("%s/%s", ta.dataDir, currentDir)
+
+	dirs, err := ioutil.ReadDir(dataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			dataPath,
+			err,
+		)
+	}
+
+	err = ensureDirectoryExists(ta.transactionPath, transactionReplacedDir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		err := ensureDirectoryExists(currentPath, dir.Name())
+		if err != nil {
+			return 0, err
+		}
+
+		err = ensureDirectoryExists(replacedPath, dir.Name())
+		if err != nil {
+			return 0, err
+		}
+
+		dirPath := fmt.Sprintf("%s/%s", dataPath, dir.Name())
+
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return 0, fmt.Errorf(
+				"could not read the directory [%v]: [%v]",
+				dirPath,
+				err,
+			)
+		}
+
+		targetDirPath := fmt.Sprintf("%s/%s", currentPath, dir.Name())
+
+		for _, file := range files {
+			if file.IsDir() || isTempFile(file.Name()) {
+				continue
+			}
+
+			err := ta.applyFile(
+				fmt.Sprintf("%s/%s", dirPath, file.Name()),
+				fmt.Sprintf("%s/%s", targetDirPath, file.Name()),
+				fmt.Sprintf("%s/%s/%s", replacedPath, dir.Name(), file.Name()),
+			)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		err = syncDirectory(targetDirPath)
+		if err != nil {
+			return 0, fmt.Errorf(
+				"could not sync the directory [%v]: [%v]",
+				targetDirPath,
+				err,
+			)
+		}
+	}
+
+	err = syncDirectory(currentPath)
+	if err != nil {
+		return 0, fmt.Errorf(
+			"could not sync the directory [%v]: [%v]",
+			currentPath,
+			err,
+		)
+	}
+
+	replacedSize, err := directorySize(replacedPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not compute replaced data size: [%v]", err)
+	}
+
+	err = os.RemoveAll(ta.transactionPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not remove transaction journal: [%v]", err)
+	}
+
+	return replacedSize, nil
+}
+
+// applyFile moves the file the staged data replaces, if any, to the
+// transaction directory and moves the staged data to the target path.
+func (ta *transactionApplier) applyFile(
+	stagedPath string,
+	targetPath string,
+	replacedPath string,
+) error {
+	file := &appliedFile{
+		stagedPath: stagedPath,
+		targetPath: targetPath,
+	}
+
+	if !isNonExistingFile(targetPath) {
+		err := os.Rename(targetPath, replacedPath)
+		if err != nil {
+			return fmt.Errorf(
+				"could not apply transaction to [%v]: [%v]",
+				targetPath,
+				err,
+			)
+		}
+
+		file.replacedPath = replacedPath
+	}
+
+	ta.applied = append(ta.applied, file)
+
+	err := os.Rename(stagedPath, targetPath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not apply transaction to [%v]: [%v]",
+			targetPath,
+			err,
+		)
+	}
+
+	file.moved = true
+
+	return nil
+}
+
+// rollback moves all the files applied so far back to the transaction
+// directory and restores the files they replaced.
+func (ta *transactionApplier) rollback() error {
+	for i := len(ta.applied) - 1; i >= 0; i-- {
+		file := ta.applied[i]
+
+		if file.moved {
+			err := os.Rename(file.targetPath, file.stagedPath)
+			if err != nil {
+				return fmt.Errorf(
+					"could not roll back [%v]: [%v]",
+					file.targetPath,
+					err,
+				)
+			}
+		}
+
+		if file.replacedPath != "" {
+			err := os.Rename(file.replacedPath, file.targetPath)
+			if err != nil {
+				return fmt.Errorf(
+					"could not restore [%v]: [%v]",
+					file.targetPath,
+					err,
+				)
+			}
+		}
+	}
+
+	ta.applied = nil
+
+	return nil
+}
+
+// recoverJournal completes all the transactions which have been committed
+// but not fully applied and discards all the transactions which have not
+// been committed before the process stopped.
+func recoverJournal(dataDir string) error {
+	journalPath := fmt.Sprintf("%s/%s", dataDir, journalDir)
+
+	transactions, err := ioutil.ReadDir(journalPath)
+	if err != nil {
+		return fmt.Errorf(
+			"could not read the directory [%v]: [%v]",
+			journalPath,
+			err,
+		)
+	}
+
+	for _, transaction := range transactions {
+		transactionPath := fmt.Sprintf("%s/%s", journalPath, transaction.Name())
+
+		if isNonExistingFile(
+			fmt.Sprintf("%s/%s", transactionPath, transactionCommitMarker),
+		) {
+			logger.Warningf(
+				"discarding uncommitted transaction [%v]",
+				transactionPath,
+			)
+
+			err := os.RemoveAll(transactionPath)
+			if err != nil {
+				return fmt.Errorf(
+					"could not remove transaction journal: [%v]",
+					err,
+				)
+			}
+
+			continue
+		}
+
+		logger.Infof("applying committed transaction [%v]", transactionPath)
+
+		applier := &transactionApplier{
+			dataDir:         dataDir,
+			transactionPath: transactionPath,
+		}
+
+		if _, err := applier.apply(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,386 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keep-network/keep-common/pkg/metrics"
+)
+
+// DiskConfig holds the optional limits of the on-disk data persistence.
+type DiskConfig struct {
+	// Quota is the maximum number of bytes all the data kept in the data
+	// directory can take. Zero means there is no quota.
+	Quota uint64
+	// MinFreeSpace is the number of bytes which must remain free on the disk
+	// holding the data directory. Writes which would leave less free space
+	// are refused before anything is written.
+	MinFreeSpace uint64
+}
+
+// usageAreas are the top-level areas of the data directory usage is tracked
+// for.
+var usageAreas = []string{
+	currentDir,
+	archiveDir,
+	snapshotDir,
+	quarantineDir,
+	journalDir,
+}
+
+// freeSpaceCheckInterval is the number of bytes of the streamed data for
+// which the free disk space is checked at once. The quota is checked for each
+// chunk of the streamed data but checking the free disk space requires
+// a system call so it is done only once per that many bytes.
+const freeSpaceCheckInterval = 1024 * 1024
+
+// diskUsage tracks the number of bytes used by each top-level area of the
+// data directory.
+type diskUsage struct {
+	mutex sync.Mutex
+	areas map[string]int64
+}
+
+// newDiskUsage computes the current usage of all the top-level areas of the
+// data directory.
+func newDiskUsage(dataDir string) (*diskUsage, error) {
+	areas := make(map[string]int64)
+
+	for _, area := range usageAreas {
+		size, err := directorySize(fmt.Sprintf("%s/%s", dataDir, area))
+		if err != nil {
+			return nil, fmt.Errorf(
+				"could not compute usage of area [%v]: [%v]",
+				area,
+				err,
+			)
+		}
+
+		areas[area] = size
+	}
+
+	return &diskUsage{areas: areas}, nil
+}
+
+func (du *diskUsage) area(area string) int64 {
+	du.mutex.Lock()
+	defer du.mutex.Unlock()
+
+	return du.areas[area]
+}
+
+func (du *diskUsage) total() int64 {
+	du.mutex.Lock()
+	defer du.mutex.Unlock()
+
+	return du.totalUnsafe()
+}
+
+func (du *diskUsage) totalUnsafe() int64 {
+	total := int64(0)
+	for _, size := range du.areas {
+		total += size
+	}
+
+	return total
+}
+
+func (du *diskUsage) add(area string, delta int64) {
+	du.mutex.Lock()
+	defer du.mutex.Unlock()
+
+	du.areas[area] += delta
+}
+
+// move transfers the given number of bytes from one area to another.
+func (du *diskUsage) move(fromArea, toArea string, size int64) {
+	du.mutex.Lock()
+	defer du.mutex.Unlock()
+
+	du.areas[fromArea] -= size
+	du.areas[toArea] += size
+}
+
+// reserve checks whether the given number of bytes can be written to the
+// area and, if so, accounts them in the area usage. Negative delta frees the
+// space and is always accepted. The reservation has to be released with
+// a negative delta if the write fails.
+func (ds *diskPersistence) reserve(area string, delta int64) error {
+	if delta <= 0 {
+		ds.usage.add(area, delta)
+		return nil
+	}
+
+	if err := ds.checkFreeSpace(delta); err != nil {
+		return err
+	}
+
+	return ds.reserveQuota(area, delta)
+}
+
+// checkFreeSpace checks whether the given number of bytes can be written to
+// the disk leaving the configured minimum of free disk space.
+func (ds *diskPersistence) checkFreeSpace(size int64) error {
+	available, err := ds.availableSpaceFunc(ds.dataDir)
+	if err != nil {
+		return fmt.Errorf("could not check available disk space: [%v]", err)
+	}
+
+	required := uint64(size) + ds.config.MinFreeSpace
+	if available < required {
+		return fmt.Errorf(
+			"insufficient disk space; [%v] bytes available, "+
+				"[%v] bytes to write and [%v] bytes must remain free",
+			available,
+			size,
+			ds.config.MinFreeSpace,
+		)
+	}
+
+	return nil
+}
+
+// reserveQuota accounts the given number of bytes in the area usage if the
+// quota allows for it.
+func (ds *diskPersistence) reserveQuota(area string, delta int64) error {
+	ds.usage.mutex.Lock()
+	defer ds.usage.mutex.Unlock()
+
+	if ds.config.Quota > 0 {
+		used := ds.usage.totalUnsafe()
+		if used+delta > int64(ds.config.Quota) {
+			return fmt.Errorf(
+				"storage quota of [%v] bytes exceeded; "+
+					"[%v] bytes used and [%v] bytes to write",
+				ds.config.Quota,
+				used,
+				delta,
+			)
+		}
+	}
+
+	ds.usage.areas[area] += delta
+
+	return nil
+}
+
+// write writes the data to the file in the area if the quota and the free
+// disk space allow for it. The data is written to a temporary file first so
+// when the file is overwritten, the space for all the data is reserved and
+// the space taken by the overwritten file is released only once the
+// temporary file replaces it.
+func (ds *diskPersistence) write(area, filePath string, data []byte) error {
+	size := int64(len(data))
+	existingSize := fileSize(filePath)
+
+	if err := ds.reserve(area, size); err != nil {
+		return err
+	}
+
+	if err := write(filePath, data); err != nil {
+		ds.usage.add(area, -size)
+		return err
+	}
+
+	ds.usage.add(area, -existingSize)
+
+	return nil
+}
+
+// writeStream writes the data produced by the provided function to the file
+// in the area. Since the size of the data is not known in advance, the space
+// is reserved as the data are produced and the write fails as soon as the
+// quota or the free disk space does not allow for more. The free disk space
+// is checked ahead for the next freeSpaceCheckInterval bytes so that it is
+// not checked for each chunk of the data. Just like for write, the space
+// taken by the overwritten file is released once the data is written.
+func (ds *diskPersistence) writeStream(
+	area string,
+	filePath string,
+	produce func(io.Writer) error,
+) error {
+	delta := int64(checksumHeaderLength)
+	existingSize := fileSize(filePath)
+
+	if err := ds.reserve(area, delta); err != nil {
+		return err
+	}
+
+	reserved := int64(0)
+	// the number of bytes the free disk space has been checked for
+	checked := int64(0)
+
+	err := writeStream(filePath, func(w io.Writer) error {
+		return produce(&reservingWriter{
+			writer: w,
+			reserve: func(size int64) error {
+				if reserved+size > checked {
+					checkSize := size
+					if checkSize < freeSpaceCheckInterval {
+						checkSize = freeSpaceCheckInterval
+					}
+
+					if err := ds.checkFreeSpace(checkSize); err != nil {
+						return err
+					}
+
+					checked = reserved + checkSize
+				}
+
+				if err := ds.reserveQuota(area, size); err != nil {
+					return err
+				}
+
+				reserved += size
+
+				return nil
+			},
+		})
+	})
+	if err != nil {
+		ds.usage.add(area, -delta-reserved)
+		return err
+	}
+
+	ds.usage.add(area, -existingSize)
+
+	return nil
+}
+
+// reservingWriter reserves the space for all the data before writing them
+// to the underlying writer.
+type reservingWriter struct {
+	writer  io.Writer
+	reserve func(size int64) error
+}
+
+func (rw *reservingWriter) Write(p []byte) (int, error) {
+	if err := rw.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return rw.writer.Write(p)
+}
+
+// ObserveDiskUsage publishes the usage of the data directory of the disk
+// handle as gauges registered in the metrics registry. There is a gauge for
+// the number of bytes used by each top-level area of the data directory,
+// for the number of bytes available on the disk and, if configured, for the
+// quota. Gauges are refreshed with the given tick until the context is done.
+// The handle may be the disk handle itself or a handle wrapping it, like the
+// encrypted persistence.
+func ObserveDiskUsage(
+	ctx context.Context,
+	handle Handle,
+	registry *metrics.Registry,
+	tick time.Duration,
+) error {
+	for {
+		wrapping, ok := handle.(wrappingHandle)
+		if !ok {
+			break
+		}
+		handle = wrapping.unwrap()
+	}
+
+	ds, ok := handle.(*diskPersistence)
+	if !ok {
+		return fmt.Errorf("handle is not an on-disk data persistence handle")
+	}
+
+	observers := make([]*metrics.Observer, 0)
+
+	for _, area := range usageAreas {
+		// capture shared loop variable for the closure
+		area := area
+
+		observer, err := registry.NewGaugeObserver(
+			fmt.Sprintf("persistence_%s_bytes", area),
+			func() float64 {
+				return float64(ds.usage.area(area))
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("could not create usage gauge: [%v]", err)
+		}
+
+		observers = append(observers, observer)
+	}
+
+	observer, err := registry.NewGaugeObserver(
+		"persistence_available_bytes",
+		func() float64 {
+			available, err := ds.availableSpaceFunc(ds.dataDir)
+			if err != nil {
+				logger.Warningf("could not check available disk space: [%v]", err)
+				return 0
+			}
+
+			return float64(available)
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not create available space gauge: [%v]", err)
+	}
+
+	observers = append(observers, observer)
+
+	if ds.config.Quota > 0 {
+		gauge, err := registry.NewGauge("persistence_quota_bytes")
+		if err != nil {
+			return fmt.Errorf("could not create quota gauge: [%v]", err)
+		}
+
+		gauge.Set(float64(ds.config.Quota))
+	}
+
+	for _, observer := range observers {
+		observer.Observe(ctx, tick)
+	}
+
+	return nil
+}
+
+// directorySize returns the number of bytes taken by all the files in the
+// directory and its subdirectories, ignoring temporary files.
+func directorySize(dirPath string) (int64, error) {
+	size := int64(0)
+
+	err := filepath.Walk(
+		dirPath,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.Mode().IsRegular() && !isTempFile(info.Name()) {
+				size += info.Size()
+			}
+
+			return nil
+		},
+	)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// fileSize returns the size of the file or zero if the file does not exist.
+func fileSize(filePath string) int64 {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
@@ -0,0 +1,460 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keep-network/keep-common/pkg/metrics"
+)
+
+func TestDiskPersistence_TrackUsage(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	handle, err := NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	err = handle.Save([]byte{1, 2, 3}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite with larger data
+	err = handle.Save([]byte{1, 2, 3, 4, 5}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Save([]byte{1, 2, 3, 4}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Save([]byte{1, 2}, dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Snapshot([]byte{1, 2, 3, 4, 5, 6}, dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.(*diskPersistence).saveStream(
+		dirName2,
+		fileName11,
+		func(w io.Writer) error {
+			_, err := w.Write(make([]byte, 100))
+			return err
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Delete(dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Archive(dirName2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertUsage := func(handle Handle) {
+		usage := handle.(*diskPersistence).usage
+
+		expectedUsage := map[string]int64{
+			currentDir:    checksumHeaderLength + 5,
+			archiveDir:    2*checksumHeaderLength + 2 + 100,
+			snapshotDir:   checksumHeaderLength + 6,
+			quarantineDir: 0,
+			journalDir:    0,
+		}
+
+		for area, expected := range expectedUsage {
+			if usage.area(area) != expected {
+				t.Errorf(
+					"unexpected usage of area [%v]\nexpected: [%v]\nactual:   [%v]",
+					area,
+					expected,
+					usage.area(area),
+				)
+			}
+		}
+	}
+
+	assertUsage(handle)
+
+	// usage is computed from scratch for a new handle
+	newHandle, err := NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newHandle.(io.Closer).Close()
+
+	assertUsage(newHandle)
+}
+
+func TestDiskPersistence_RefuseWriteExceedingQuota(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	handle, err := NewDiskHandleWithConfig(
+		dataDir,
+		&DiskConfig{Quota: 2*checksumHeaderLength + 10},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	err = handle.Save(make([]byte, 5), dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Snapshot(make([]byte, 6), dirName1, fileName11)
+	expectedError := fmt.Errorf(
+		"storage quota of [90] bytes exceeded; " +
+			"[45] bytes used and [46] bytes to write",
+	)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+
+	snapshots, err := handle.ListSnapshots(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Fatalf("refused snapshot has been written")
+	}
+
+	// overwriting with data of the same size fits in the quota
+	err = handle.Save(make([]byte, 5), dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// freed space can be used again
+	err = handle.Delete(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Snapshot(make([]byte, 6), dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskPersistence_ReserveFullSizeOnOverwrite(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	handle, err := NewDiskHandleWithConfig(
+		dataDir,
+		&DiskConfig{Quota: 2*checksumHeaderLength + 15},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	err = handle.Save(make([]byte, 10), dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the smaller data are written to a temporary file before they replace
+	// the existing file so the full size has to fit in the quota
+	err = handle.Save(make([]byte, 6), dirName1, fileName11)
+	expectedError := fmt.Errorf(
+		"storage quota of [95] bytes exceeded; " +
+			"[50] bytes used and [46] bytes to write",
+	)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+
+	err = handle.Save(make([]byte, 5), dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the space taken by the overwritten file is released
+	expectedUsage := int64(checksumHeaderLength + 5)
+	if usage := handle.(*diskPersistence).usage.total(); usage != expectedUsage {
+		t.Fatalf(
+			"unexpected usage\nexpected: [%v]\nactual:   [%v]",
+			expectedUsage,
+			usage,
+		)
+	}
+}
+
+func TestDiskPersistence_RefuseStreamExceedingQuota(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	handle, err := NewDiskHandleWithConfig(
+		dataDir,
+		&DiskConfig{Quota: checksumHeaderLength + 100},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	chunk := make([]byte, 30)
+
+	err = handle.(*diskPersistence).saveStream(
+		dirName1,
+		fileName11,
+		func(w io.Writer) error {
+			for i := 0; i < 4; i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+	if err == nil || !strings.Contains(err.Error(), "storage quota") {
+		t.Fatalf("expected quota error; has [%v]", err)
+	}
+
+	if !isNonExistingFile(
+		fmt.Sprintf("%s/%s/%s/%s", dataDir, currentDir, dirName1, fileName11),
+	) {
+		t.Fatalf("refused stream has been written")
+	}
+
+	if usage := handle.(*diskPersistence).usage.total(); usage != 0 {
+		t.Fatalf("expected no usage; has [%v]", usage)
+	}
+}
+
+func TestDiskPersistence_RefuseWriteUnderFreeSpaceThreshold(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	available, err := availableSpace(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := NewDiskHandleWithConfig(
+		dataDir,
+		&DiskConfig{MinFreeSpace: available},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	err = handle.Save(bytes.Repeat([]byte{1}, 1024*1024), dirName1, fileName11)
+	if err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("expected insufficient disk space error; has [%v]", err)
+	}
+
+	files, err := handle.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("refused data has been written")
+	}
+
+	handle.(*diskPersistence).config.MinFreeSpace = 0
+
+	err = handle.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting does not need free space
+	handle.(*diskPersistence).config.MinFreeSpace = available
+
+	err = handle.Delete(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskPersistence_CheckFreeSpaceOncePerInterval(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	checks := 0
+	handle.(*diskPersistence).availableSpaceFunc = func(
+		path string,
+	) (uint64, error) {
+		checks++
+		return availableSpace(path)
+	}
+
+	chunk := make([]byte, 4*1024)
+
+	err := handle.(*diskPersistence).saveStream(
+		dirName1,
+		fileName11,
+		func(w io.Writer) error {
+			// 3 MiB of data written in small chunks
+			for i := 0; i < 3*256; i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one check for the checksum header and one for each interval
+	expectedChecks := 4
+	if checks != expectedChecks {
+		t.Fatalf(
+			"unexpected number of free space checks\n"+
+				"expected: [%v]\nactual:   [%v]",
+			expectedChecks,
+			checks,
+		)
+	}
+}
+
+func TestDiskPersistence_TrackTransactionUsage(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	usage := handle.(*diskPersistence).usage
+
+	err := handle.Save([]byte{1, 2, 3}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx.Save([]byte{1, 2, 3, 4, 5}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx.Save([]byte{1, 2}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertAreaUsage := func(area string, expected int64) {
+		if usage.area(area) != expected {
+			t.Errorf(
+				"unexpected usage of area [%v]\nexpected: [%v]\nactual:   [%v]",
+				area,
+				expected,
+				usage.area(area),
+			)
+		}
+	}
+
+	// staged data is accounted in the journal until committed
+	assertAreaUsage(currentDir, checksumHeaderLength+3)
+	assertAreaUsage(journalDir, 2*checksumHeaderLength+7)
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertAreaUsage(currentDir, 2*checksumHeaderLength+7)
+	assertAreaUsage(journalDir, 0)
+}
+
+func TestObserveDiskUsage(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	handle, err := NewDiskHandleWithConfig(dataDir, &DiskConfig{Quota: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	registry := metrics.NewRegistry()
+
+	err = ObserveDiskUsage(ctx, handle, registry, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"persistence_current_bytes",
+		"persistence_archive_bytes",
+		"persistence_snapshot_bytes",
+		"persistence_quarantine_bytes",
+		"persistence_journal_bytes",
+		"persistence_available_bytes",
+		"persistence_quota_bytes",
+	} {
+		if _, err := registry.NewGauge(name); err == nil {
+			t.Errorf("gauge [%v] has not been registered", name)
+		}
+	}
+
+	err = ObserveDiskUsage(ctx, NewMemoryHandle(), registry, time.Minute)
+	if err == nil {
+		t.Fatal("expected error for non-disk handle")
+	}
+}
+
+func TestObserveDiskUsage_EncryptedHandle(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	registry := metrics.NewRegistry()
+
+	err := ObserveDiskUsage(
+		ctx,
+		NewEncryptedPersistence(handle, accountPassword),
+		registry,
+		time.Minute,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := registry.NewGauge("persistence_current_bytes"); err == nil {
+		t.Errorf("usage gauge has not been registered")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package persistence
+
+import "syscall"
+
+// availableSpace returns the number of bytes available to the process on the
+// disk holding the given path.
+func availableSpace(path string) (uint64, error) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(path, stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
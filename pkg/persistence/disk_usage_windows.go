@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package persistence
+
+import "golang.org/x/sys/windows"
+
+// availableSpace returns the number of bytes available to the process on the
+// disk holding the given path.
+func availableSpace(path string) (uint64, error) {
+	pathPointer, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(pathPointer, &available, &total, &totalFree)
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
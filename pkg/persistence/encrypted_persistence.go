@@ -1,7 +1,10 @@
 package persistence
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
 
 	"github.com/keep-network/keep-common/pkg/encryption"
 )
@@ -9,24 +12,89 @@ import (
 // KeyLength represents the byte size of the key.
 const KeyLength = encryption.KeyLength
 
+// streamingThreshold is the size of data above which the data is encrypted
+// as a stream if the delegate handle or transaction supports it, so that the
+// ciphertext is written in chunks and never held in memory as a whole.
+// Reading with Read decrypts the stream as it is read from the delegate, if
+// supported, so only the plaintext is held in memory. The content of data
+// descriptors returned by ReadAll, ReadArchived, ReadEntries and
+// ListSnapshots is always read as a whole before it is decrypted.
+const streamingThreshold = 1024 * 1024
+
+// streamingHandle is implemented by handles able to save data produced by
+// a function writing to a stream and to read data as a stream.
+type streamingHandle interface {
+	saveStream(directory, name string, produce func(io.Writer) error) error
+	snapshotStream(directory, name string, produce func(io.Writer) error) error
+	readStream(directory, name string, consume func(io.Reader) error) error
+}
+
+// streamingTransaction is implemented by transactions able to stage data
+// produced by a function writing to a stream.
+type streamingTransaction interface {
+	saveStream(directory, name string, produce func(io.Writer) error) error
+}
+
 type encryptedPersistence struct {
 	delegate Handle
-	box      encryption.Box
+	box      encryption.AEADBox
+}
+
+// wrappingHandle is implemented by handles adding functionality to other
+// handles so that the underlying handle can be reached, for example, to
+// observe its disk usage.
+type wrappingHandle interface {
+	unwrap() Handle
+}
+
+func (ep *encryptedPersistence) unwrap() Handle {
+	return ep.delegate
+}
+
+// Close closes the delegate handle if it implements io.Closer.
+func (ep *encryptedPersistence) Close() error {
+	if closer, ok := ep.delegate.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
 }
 
 // NewEncryptedPersistence creates an adapter for the disk persistence to store data
-// in an encrypted format
+// in an encrypted format. Each ciphertext is bound to the directory and name
+// it is stored under so that encrypted files can not be swapped unnoticed.
 func NewEncryptedPersistence(handle Handle, password string) Handle {
-	passwordBytes := []byte(password)
+	return &encryptedPersistence{
+		delegate: handle,
+		box:      encryption.NewPasswordBox(password),
+	}
+}
 
+// NewEnvelopeEncryptedPersistence creates an adapter for the disk persistence
+// to store data in an encrypted format, encrypting each piece of data with its
+// own random data key wrapped by the provided key provider. Unlike with
+// NewEncryptedPersistence, the master key does not have to be known to the
+// client; it is kept by the key provider.
+func NewEnvelopeEncryptedPersistence(
+	handle Handle,
+	provider encryption.KeyProvider,
+) Handle {
 	return &encryptedPersistence{
 		delegate: handle,
-		box:      encryption.NewBox(sha256.Sum256(passwordBytes)),
+		box:      encryption.NewEnvelopeBox(provider),
 	}
 }
 
 func (ep *encryptedPersistence) Save(data []byte, directory string, name string) error {
-	encrypted, err := ep.box.Encrypt(data)
+	if delegate, streamBox, ok := ep.streamingDelegate(data); ok {
+		return delegate.saveStream(
+			directory,
+			name,
+			encryptStream(streamBox, data, associatedData(directory, name)),
+		)
+	}
+
+	encrypted, err := ep.box.EncryptWithAD(data, associatedData(directory, name))
 	if err != nil {
 		return err
 	}
@@ -35,7 +103,15 @@ func (ep *encryptedPersistence) Save(data []byte, directory string, name string)
 }
 
 func (ep *encryptedPersistence) Snapshot(data []byte, directory string, name string) error {
-	encrypted, err := ep.box.Encrypt(data)
+	if delegate, streamBox, ok := ep.streamingDelegate(data); ok {
+		return delegate.snapshotStream(
+			directory,
+			name,
+			encryptStream(streamBox, data, associatedData(directory, name)),
+		)
+	}
+
+	encrypted, err := ep.box.EncryptWithAD(data, associatedData(directory, name))
 	if err != nil {
 		return err
 	}
@@ -43,18 +119,153 @@ func (ep *encryptedPersistence) Snapshot(data []byte, directory string, name str
 	return ep.delegate.Snapshot(encrypted, directory, name)
 }
 
-func (ep *encryptedPersistence) ReadAll() (<-chan DataDescriptor, <-chan error) {
+func (ep *encryptedPersistence) Begin() (Transaction, error) {
+	transaction, err := ep.delegate.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedTransaction{
+		delegate: transaction,
+		box:      ep.box,
+	}, nil
+}
+
+// encryptedTransaction encrypts all the data before they are staged in the
+// delegate transaction.
+type encryptedTransaction struct {
+	delegate Transaction
+	box      encryption.AEADBox
+}
+
+func (et *encryptedTransaction) Save(
+	data []byte,
+	directory string,
+	name string,
+) error {
+	if delegate, ok := et.delegate.(streamingTransaction); ok {
+		if streamBox, ok := streamingBox(et.box, data); ok {
+			return delegate.saveStream(
+				directory,
+				name,
+				encryptStream(streamBox, data, associatedData(directory, name)),
+			)
+		}
+	}
+
+	encrypted, err := et.box.EncryptWithAD(data, associatedData(directory, name))
+	if err != nil {
+		return err
+	}
+
+	return et.delegate.Save(encrypted, directory, name)
+}
+
+func (et *encryptedTransaction) Commit() error {
+	return et.delegate.Commit()
+}
+
+func (et *encryptedTransaction) Rollback() error {
+	return et.delegate.Rollback()
+}
+
+// streamingDelegate returns the delegate handle and the box to be used for
+// streaming encryption if the data is large enough to be streamed and both
+// the delegate and the box support streaming.
+func (ep *encryptedPersistence) streamingDelegate(
+	data []byte,
+) (streamingHandle, encryption.StreamBox, bool) {
+	delegate, ok := ep.delegate.(streamingHandle)
+	if !ok {
+		return nil, nil, false
+	}
+
+	streamBox, ok := streamingBox(ep.box, data)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return delegate, streamBox, true
+}
+
+// streamingBox returns the box to be used for streaming encryption if the
+// data is large enough to be streamed and the box supports streaming.
+func streamingBox(
+	box encryption.AEADBox,
+	data []byte,
+) (encryption.StreamBox, bool) {
+	if len(data) <= streamingThreshold {
+		return nil, false
+	}
+
+	streamBox, ok := box.(encryption.StreamBox)
+	return streamBox, ok
+}
+
+// encryptStream returns a function encrypting the data as a stream written
+// to the provided writer.
+func encryptStream(
+	streamBox encryption.StreamBox,
+	data []byte,
+	additionalData []byte,
+) func(io.Writer) error {
+	return func(w io.Writer) error {
+		writer, err := streamBox.NewEncryptingWriter(w, additionalData)
+		if err != nil {
+			return err
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+
+		return writer.Close()
+	}
+}
+
+func (ep *encryptedPersistence) ReadAll(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	inputData, inputErrors := ep.delegate.ReadAll(delegateReadOptions(options)...)
+	return ep.decryptAll(newReadOptions(options), inputData, inputErrors)
+}
+
+func (ep *encryptedPersistence) ReadArchived(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	inputData, inputErrors := ep.delegate.ReadArchived(delegateReadOptions(options)...)
+	return ep.decryptAll(newReadOptions(options), inputData, inputErrors)
+}
+
+// delegateReadOptions returns read options for the delegate handle. Content
+// is prefetched after decryption, so that decryption is done in parallel too,
+// and the delegate should not prefetch it on its own.
+func delegateReadOptions(options []ReadOption) []ReadOption {
+	delegateOptions := make([]ReadOption, 0, len(options)+1)
+	delegateOptions = append(delegateOptions, options...)
+	return append(delegateOptions, WithWorkers(0))
+}
+
+// decryptAll pipes the provided input channels to the output channels
+// decorating data descriptors so that their content is decrypted on read.
+func (ep *encryptedPersistence) decryptAll(
+	options *readOptions,
+	inputData <-chan DataDescriptor,
+	inputErrors <-chan error,
+) (<-chan DataDescriptor, <-chan error) {
 	outputData := make(chan DataDescriptor)
 	outputErrors := make(chan error)
 
-	inputData, inputErrors := ep.delegate.ReadAll()
-
 	// pass thru all errors from the input to the output channel without
 	// changing anything
 	go func() {
 		defer close(outputErrors)
 		for err := range inputErrors {
-			outputErrors <- err
+			select {
+			case outputErrors <- err:
+			case <-options.ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -66,7 +277,7 @@ func (ep *encryptedPersistence) ReadAll() (<-chan DataDescriptor, <-chan error)
 			// capture shared loop variable's value for the closure
 			d := descriptor
 
-			outputData <- &dataDescriptor{
+			decrypted := &dataDescriptor{
 				name:      d.Name(),
 				directory: d.Directory(),
 				readFunc: func() ([]byte, error) {
@@ -74,15 +285,248 @@ func (ep *encryptedPersistence) ReadAll() (<-chan DataDescriptor, <-chan error)
 					if err != nil {
 						return nil, err
 					}
-					return ep.box.Decrypt(content)
+					return ep.box.DecryptWithAD(
+						content,
+						associatedData(d.Directory(), d.Name()),
+					)
 				},
 			}
+
+			select {
+			case outputData <- decrypted:
+			case <-options.ctx.Done():
+				return
+			}
 		}
 	}()
 
-	return outputData, outputErrors
+	return prefetch(options, outputData), outputErrors
 }
 
 func (ep *encryptedPersistence) Archive(directory string) error {
 	return ep.delegate.Archive(directory)
 }
+
+func (ep *encryptedPersistence) Unarchive(directory string) error {
+	return ep.delegate.Unarchive(directory)
+}
+
+func (ep *encryptedPersistence) Read(directory string, name string) ([]byte, error) {
+	if delegate, ok := ep.delegate.(streamingHandle); ok {
+		if streamBox, ok := ep.box.(encryption.StreamBox); ok {
+			return ep.readStream(delegate, streamBox, directory, name)
+		}
+	}
+
+	content, err := ep.delegate.Read(directory, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ep.box.DecryptWithAD(content, associatedData(directory, name))
+}
+
+// readStream reads the data from the delegate handle as a stream decrypting
+// it as it is read.
+func (ep *encryptedPersistence) readStream(
+	delegate streamingHandle,
+	streamBox encryption.StreamBox,
+	directory string,
+	name string,
+) ([]byte, error) {
+	var data []byte
+
+	err := delegate.readStream(directory, name, func(r io.Reader) error {
+		var err error
+		data, err = ep.decryptStream(
+			streamBox,
+			r,
+			associatedData(directory, name),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// decryptStream decrypts the ciphertext read from the provided reader. Only
+// data saved above the streaming threshold are encrypted as a stream so if
+// the ciphertext is not a stream, it is read as a whole and decrypted with
+// the box, starting over from the envelope header consumed by the attempt to
+// decrypt it as a stream.
+func (ep *encryptedPersistence) decryptStream(
+	streamBox encryption.StreamBox,
+	r io.Reader,
+	additionalData []byte,
+) ([]byte, error) {
+	header := &recordingReader{reader: r, recorded: &bytes.Buffer{}}
+
+	decrypting, err := streamBox.NewDecryptingReader(header, additionalData)
+	if err != nil {
+		content, err := ioutil.ReadAll(
+			io.MultiReader(bytes.NewReader(header.recorded.Bytes()), r),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return ep.box.DecryptWithAD(content, additionalData)
+	}
+
+	// only the envelope header has to be recorded
+	header.recorded = nil
+
+	return ioutil.ReadAll(decrypting)
+}
+
+// recordingReader records all the bytes read from the underlying reader
+// until the record buffer is cleared.
+type recordingReader struct {
+	reader   io.Reader
+	recorded *bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.reader.Read(p)
+	if rr.recorded != nil {
+		rr.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+func (ep *encryptedPersistence) Delete(directory string, name string) error {
+	return ep.delegate.Delete(directory, name)
+}
+
+func (ep *encryptedPersistence) List(directory string) ([]string, error) {
+	return ep.delegate.List(directory)
+}
+
+func (ep *encryptedPersistence) ListSnapshots(
+	directory string,
+	name string,
+) ([]SnapshotDescriptor, error) {
+	snapshots, err := ep.delegate.ListSnapshots(directory, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// decorate the descriptors so that the content is decrypted on read
+	decrypted := make([]SnapshotDescriptor, len(snapshots))
+	for i, snapshot := range snapshots {
+		// capture shared loop variable's value for the closure
+		s := snapshot
+
+		decrypted[i] = &snapshotDescriptor{
+			dataDescriptor: dataDescriptor{
+				name:      s.Name(),
+				directory: s.Directory(),
+				readFunc: func() ([]byte, error) {
+					content, err := s.Content()
+					if err != nil {
+						return nil, err
+					}
+					return ep.box.DecryptWithAD(
+						content,
+						associatedData(s.Directory(), s.Name()),
+					)
+				},
+			},
+			timestamp: s.Timestamp(),
+		}
+	}
+
+	return decrypted, nil
+}
+
+func (ep *encryptedPersistence) RestoreSnapshot(
+	directory string,
+	name string,
+	timestamp time.Time,
+) error {
+	return ep.delegate.RestoreSnapshot(directory, name, timestamp)
+}
+
+func (ep *encryptedPersistence) PruneSnapshots(
+	policy *SnapshotRetentionPolicy,
+) error {
+	return ep.delegate.PruneSnapshots(policy)
+}
+
+func (ep *encryptedPersistence) Verify() <-chan error {
+	return ep.delegate.Verify()
+}
+
+func (ep *encryptedPersistence) ReadEntries() (<-chan EntryDescriptor, <-chan error) {
+	outputEntries := make(chan EntryDescriptor)
+	outputErrors := make(chan error)
+
+	inputEntries, inputErrors := ep.delegate.ReadEntries()
+
+	// pass thru all errors from the input to the output channel without
+	// changing anything
+	go func() {
+		defer close(outputErrors)
+		for err := range inputErrors {
+			outputErrors <- err
+		}
+	}()
+
+	// pipe input entry descriptor channel to the output entry descriptor
+	// channel decorating the descriptor passed so that the content is
+	// decrypted on read
+	go func() {
+		defer close(outputEntries)
+		for entry := range inputEntries {
+			// capture shared loop variable's value for the closure
+			e := entry
+
+			outputEntries <- &entryDescriptor{
+				dataDescriptor: dataDescriptor{
+					name:      e.Name(),
+					directory: e.Directory(),
+					readFunc: func() ([]byte, error) {
+						content, err := e.Content()
+						if err != nil {
+							return nil, err
+						}
+						return ep.box.DecryptWithAD(
+							content,
+							associatedData(e.Directory(), e.Name()),
+						)
+					},
+				},
+				key: e.Key(),
+			}
+		}
+	}()
+
+	return outputEntries, outputErrors
+}
+
+func (ep *encryptedPersistence) WriteEntry(key string, data []byte) error {
+	area, directory, storedName, err := parseEntryKey(key)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := ep.box.EncryptWithAD(
+		data,
+		associatedData(directory, entryName(area, storedName)),
+	)
+	if err != nil {
+		return err
+	}
+
+	return ep.delegate.WriteEntry(key, encrypted)
+}
+
+// associatedData is authenticated along with the ciphertext to bind it to
+// the directory and name it is stored under. For snapshots, it is the name
+// of the snapshotted data.
+func associatedData(directory string, name string) []byte {
+	return []byte(directory + "/" + name)
+}
@@ -3,9 +3,14 @@ package persistence
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
+	"time"
 
+	"crypto/rand"
 	"crypto/sha256"
 
 	"github.com/keep-network/keep-common/pkg/encryption"
@@ -85,6 +90,23 @@ func TestSaveReadAndDecryptData(t *testing.T) {
 	}
 }
 
+func TestReadAndDecryptData(t *testing.T) {
+	encryptedPersistence := NewEncryptedPersistence(delegateMock, accountPassword)
+
+	decrypted, err := encryptedPersistence.Read("dir", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dataToEncrypt1, decrypted) {
+		t.Errorf(
+			"unexpected decrypted data\nexpected: [%v]\nactual:   [%v]\n",
+			dataToEncrypt1,
+			decrypted,
+		)
+	}
+}
+
 type delegatePersistenceMock struct{}
 
 func (dpm *delegatePersistenceMock) Save(data []byte, directory string, name string) error {
@@ -97,7 +119,16 @@ func (dpm *delegatePersistenceMock) Snapshot(data []byte, directory string, name
 	return nil
 }
 
-func (dpm *delegatePersistenceMock) ReadAll() (<-chan DataDescriptor, <-chan error) {
+func (dpm *delegatePersistenceMock) Begin() (Transaction, error) {
+	return newBufferedTransaction(func(staged []*stagedData) error {
+		// noop
+		return nil
+	}), nil
+}
+
+func (dpm *delegatePersistenceMock) ReadAll(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
 	encrypted := encryptData()
 
 	outputData := make(chan DataDescriptor, 2)
@@ -117,6 +148,74 @@ func (dpm *delegatePersistenceMock) Archive(directory string) error {
 	return nil
 }
 
+func (dpm *delegatePersistenceMock) Unarchive(directory string) error {
+	// noop
+	return nil
+}
+
+func (dpm *delegatePersistenceMock) ReadArchived(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	return dpm.ReadAll()
+}
+
+func (dpm *delegatePersistenceMock) ListSnapshots(
+	directory string,
+	name string,
+) ([]SnapshotDescriptor, error) {
+	return []SnapshotDescriptor{}, nil
+}
+
+func (dpm *delegatePersistenceMock) RestoreSnapshot(
+	directory string,
+	name string,
+	timestamp time.Time,
+) error {
+	// noop
+	return nil
+}
+
+func (dpm *delegatePersistenceMock) PruneSnapshots(
+	policy *SnapshotRetentionPolicy,
+) error {
+	// noop
+	return nil
+}
+
+func (dpm *delegatePersistenceMock) Verify() <-chan error {
+	errorChannel := make(chan error)
+	close(errorChannel)
+	return errorChannel
+}
+
+func (dpm *delegatePersistenceMock) ReadEntries() (<-chan EntryDescriptor, <-chan error) {
+	outputEntries := make(chan EntryDescriptor)
+	outputErrors := make(chan error)
+
+	close(outputEntries)
+	close(outputErrors)
+
+	return outputEntries, outputErrors
+}
+
+func (dpm *delegatePersistenceMock) WriteEntry(key string, data []byte) error {
+	// noop
+	return nil
+}
+
+func (dpm *delegatePersistenceMock) Read(directory string, name string) ([]byte, error) {
+	return encryptData()[0], nil
+}
+
+func (dpm *delegatePersistenceMock) Delete(directory string, name string) error {
+	// noop
+	return nil
+}
+
+func (dpm *delegatePersistenceMock) List(directory string) ([]string, error) {
+	return []string{"1", "2"}, nil
+}
+
 type testDataDescriptor struct {
 	name      string
 	directory string
@@ -147,3 +246,296 @@ func encryptData() [][]byte {
 
 	return [][]byte{encryptedData1, encryptedData2}
 }
+
+func TestRefuseSwappedEncryptedData(t *testing.T) {
+	delegate := NewMemoryHandle()
+	encryptedPersistence := NewEncryptedPersistence(delegate, accountPassword)
+
+	err := encryptedPersistence.Save(dataToEncrypt1, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := delegate.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = map[string]struct {
+		directory string
+		name      string
+	}{
+		"other directory": {
+			directory: "dir2",
+			name:      "name1",
+		},
+		"other name": {
+			directory: "dir1",
+			name:      "name2",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := delegate.Save(encrypted, test.directory, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = encryptedPersistence.Read(test.directory, test.name)
+			if err == nil {
+				t.Fatal("expected decryption of swapped data to fail")
+			}
+		})
+	}
+
+	decrypted, err := encryptedPersistence.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dataToEncrypt1, decrypted) {
+		t.Fatalf(
+			"unexpected decrypted data\nexpected: [%v]\nactual:   [%v]",
+			dataToEncrypt1,
+			decrypted,
+		)
+	}
+}
+
+func TestSaveAndSnapshotLargeData(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "encrypted-persistence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	delegate, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delegate.(io.Closer).Close()
+
+	encryptedPersistence := NewEncryptedPersistence(delegate, accountPassword)
+
+	largeData := make([]byte, 3*streamingThreshold+7)
+	if _, err := rand.Read(largeData); err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptedPersistence.Save(largeData, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptedPersistence.Snapshot(largeData, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for err := range delegate.Verify() {
+		t.Fatalf("unexpected verification error: [%v]", err)
+	}
+
+	decrypted, err := encryptedPersistence.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(largeData, decrypted) {
+		t.Fatal("unexpected decrypted data")
+	}
+
+	snapshots, err := encryptedPersistence.ListSnapshots("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected [1] snapshot; has [%v]", len(snapshots))
+	}
+
+	decrypted, err = snapshots[0].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(largeData, decrypted) {
+		t.Fatal("unexpected decrypted snapshot")
+	}
+
+	// streamed ciphertext is bound to its location as well
+	encrypted, err := delegate.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegate.Save(encrypted, "dir2", "name1")
+
+	_, err = encryptedPersistence.Read("dir2", "name1")
+	if err == nil {
+		t.Fatal("expected decryption of swapped data to fail")
+	}
+}
+
+func TestEnvelopeEncryptedPersistence(t *testing.T) {
+	hsm := encryption.NewSoftwareHSM()
+	hsm.GenerateKey("master")
+
+	provider, err := encryption.NewHSMKeyProvider(hsm, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delegate := NewMemoryHandle()
+	encryptedPersistence := NewEnvelopeEncryptedPersistence(delegate, provider)
+
+	err = encryptedPersistence.Save(dataToEncrypt1, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := delegate.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, dataToEncrypt1) {
+		t.Fatal("data stored in plain text")
+	}
+
+	decrypted, err := encryptedPersistence.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dataToEncrypt1, decrypted) {
+		t.Fatalf(
+			"unexpected decrypted data\nexpected: [%v]\nactual:   [%v]",
+			dataToEncrypt1,
+			decrypted,
+		)
+	}
+}
+
+func TestSaveLargeDataInTransaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "encrypted-persistence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	delegate, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delegate.(io.Closer).Close()
+
+	encryptedPersistence := NewEncryptedPersistence(delegate, accountPassword)
+
+	largeData := make([]byte, 2*streamingThreshold+3)
+	if _, err := rand.Read(largeData); err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := encryptedPersistence.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save(largeData, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the staged data has been encrypted as a stream
+	encrypted, err := delegate.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamBox := encryption.NewPasswordBox(accountPassword).(encryption.StreamBox)
+	_, err = streamBox.NewDecryptingReader(
+		bytes.NewReader(encrypted),
+		associatedData("dir1", "name1"),
+	)
+	if err != nil {
+		t.Fatalf("data has not been encrypted as a stream: [%v]", err)
+	}
+
+	decrypted, err := encryptedPersistence.Read("dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(largeData, decrypted) {
+		t.Fatal("unexpected decrypted data")
+	}
+}
+
+func TestReadStreamDetectsCorruptedData(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "encrypted-persistence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	delegate, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delegate.(io.Closer).Close()
+
+	encryptedPersistence := NewEncryptedPersistence(delegate, accountPassword)
+
+	largeData := make([]byte, streamingThreshold+1)
+	if _, err := rand.Read(largeData); err != nil {
+		t.Fatal(err)
+	}
+
+	smallData := []byte{1, 2, 3}
+
+	err = encryptedPersistence.Save(largeData, "dir1", "name1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptedPersistence.Save(smallData, "dir1", "name2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// data not encrypted as a stream is read from the stream as well
+	decrypted, err := encryptedPersistence.Read("dir1", "name2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(smallData, decrypted) {
+		t.Fatal("unexpected decrypted data")
+	}
+
+	filePath := fmt.Sprintf("%s/%s/dir1/name1", tempDir, currentDir)
+
+	stored, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored[len(stored)-1] ^= 0x01
+
+	err = ioutil.WriteFile(filePath, stored, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedError := fmt.Errorf(
+		"could not read [name1] from directory [dir1]: " +
+			"[data corrupted; checksum mismatch]",
+	)
+
+	_, err = encryptedPersistence.Read("dir1", "name1")
+	if err == nil || err.Error() != expectedError.Error() {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+}
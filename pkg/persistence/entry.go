@@ -0,0 +1,118 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EntryDescriptor is an interface representing a single entry saved in any
+// of the storage areas of the persistence layer represented by Handle:
+// non-archived data, archived data or snapshots.
+type EntryDescriptor interface {
+	DataDescriptor
+
+	// Key uniquely identifies the entry in the persistence layer. It consists
+	// of the storage area, the directory and the name under which the entry
+	// is kept in the storage, e.g. snapshot/0x424242/state.1583837153000.
+	Key() string
+}
+
+// entryDescriptor is the simplest possible implementation of EntryDescriptor
+// interface that can be used by a storage when reading entries.
+type entryDescriptor struct {
+	dataDescriptor
+	key string
+}
+
+func (ed *entryDescriptor) Key() string {
+	return ed.key
+}
+
+func newEntryDescriptor(
+	area string,
+	directory string,
+	storedName string,
+	readFunc func() ([]byte, error),
+) *entryDescriptor {
+	return &entryDescriptor{
+		dataDescriptor: dataDescriptor{
+			name:      entryName(area, storedName),
+			directory: directory,
+			readFunc:  readFunc,
+		},
+		key: entryKey(area, directory, storedName),
+	}
+}
+
+// entryName returns the name of the data kept in the storage area under the
+// given name. For snapshots, it is the name of the snapshotted data.
+func entryName(area string, storedName string) string {
+	if area == snapshotDir {
+		if snapshottedName, _, ok := parseSnapshotFileName(storedName); ok {
+			return snapshottedName
+		}
+	}
+
+	return storedName
+}
+
+func entryKey(area, directory, storedName string) string {
+	return fmt.Sprintf("%s/%s/%s", area, directory, storedName)
+}
+
+// parseEntryKey splits the entry key into the storage area, the directory
+// and the name under which the entry is kept in the storage.
+func parseEntryKey(key string) (string, string, string, error) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || strings.Contains(parts[2], "/") {
+		return "", "", "", fmt.Errorf("malformed entry key [%v]", key)
+	}
+
+	area, directory, storedName := parts[0], parts[1], parts[2]
+
+	if area != currentDir && area != archiveDir && area != snapshotDir {
+		return "", "", "", fmt.Errorf("unknown storage area in key [%v]", key)
+	}
+
+	// keys may come from an untrusted source, like an imported archive, so
+	// they are validated the same way as names passed to the handle
+	if err := validateDirectoryName(directory); err != nil {
+		return "", "", "", fmt.Errorf("invalid entry key [%v]: [%v]", key, err)
+	}
+
+	if err := validateFileName(storedName); err != nil {
+		return "", "", "", fmt.Errorf("invalid entry key [%v]: [%v]", key, err)
+	}
+
+	return area, directory, storedName, nil
+}
+
+// collectEntries reads descriptors of all entries kept by the handle. Any
+// error occurred during reading is returned.
+func collectEntries(handle Handle) ([]EntryDescriptor, error) {
+	entryChannel, errorChannel := handle.ReadEntries()
+
+	entries := make([]EntryDescriptor, 0)
+	errors := make([]error, 0)
+
+	// both channels are unbuffered so they have to be read concurrently
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errorChannel {
+			errors = append(errors, err)
+		}
+	}()
+
+	for entry := range entryChannel {
+		entries = append(entries, entry)
+	}
+
+	<-done
+
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("could not read entries: %v", errors)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,314 @@
+package persistence
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/keep-network/keep-common/pkg/encryption"
+)
+
+const (
+	// manifestVersion is the version of the export archive format.
+	manifestVersion = 1
+
+	manifestFileName = "manifest.json"
+	entriesDirName   = "entries"
+
+	// maxManifestSize limits the size of the manifest read during import.
+	maxManifestSize = 64 * 1024 * 1024
+)
+
+// Manifest describes the content of an archive exported from the
+// persistence layer. It is the first file in the archive.
+type Manifest struct {
+	// Version of the archive format.
+	Version int `json:"version"`
+	// CreatedAt is the time the archive has been exported.
+	CreatedAt time.Time `json:"createdAt"`
+	// Entries lists all the entries in the archive.
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes a single entry of an archive exported from the
+// persistence layer.
+type ManifestEntry struct {
+	// Key uniquely identifies the entry in the persistence layer.
+	Key string `json:"key"`
+	// Area is the storage area of the entry: current, archive or snapshot.
+	Area string `json:"area"`
+	// Directory is the directory of the entry.
+	Directory string `json:"directory"`
+	// Name is the name of the entry; for snapshots, it is the name of the
+	// snapshotted data.
+	Name string `json:"name"`
+	// Size is the size of the entry content in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex-encoded SHA-256 of the entry content.
+	SHA256 string `json:"sha256"`
+	// EncryptionFormat is the version of the encryption envelope format the
+	// entry content is written in. Zero means the content is not written in
+	// the envelope format: it is either not encrypted or encrypted before the
+	// envelope format has been introduced.
+	EncryptionFormat int `json:"encryptionFormat"`
+}
+
+// Export writes all the entries kept by the handle, that is non-archived
+// data, archived data and snapshots, to the writer as a tar archive. The
+// first file in the archive is the manifest describing all the entries
+// followed by the content of each entry. The content is exported as it is
+// returned by the handle, so to keep the data encrypted in the archive, the
+// handle the encrypted persistence delegates to should be exported instead
+// of the encrypted persistence itself. The handle should not be modified
+// during the export.
+func Export(handle Handle, writer io.Writer) error {
+	entries, err := collectEntries(handle)
+	if err != nil {
+		return err
+	}
+
+	manifest := &Manifest{
+		Version:   manifestVersion,
+		CreatedAt: time.Now(),
+		Entries:   make([]*ManifestEntry, 0, len(entries)),
+	}
+
+	// The manifest goes first so all the entries are read twice to not hold
+	// the content of all of them in memory at once.
+	for _, entry := range entries {
+		content, err := entry.Content()
+		if err != nil {
+			return fmt.Errorf("could not read entry [%v]: [%v]", entry.Key(), err)
+		}
+
+		area, _, _, err := parseEntryKey(entry.Key())
+		if err != nil {
+			return err
+		}
+
+		manifest.Entries = append(manifest.Entries, &ManifestEntry{
+			Key:              entry.Key(),
+			Area:             area,
+			Directory:        entry.Directory(),
+			Name:             entry.Name(),
+			Size:             int64(len(content)),
+			SHA256:           contentChecksum(content),
+			EncryptionFormat: encryption.FormatVersion(content),
+		})
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not serialize the manifest: [%v]", err)
+	}
+
+	tarWriter := tar.NewWriter(writer)
+
+	err = writeTarFile(tarWriter, manifestFileName, manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		content, err := entry.Content()
+		if err != nil {
+			return fmt.Errorf("could not read entry [%v]: [%v]", entry.Key(), err)
+		}
+
+		if contentChecksum(content) != manifest.Entries[i].SHA256 {
+			return fmt.Errorf(
+				"entry [%v] has been modified during the export",
+				entry.Key(),
+			)
+		}
+
+		err = writeTarFile(tarWriter, entryArchivePath(entry.Key()), content)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("could not finalize the archive: [%v]", err)
+	}
+
+	logger.Infof("exported [%v] entries", len(entries))
+
+	return nil
+}
+
+// Import reads the tar archive produced by Export and restores all the
+// entries from it into the handle. The handle must not contain any data.
+//
+// The manifest is validated first and then the size and the checksum of each
+// entry is validated before the entry is written to the handle. If the
+// archive turns out to be invalid, the import fails and the handle may
+// contain a part of the entries so it should be discarded.
+func Import(reader io.Reader, handle Handle) error {
+	existing, err := collectEntries(handle)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf(
+			"could not import into non-empty store; has [%v] entries",
+			len(existing),
+		)
+	}
+
+	tarReader := tar.NewReader(reader)
+
+	manifest, err := readManifest(tarReader)
+	if err != nil {
+		return err
+	}
+
+	manifestEntries := make(map[string]*ManifestEntry)
+	for _, entry := range manifest.Entries {
+		if _, _, _, err := parseEntryKey(entry.Key); err != nil {
+			return fmt.Errorf("invalid manifest: [%v]", err)
+		}
+
+		if _, exists := manifestEntries[entry.Key]; exists {
+			return fmt.Errorf("invalid manifest: duplicated entry [%v]", entry.Key)
+		}
+
+		manifestEntries[entry.Key] = entry
+	}
+
+	imported := make(map[string]bool)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read the archive: [%v]", err)
+		}
+
+		if !strings.HasPrefix(header.Name, entriesDirName+"/") {
+			return fmt.Errorf("unexpected file [%v] in the archive", header.Name)
+		}
+
+		key := strings.TrimPrefix(header.Name, entriesDirName+"/")
+		entry, ok := manifestEntries[key]
+		if !ok {
+			return fmt.Errorf("file [%v] is not listed in the manifest", header.Name)
+		}
+
+		if imported[key] {
+			return fmt.Errorf("duplicated file [%v] in the archive", header.Name)
+		}
+
+		if header.Size != entry.Size {
+			return fmt.Errorf(
+				"unexpected size of entry [%v]; manifest: [%v], archive: [%v]",
+				key,
+				entry.Size,
+				header.Size,
+			)
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(tarReader, entry.Size))
+		if err != nil {
+			return fmt.Errorf("could not read entry [%v]: [%v]", key, err)
+		}
+
+		if contentChecksum(content) != entry.SHA256 {
+			return fmt.Errorf("checksum mismatch for entry [%v]", key)
+		}
+
+		if err := handle.WriteEntry(key, content); err != nil {
+			return fmt.Errorf("could not write entry [%v]: [%v]", key, err)
+		}
+
+		imported[key] = true
+	}
+
+	if len(imported) != len(manifestEntries) {
+		return fmt.Errorf(
+			"archive is incomplete; imported [%v] out of [%v] entries",
+			len(imported),
+			len(manifestEntries),
+		)
+	}
+
+	logger.Infof("imported [%v] entries", len(imported))
+
+	return nil
+}
+
+func readManifest(tarReader *tar.Reader) (*Manifest, error) {
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the archive: [%v]", err)
+	}
+
+	if header.Name != manifestFileName {
+		return nil, fmt.Errorf(
+			"the first file in the archive must be [%v]; has [%v]",
+			manifestFileName,
+			header.Name,
+		)
+	}
+
+	if header.Size > maxManifestSize {
+		return nil, fmt.Errorf("manifest is too large")
+	}
+
+	manifestBytes, err := ioutil.ReadAll(tarReader)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the manifest: [%v]", err)
+	}
+
+	manifest := &Manifest{}
+	decoder := json.NewDecoder(bytes.NewReader(manifestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest: [%v]", err)
+	}
+
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf(
+			"unsupported manifest version [%v]",
+			manifest.Version,
+		)
+	}
+
+	return manifest, nil
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, content []byte) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not write [%v] to the archive: [%v]", name, err)
+	}
+
+	if _, err := tarWriter.Write(content); err != nil {
+		return fmt.Errorf("could not write [%v] to the archive: [%v]", name, err)
+	}
+
+	return nil
+}
+
+func entryArchivePath(key string) string {
+	return entriesDirName + "/" + key
+}
+
+func contentChecksum(content []byte) string {
+	checksum := sha256.Sum256(content)
+	return hex.EncodeToString(checksum[:])
+}
@@ -0,0 +1,261 @@
+package persistence
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	source := NewMemoryHandle()
+	populateEncryptedStore(t, source, accountPassword)
+
+	var archive bytes.Buffer
+	if err := Export(source, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(tar.NewReader(bytes.NewReader(archive.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 4 {
+		t.Fatalf("expected [4] manifest entries; has [%v]", len(manifest.Entries))
+	}
+	for _, entry := range manifest.Entries {
+		if entry.EncryptionFormat != 1 {
+			t.Errorf(
+				"unexpected encryption format of entry [%v]: [%v]",
+				entry.Key,
+				entry.EncryptionFormat,
+			)
+		}
+	}
+
+	// import into other backend
+	target, cleanupBolt := newTestBoltHandle(t)
+	defer cleanupBolt()
+
+	if err := Import(bytes.NewReader(archive.Bytes()), target); err != nil {
+		t.Fatal(err)
+	}
+
+	sourceEntries := readEntryContents(t, source)
+	targetEntries := readEntryContents(t, target)
+	if !reflect.DeepEqual(sourceEntries, targetEntries) {
+		t.Fatalf(
+			"unexpected imported entries\nexpected: [%v]\nactual:   [%v]",
+			sourceEntries,
+			targetEntries,
+		)
+	}
+
+	assertEncryptedStore(t, target, accountPassword)
+}
+
+func TestImport_Refuse(t *testing.T) {
+	source := NewMemoryHandle()
+	source.Save([]byte{1}, dirName1, fileName11)
+	source.Save([]byte{2}, dirName1, fileName12)
+
+	var archive bytes.Buffer
+	if err := Export(source, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(tar.NewReader(bytes.NewReader(archive.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstKey := manifest.Entries[0].Key
+
+	var tests = map[string]struct {
+		archive       func() []byte
+		target        func() Handle
+		expectedError error
+	}{
+		"non-empty target": {
+			archive: func() []byte { return archive.Bytes() },
+			target: func() Handle {
+				handle := NewMemoryHandle()
+				handle.Save([]byte{3}, dirName2, fileName21)
+				return handle
+			},
+			expectedError: fmt.Errorf(
+				"could not import into non-empty store; has [1] entries",
+			),
+		},
+		"manifest not first": {
+			archive: func() []byte {
+				return buildTestArchive(t, nil, map[string][]byte{
+					entryArchivePath(firstKey): {1},
+				})
+			},
+			expectedError: fmt.Errorf(
+				"the first file in the archive must be [manifest.json]; has [%v]",
+				entryArchivePath(firstKey),
+			),
+		},
+		"checksum mismatch": {
+			archive: func() []byte {
+				return buildTestArchive(t, manifest, map[string][]byte{
+					entryArchivePath(firstKey): {7},
+				})
+			},
+			expectedError: fmt.Errorf("checksum mismatch for entry [%v]", firstKey),
+		},
+		"missing entry": {
+			archive: func() []byte {
+				return buildTestArchive(t, manifest, map[string][]byte{
+					entryArchivePath(firstKey): {1},
+				})
+			},
+			expectedError: fmt.Errorf(
+				"archive is incomplete; imported [1] out of [2] entries",
+			),
+		},
+		"unlisted entry": {
+			archive: func() []byte {
+				return buildTestArchive(t, manifest, map[string][]byte{
+					entryArchivePath("current/0x424242/other"): {1},
+				})
+			},
+			expectedError: fmt.Errorf(
+				"file [entries/current/0x424242/other] is not listed in the manifest",
+			),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			target := NewMemoryHandle()
+			if test.target != nil {
+				target = test.target()
+			}
+
+			err := Import(bytes.NewReader(test.archive()), target)
+			if !reflect.DeepEqual(test.expectedError, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					test.expectedError,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestImport_MaliciousArchive(t *testing.T) {
+	maliciousKeys := []string{
+		"current/../escaped",
+		"archive/../.lock",
+		"current/./escaped",
+		"current//escaped",
+		"current/0x424242/..",
+		"current/0x424242/.",
+		"current/0x424242/",
+		`current/..\escaped/file`,
+	}
+
+	for _, key := range maliciousKeys {
+		t.Run(key, func(t *testing.T) {
+			handle, cleanup := newTestDiskHandle(t)
+			defer cleanup()
+
+			dataDir := handle.(*diskPersistence).dataDir
+			lockFilePath := fmt.Sprintf("%s/%s", dataDir, lockFileName)
+
+			lockContent, err := ioutil.ReadFile(lockFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content := []byte{1}
+			manifest := &Manifest{
+				Version: manifestVersion,
+				Entries: []*ManifestEntry{{
+					Key:    key,
+					Size:   int64(len(content)),
+					SHA256: contentChecksum(content),
+				}},
+			}
+
+			archive := buildTestArchive(t, manifest, map[string][]byte{
+				entryArchivePath(key): content,
+			})
+
+			err = Import(bytes.NewReader(archive), handle)
+			if err == nil {
+				t.Fatal("expected malicious archive to be refused")
+			}
+
+			err = handle.WriteEntry(key, content)
+			if err == nil {
+				t.Fatal("expected malicious entry key to be refused")
+			}
+
+			if _, err := os.Stat(
+				fmt.Sprintf("%s/%s", dataDir, "escaped"),
+			); !os.IsNotExist(err) {
+				t.Fatal("file written outside of the storage area")
+			}
+
+			currentLockContent, err := ioutil.ReadFile(lockFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(lockContent, currentLockContent) {
+				t.Fatal("lock file has been overwritten")
+			}
+		})
+	}
+}
+
+func buildTestArchive(
+	t *testing.T,
+	manifest *Manifest,
+	files map[string][]byte,
+) []byte {
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+
+	if manifest != nil {
+		manifestBytes, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTarFile(tarWriter, manifestFileName, manifestBytes)
+	}
+
+	for name, content := range files {
+		writeTarFile(tarWriter, name, content)
+	}
+
+	tarWriter.Close()
+
+	return archive.Bytes()
+}
+
+func readEntryContents(t *testing.T, handle Handle) map[string][]byte {
+	entries, err := collectEntries(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[string][]byte)
+	for _, entry := range entries {
+		content, err := entry.Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[entry.Key()] = content
+	}
+
+	return contents
+}
@@ -0,0 +1,253 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lockFileName is the name of the lock file in the data directory. The file
+// is exclusively locked by the process using the data directory and contains
+// the PID of that process.
+const lockFileName = ".lock"
+
+// errLockHeld is returned by the platform-specific tryLockFile if the lock is
+// held by another process.
+var errLockHeld = errors.New("lock is held by another process")
+
+var (
+	// heldLocks keeps locks of data directories taken by this process by the
+	// absolute path of the data directory. Handles created in this process
+	// for the same data directory share the lock. The lock is released once
+	// all the handles sharing it are closed.
+	heldLocks      = make(map[string]*heldLock)
+	heldLocksMutex sync.Mutex
+)
+
+// heldLock is the lock of the data directory shared by handles created in
+// this process.
+type heldLock struct {
+	lockFile *os.File
+	handles  int
+}
+
+// LockStatus describes the state of the data directory lock.
+type LockStatus struct {
+	// Locked is true if the data directory is locked by any process.
+	Locked bool
+	// HolderPID is the PID of the process holding the lock, if known.
+	HolderPID int
+	// Stale is true if the lock is held but the process which has taken it
+	// is not running anymore. It may happen, for example, if a child process
+	// inherited the lock file descriptor and outlived its parent. Such lock
+	// is still held and can not be taken over; it is released once all the
+	// processes sharing the lock file descriptor exit.
+	Stale bool
+}
+
+// lockDataDirectory takes the exclusive lock of the data directory so that
+// no other process is able to use it at the same time. If the lock is held
+// by another process, an error naming the PID of that process is returned.
+// The lock is released by the system when the process holding it exits, so
+// the lock file left behind by such a process is taken over and the PID in
+// it is rewritten in place. The lock file is never removed as it could still
+// be locked by another process. The returned flag is true if the lock has
+// been taken by this call and false if it was already held by another handle
+// of this process.
+func lockDataDirectory(dataDir string) (bool, error) {
+	path, err := filepath.Abs(dataDir)
+	if err != nil {
+		return false, fmt.Errorf("could not resolve data directory path: [%v]", err)
+	}
+
+	heldLocksMutex.Lock()
+	defer heldLocksMutex.Unlock()
+
+	if lock, held := heldLocks[path]; held {
+		lock.handles++
+		return false, nil
+	}
+
+	lockFilePath := filepath.Join(path, lockFileName)
+
+	// #nosec G304 (file path provided as taint input)
+	// This line opens the lock file in the data directory provided by the
+	// operator.
+	lockFile, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, fmt.Errorf("could not open lock file: [%v]", err)
+	}
+
+	err = tryLockFile(lockFile)
+	if err == errLockHeld {
+		closeFile(lockFile)
+		return false, fmt.Errorf(
+			"data directory [%v] is locked by another process with PID [%v]",
+			path,
+			describeHolder(readLockHolder(lockFilePath)),
+		)
+	}
+	if err != nil {
+		closeFile(lockFile)
+		return false, fmt.Errorf("could not lock data directory: [%v]", err)
+	}
+
+	// the lock file left behind by a process which is not running anymore
+	// is not locked, it only names the PID of that process
+	previousHolderPID := readLockHolder(lockFilePath)
+	if previousHolderPID > 0 && previousHolderPID != os.Getpid() {
+		logger.Warningf(
+			"taking over lock of data directory [%v] left by process [%v]",
+			path,
+			previousHolderPID,
+		)
+	}
+
+	err = writeLockHolder(lockFile)
+	if err != nil {
+		unlockFile(lockFile)
+		closeFile(lockFile)
+		return false, err
+	}
+
+	heldLocks[path] = &heldLock{lockFile: lockFile, handles: 1}
+
+	return true, nil
+}
+
+// unlockDataDirectory releases the lock of the data directory taken with
+// lockDataDirectory. The lock is shared by all the handles created in this
+// process for the same data directory so it is released only once it has
+// been released by all of them.
+func unlockDataDirectory(dataDir string) error {
+	path, err := filepath.Abs(dataDir)
+	if err != nil {
+		return fmt.Errorf("could not resolve data directory path: [%v]", err)
+	}
+
+	heldLocksMutex.Lock()
+	defer heldLocksMutex.Unlock()
+
+	lock, held := heldLocks[path]
+	if !held {
+		return fmt.Errorf("data directory [%v] is not locked", path)
+	}
+
+	lock.handles--
+	if lock.handles > 0 {
+		return nil
+	}
+
+	delete(heldLocks, path)
+
+	err = unlockFile(lock.lockFile)
+	closeFile(lock.lockFile)
+	if err != nil {
+		return fmt.Errorf("could not release data directory lock: [%v]", err)
+	}
+
+	return nil
+}
+
+// CheckDataDirectoryLock checks whether the data directory is locked and by
+// which process. The lock file left behind by a process which is not running
+// anymore is reported as not locked as it is taken over by the next handle
+// created for the data directory. The stale lock, held although the process
+// which has taken it is not running anymore, can not be broken; processes
+// sharing its lock file descriptor have to be stopped.
+func CheckDataDirectoryLock(dataDir string) (*LockStatus, error) {
+	path, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve data directory path: [%v]", err)
+	}
+
+	heldLocksMutex.Lock()
+	defer heldLocksMutex.Unlock()
+
+	if _, held := heldLocks[path]; held {
+		return &LockStatus{Locked: true, HolderPID: os.Getpid()}, nil
+	}
+
+	lockFilePath := filepath.Join(path, lockFileName)
+
+	// #nosec G304 (file path provided as taint input)
+	// This line opens the lock file in the data directory provided by the
+	// operator.
+	lockFile, err := os.OpenFile(lockFilePath, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return &LockStatus{Locked: false}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: [%v]", err)
+	}
+	defer closeFile(lockFile)
+
+	err = tryLockFile(lockFile)
+	if err == errLockHeld {
+		holderPID := readLockHolder(lockFilePath)
+
+		return &LockStatus{
+			Locked:    true,
+			HolderPID: holderPID,
+			Stale:     holderPID > 0 && !isProcessRunning(holderPID),
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not check data directory lock: [%v]", err)
+	}
+
+	if err := unlockFile(lockFile); err != nil {
+		return nil, fmt.Errorf("could not release data directory lock: [%v]", err)
+	}
+
+	return &LockStatus{Locked: false}, nil
+}
+
+func writeLockHolder(lockFile *os.File) error {
+	if err := lockFile.Truncate(0); err != nil {
+		return fmt.Errorf("could not write lock file: [%v]", err)
+	}
+
+	_, err := lockFile.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	if err != nil {
+		return fmt.Errorf("could not write lock file: [%v]", err)
+	}
+
+	if err := lockFile.Sync(); err != nil {
+		return fmt.Errorf("could not sync lock file: [%v]", err)
+	}
+
+	return nil
+}
+
+// readLockHolder returns the PID written to the lock file or zero if it
+// could not be read.
+func readLockHolder(lockFilePath string) int {
+	// #nosec G304 (file path provided as taint input)
+	// This line reads the lock file in the data directory provided by the
+	// operator.
+	content, err := ioutil.ReadFile(lockFilePath)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
+
+func describeHolder(pid int) string {
+	if pid <= 0 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(pid)
+}
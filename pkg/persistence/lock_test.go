@@ -0,0 +1,295 @@
+package persistence
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// nonExistingPID is above the maximum PID on any supported platform.
+const nonExistingPID = 1 << 30
+
+func TestNewDiskHandle_LockedByOtherProcess(t *testing.T) {
+	tempDir := newTestDataDir(t)
+	defer os.RemoveAll(tempDir)
+
+	holderPID := 4242
+	lockFile := holdTestLock(t, tempDir, holderPID)
+	defer lockFile.Close()
+
+	_, err := NewDiskHandle(tempDir)
+
+	absolutePath, _ := filepath.Abs(tempDir)
+	expectedError := fmt.Errorf(
+		"data directory [%v] is locked by another process with PID [%v]",
+		absolutePath,
+		holderPID,
+	)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+}
+
+func TestNewDiskHandle_SharedLockInProcess(t *testing.T) {
+	tempDir := newTestDataDir(t)
+	defer os.RemoveAll(tempDir)
+
+	handle1, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle1.(io.Closer).Close()
+
+	handle2, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle2.(io.Closer).Close()
+
+	status, err := CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStatus := &LockStatus{Locked: true, HolderPID: os.Getpid()}
+	if !reflect.DeepEqual(expectedStatus, status) {
+		t.Fatalf(
+			"unexpected lock status\nexpected: [%+v]\nactual:   [%+v]",
+			expectedStatus,
+			status,
+		)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, lockFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Fatalf("unexpected lock file content: [%s]", content)
+	}
+}
+
+func TestCheckDataDirectoryLock_Held(t *testing.T) {
+	var tests = map[string]struct {
+		holderPID      int
+		expectedStatus *LockStatus
+	}{
+		"running holder": {
+			holderPID:      os.Getpid(),
+			expectedStatus: &LockStatus{Locked: true, HolderPID: os.Getpid()},
+		},
+		"holder not running": {
+			holderPID: nonExistingPID,
+			expectedStatus: &LockStatus{
+				Locked:    true,
+				HolderPID: nonExistingPID,
+				Stale:     true,
+			},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tempDir := newTestDataDir(t)
+			defer os.RemoveAll(tempDir)
+
+			lockFile := holdTestLock(t, tempDir, test.holderPID)
+			defer lockFile.Close()
+
+			status, err := CheckDataDirectoryLock(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.expectedStatus, status) {
+				t.Fatalf(
+					"unexpected lock status\nexpected: [%+v]\nactual:   [%+v]",
+					test.expectedStatus,
+					status,
+				)
+			}
+
+			// the lock held by any process is never taken over
+			_, err = NewDiskHandle(tempDir)
+			if err == nil {
+				t.Fatal("expected handle creation to fail")
+			}
+		})
+	}
+}
+
+func TestNewDiskHandle_LeftoverLock(t *testing.T) {
+	tempDir := newTestDataDir(t)
+	defer os.RemoveAll(tempDir)
+
+	// lock file left by a process that has exited
+	lockFilePath := filepath.Join(tempDir, lockFileName)
+	err := ioutil.WriteFile(lockFilePath, []byte("4242\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockFileInfo, err := os.Stat(lockFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(io.Closer).Close()
+
+	currentLockFileInfo, err := os.Stat(lockFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(lockFileInfo, currentLockFileInfo) {
+		t.Fatal("lock file should be rewritten in place")
+	}
+
+	content, err := ioutil.ReadFile(lockFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Fatalf("unexpected lock file content: [%s]", content)
+	}
+
+	status, err := CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStatus := &LockStatus{Locked: true, HolderPID: os.Getpid()}
+	if !reflect.DeepEqual(expectedStatus, status) {
+		t.Fatalf(
+			"unexpected lock status\nexpected: [%+v]\nactual:   [%+v]",
+			expectedStatus,
+			status,
+		)
+	}
+}
+
+func TestDiskPersistence_Close(t *testing.T) {
+	tempDir := newTestDataDir(t)
+	defer os.RemoveAll(tempDir)
+
+	handle1, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle2, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handle1.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the handle again does not release the lock shared with
+	// the other handle
+	if err := handle1.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Locked {
+		t.Fatal("lock should be held until all handles are closed")
+	}
+
+	if err := handle2.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Locked {
+		t.Fatalf("unexpected lock status: [%+v]", status)
+	}
+
+	// the released lock can be taken by another process
+	lockFile := holdTestLock(t, tempDir, 4242)
+	defer lockFile.Close()
+
+	_, err = NewDiskHandle(tempDir)
+	if err == nil {
+		t.Fatal("expected handle creation to fail")
+	}
+}
+
+func TestCheckDataDirectoryLock_NotLocked(t *testing.T) {
+	tempDir := newTestDataDir(t)
+	defer os.RemoveAll(tempDir)
+
+	// lock file left by a process that has exited
+	lockFilePath := filepath.Join(tempDir, lockFileName)
+	err := ioutil.WriteFile(lockFilePath, []byte("4242\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := CheckDataDirectoryLock(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Locked {
+		t.Fatalf("unexpected lock status: [%+v]", status)
+	}
+
+	handle, err := NewDiskHandle(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handle.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestDataDir(t *testing.T) string {
+	tempDir, err := ioutil.TempDir("", "lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tempDir
+}
+
+// holdTestLock locks the data directory as if it was locked by the process
+// with the given PID. Lock taken with another file descriptor conflicts with
+// the lock taken by NewDiskHandle even in the same process.
+func holdTestLock(t *testing.T, dataDir string, pid int) *os.File {
+	lockFilePath := filepath.Join(dataDir, lockFileName)
+
+	lockFile, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tryLockFile(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = lockFile.WriteString(strconv.Itoa(pid) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lockFile
+}
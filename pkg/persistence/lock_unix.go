@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package persistence
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes the exclusive advisory lock of the file without blocking.
+// If the lock is held by another process, errLockHeld is returned.
+func tryLockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+
+	return err
+}
+
+// unlockFile releases the lock of the file.
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// isProcessRunning returns true if the process with the given PID exists.
+func isProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists but belongs to another user
+	return err == nil || err == syscall.EPERM
+}
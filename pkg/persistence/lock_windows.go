@@ -0,0 +1,66 @@
+//go:build windows
+// +build windows
+
+package persistence
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockedByteOffset is the offset of the byte locked in the lock file. Windows
+// locks are mandatory so the byte is far beyond the PID written to the file
+// to not prevent other processes from reading it.
+const lockedByteOffset = 1 << 30
+
+// tryLockFile takes the exclusive lock of the file without blocking. If the
+// lock is held by another process, errLockHeld is returned.
+func tryLockFile(file *os.File) error {
+	err := windows.LockFileEx(
+		windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0,
+		1,
+		0,
+		&windows.Overlapped{Offset: lockedByteOffset},
+	)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLockHeld
+	}
+
+	return err
+}
+
+// unlockFile releases the lock of the file.
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(
+		windows.Handle(file.Fd()),
+		0,
+		1,
+		0,
+		&windows.Overlapped{Offset: lockedByteOffset},
+	)
+}
+
+// isProcessRunning returns true if the process with the given PID exists.
+func isProcessRunning(pid int) bool {
+	process, err := windows.OpenProcess(
+		windows.PROCESS_QUERY_LIMITED_INFORMATION,
+		false,
+		uint32(pid),
+	)
+	if err != nil {
+		// access denied means the process exists but we can not inspect it
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(process)
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(process, &exitCode); err != nil {
+		return true
+	}
+
+	// STILL_ACTIVE
+	return exitCode == 259
+}
@@ -0,0 +1,559 @@
+package persistence
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryHandle creates in-memory data persistence handle. The handle
+// follows the same current, archive and snapshot semantics as the on-disk
+// handle but nothing is persisted between process restarts. It is meant to be
+// used in tests and by short-lived nodes which do not need a disk.
+func NewMemoryHandle() Handle {
+	return &memoryPersistence{
+		current:  make(map[string]map[string][]byte),
+		archive:  make(map[string]map[string][]byte),
+		snapshot: make(map[string]map[string][]*memorySnapshot),
+		snapshotTimeGenerator: func() time.Time {
+			return time.Now()
+		},
+	}
+}
+
+type memorySnapshot struct {
+	data      []byte
+	timestamp time.Time
+}
+
+type memoryPersistence struct {
+	// directory name -> data name -> data
+	current map[string]map[string][]byte
+	archive map[string]map[string][]byte
+	// directory name -> data name -> snapshots ordered from the oldest to
+	// the most recent one
+	snapshot map[string]map[string][]*memorySnapshot
+	mutex    sync.RWMutex
+
+	snapshotTimeGenerator func() time.Time
+}
+
+func (mp *memoryPersistence) Save(data []byte, directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if _, exists := mp.current[directory]; !exists {
+		mp.current[directory] = make(map[string][]byte)
+	}
+
+	mp.current[directory][name] = copyBytes(data)
+
+	return nil
+}
+
+func (mp *memoryPersistence) Snapshot(data []byte, directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	// snapshots are kept with the same precision as on disk
+	timestamp := mp.snapshotTimeGenerator().Truncate(time.Millisecond)
+
+	maxSnapshotNameLength := maxFileNameLength - len(snapshotSuffix(timestamp))
+	if len(name) > maxSnapshotNameLength {
+		return fmt.Errorf(
+			"the maximum file name length of [%v] exceeded for [%v]",
+			maxSnapshotNameLength,
+			name,
+		)
+	}
+
+	err = validatePathSegment("file", name)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if _, exists := mp.snapshot[directory]; !exists {
+		mp.snapshot[directory] = make(map[string][]*memorySnapshot)
+	}
+
+	snapshots := mp.snapshot[directory][name]
+	for _, snapshot := range snapshots {
+		// very unlikely but better fail than overwrite an existing snapshot
+		if snapshot.timestamp.Equal(timestamp) {
+			return fmt.Errorf(
+				"could not create unique snapshot; " +
+					"snapshot name collision has been detected",
+			)
+		}
+	}
+
+	snapshots = append(snapshots, &memorySnapshot{
+		data:      copyBytes(data),
+		timestamp: timestamp,
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].timestamp.Before(snapshots[j].timestamp)
+	})
+
+	mp.snapshot[directory][name] = snapshots
+
+	return nil
+}
+
+func (mp *memoryPersistence) Begin() (Transaction, error) {
+	return newBufferedTransaction(func(staged []*stagedData) error {
+		mp.mutex.Lock()
+		defer mp.mutex.Unlock()
+
+		for _, data := range staged {
+			if _, exists := mp.current[data.directory]; !exists {
+				mp.current[data.directory] = make(map[string][]byte)
+			}
+
+			mp.current[data.directory][data.name] = data.data
+		}
+
+		return nil
+	}), nil
+}
+
+func (mp *memoryPersistence) ReadAll(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return readAllFromMemory(mp.current, newReadOptions(options))
+}
+
+func (mp *memoryPersistence) ReadArchived(
+	options ...ReadOption,
+) (<-chan DataDescriptor, <-chan error) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return readAllFromMemory(mp.archive, newReadOptions(options))
+}
+
+func (mp *memoryPersistence) Archive(directory string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	return moveAllInMemory(mp.current, mp.archive, directory)
+}
+
+func (mp *memoryPersistence) Unarchive(directory string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if _, exists := mp.archive[directory]; !exists {
+		return fmt.Errorf("directory [%v] is not archived", directory)
+	}
+
+	return moveAllInMemory(mp.archive, mp.current, directory)
+}
+
+func (mp *memoryPersistence) Read(directory, name string) ([]byte, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	data, exists := mp.current[directory][name]
+	if !exists {
+		return nil, fmt.Errorf(
+			"could not read [%v] from directory [%v]: [no such data]",
+			name,
+			directory,
+		)
+	}
+
+	return copyBytes(data), nil
+}
+
+func (mp *memoryPersistence) Delete(directory, name string) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if _, exists := mp.current[directory][name]; !exists {
+		return fmt.Errorf(
+			"could not delete [%v] from directory [%v]: [no such data]",
+			name,
+			directory,
+		)
+	}
+
+	delete(mp.current[directory], name)
+
+	return nil
+}
+
+func (mp *memoryPersistence) List(directory string) ([]string, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	names := make([]string, 0, len(mp.current[directory]))
+	for name := range mp.current[directory] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (mp *memoryPersistence) ListSnapshots(
+	directory string,
+	name string,
+) ([]SnapshotDescriptor, error) {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	snapshots := mp.snapshot[directory][name]
+
+	descriptors := make([]SnapshotDescriptor, len(snapshots))
+	for i, snapshot := range snapshots {
+		// capture shared loop variable for the closure
+		data := snapshot.data
+
+		descriptors[i] = &snapshotDescriptor{
+			dataDescriptor: dataDescriptor{
+				name:      name,
+				directory: directory,
+				readFunc: func() ([]byte, error) {
+					return copyBytes(data), nil
+				},
+			},
+			timestamp: snapshot.timestamp,
+		}
+	}
+
+	return descriptors, nil
+}
+
+func (mp *memoryPersistence) RestoreSnapshot(
+	directory string,
+	name string,
+	timestamp time.Time,
+) error {
+	snapshots, err := mp.ListSnapshots(directory, name)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if !snapshot.Timestamp().Equal(timestamp) {
+			continue
+		}
+
+		data, err := snapshot.Content()
+		if err != nil {
+			return fmt.Errorf("could not read snapshot: [%v]", err)
+		}
+
+		return mp.Save(data, directory, name)
+	}
+
+	return fmt.Errorf(
+		"no snapshot of [%v] in directory [%v] taken at [%v]",
+		name,
+		directory,
+		timestamp,
+	)
+}
+
+func (mp *memoryPersistence) PruneSnapshots(
+	policy *SnapshotRetentionPolicy,
+) error {
+	if policy == nil {
+		return errNoRetentionPolicy
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, directorySnapshots := range mp.snapshot {
+		for name, snapshots := range directorySnapshots {
+			retained := make([]*memorySnapshot, 0, len(snapshots))
+
+			for i, snapshot := range snapshots {
+				position := len(snapshots) - 1 - i
+				if policy.retains(position, snapshot.timestamp, now) {
+					retained = append(retained, snapshot)
+				}
+			}
+
+			directorySnapshots[name] = retained
+		}
+	}
+
+	return nil
+}
+
+// Verify does not report anything as data kept in memory is not subject to
+// silent corruption the way data kept on disk is.
+func (mp *memoryPersistence) Verify() <-chan error {
+	errorChannel := make(chan error)
+	close(errorChannel)
+	return errorChannel
+}
+
+func (mp *memoryPersistence) ReadEntries() (<-chan EntryDescriptor, <-chan error) {
+	entryChannel := make(chan EntryDescriptor)
+	errorChannel := make(chan error)
+
+	entries := make([]*entryDescriptor, 0)
+
+	// readFunc captures the data for the closure
+	readFunc := func(data []byte) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			return copyBytes(data), nil
+		}
+	}
+
+	mp.mutex.RLock()
+	for _, area := range []string{currentDir, archiveDir} {
+		storage := mp.current
+		if area == archiveDir {
+			storage = mp.archive
+		}
+
+		for directory, directoryData := range storage {
+			for name, data := range directoryData {
+				entries = append(
+					entries,
+					newEntryDescriptor(area, directory, name, readFunc(data)),
+				)
+			}
+		}
+	}
+	for directory, directorySnapshots := range mp.snapshot {
+		for name, snapshots := range directorySnapshots {
+			for _, snapshot := range snapshots {
+				entries = append(entries, newEntryDescriptor(
+					snapshotDir,
+					directory,
+					name+snapshotSuffix(snapshot.timestamp),
+					readFunc(snapshot.data),
+				))
+			}
+		}
+	}
+	mp.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	go func() {
+		defer close(entryChannel)
+		defer close(errorChannel)
+
+		for _, entry := range entries {
+			entryChannel <- entry
+		}
+	}()
+
+	return entryChannel, errorChannel
+}
+
+func (mp *memoryPersistence) WriteEntry(key string, data []byte) error {
+	area, directory, storedName, err := parseEntryKey(key)
+	if err != nil {
+		return err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if area != snapshotDir {
+		storage := mp.current
+		if area == archiveDir {
+			storage = mp.archive
+		}
+
+		if _, exists := storage[directory]; !exists {
+			storage[directory] = make(map[string][]byte)
+		}
+
+		storage[directory][storedName] = copyBytes(data)
+		return nil
+	}
+
+	name, timestamp, ok := parseSnapshotFileName(storedName)
+	if !ok {
+		return fmt.Errorf("snapshot key [%v] does not carry the timestamp", key)
+	}
+
+	if _, exists := mp.snapshot[directory]; !exists {
+		mp.snapshot[directory] = make(map[string][]*memorySnapshot)
+	}
+
+	snapshots := mp.snapshot[directory][name]
+	for _, snapshot := range snapshots {
+		if snapshot.timestamp.Equal(timestamp) {
+			snapshot.data = copyBytes(data)
+			return nil
+		}
+	}
+
+	snapshots = append(snapshots, &memorySnapshot{
+		data:      copyBytes(data),
+		timestamp: timestamp,
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].timestamp.Before(snapshots[j].timestamp)
+	})
+
+	mp.snapshot[directory][name] = snapshots
+
+	return nil
+}
+
+// readAllFromMemory outputs all data from the provided storage as
+// DataDescriptors into the first returned output channel following the same
+// contract as readAll. The caller is expected to hold a lock protecting the
+// storage; the storage content is captured before this function returns so
+// the lock can be released before the returned channels are read.
+func readAllFromMemory(
+	storage map[string]map[string][]byte,
+	options *readOptions,
+) (<-chan DataDescriptor, <-chan error) {
+	descriptors := make([]*dataDescriptor, 0)
+
+	directories := make([]string, 0, len(storage))
+	for directory := range storage {
+		if options.matches(directory) {
+			directories = append(directories, directory)
+		}
+	}
+	sort.Strings(directories)
+
+	for _, directory := range directories {
+		names := make([]string, 0, len(storage[directory]))
+		for name := range storage[directory] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			// capture shared loop variable for the closure
+			data := storage[directory][name]
+
+			descriptors = append(descriptors, &dataDescriptor{
+				name:      name,
+				directory: directory,
+				readFunc: func() ([]byte, error) {
+					return copyBytes(data), nil
+				},
+			})
+		}
+	}
+
+	return readDescriptors(options, func(
+		emit func(DataDescriptor) bool,
+		emitError func(error) bool,
+	) {
+		for _, descriptor := range descriptors {
+			if !emit(descriptor) {
+				return
+			}
+		}
+	})
+}
+
+// moveAllInMemory moves the entire directory between the provided storages.
+// If the directory already exists in the target storage, data are appended
+// to it overwriting data with the same names.
+func moveAllInMemory(
+	from map[string]map[string][]byte,
+	to map[string]map[string][]byte,
+	directory string,
+) error {
+	data, exists := from[directory]
+	if !exists {
+		return fmt.Errorf("directory [%v] does not exist", directory)
+	}
+
+	if _, exists := to[directory]; !exists {
+		to[directory] = data
+	} else {
+		for name, content := range data {
+			to[directory][name] = content
+		}
+	}
+
+	delete(from, directory)
+
+	return nil
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
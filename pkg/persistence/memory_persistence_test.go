@@ -0,0 +1,348 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryPersistence_SaveAndRead(t *testing.T) {
+	handle := NewMemoryHandle()
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := handle.Save(bytesToTest, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// modifying the saved slice must not affect the persisted data
+	bytesToTest[0] = 0
+
+	content, err := handle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedContent := []byte{115, 111, 109, 101, 10}
+	if !bytes.Equal(expectedContent, content) {
+		t.Fatalf(
+			"unexpected content\nexpected: [%v]\nactual:   [%v]",
+			expectedContent,
+			content,
+		)
+	}
+
+	_, err = handle.Read(dirName1, fileName12)
+	if err == nil {
+		t.Fatalf("expected error for non-existing data")
+	}
+}
+
+func TestMemoryPersistence_RefuseSave(t *testing.T) {
+	handle := NewMemoryHandle()
+	bytesToTest := []byte{115, 111, 109, 101, 10}
+
+	err := handle.Save(bytesToTest, maxAllowedName, maxAllowedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Save(bytesToTest, notAllowedName, fileName11)
+	if err == nil || errDirectoryNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errDirectoryNameLength,
+			err,
+		)
+	}
+
+	err = handle.Save(bytesToTest, dirName1, notAllowedName)
+	if err == nil || errFileNameLength.Error() != err.Error() {
+		t.Fatalf(
+			"unexpected error returned\nexpected: [%v]\nactual:   [%v]",
+			errFileNameLength,
+			err,
+		)
+	}
+}
+
+func TestMemoryPersistence_ReadAll(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	handle.Save([]byte{1}, dirName2, fileName21)
+	handle.Save([]byte{2}, dirName1, fileName12)
+	handle.Save([]byte{3}, dirName1, fileName11)
+
+	descriptors, errors := readAllDescriptors(handle.ReadAll())
+	for _, err := range errors {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		directory string
+		name      string
+		content   []byte
+	}{
+		{dirName1, fileName11, []byte{3}},
+		{dirName1, fileName12, []byte{2}},
+		{dirName2, fileName21, []byte{1}},
+	}
+
+	if len(descriptors) != len(expected) {
+		t.Fatalf(
+			"Number of descriptors does not match\nExpected: [%v]\nActual:   [%v]",
+			len(expected),
+			len(descriptors),
+		)
+	}
+
+	for i, descriptor := range descriptors {
+		content, err := descriptor.Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if descriptor.Directory() != expected[i].directory ||
+			descriptor.Name() != expected[i].name ||
+			!bytes.Equal(content, expected[i].content) {
+			t.Errorf(
+				"unexpected descriptor [%v]\nexpected: [%v/%v %v]\nactual:   [%v/%v %v]",
+				i,
+				expected[i].directory,
+				expected[i].name,
+				expected[i].content,
+				descriptor.Directory(),
+				descriptor.Name(),
+				content,
+			)
+		}
+	}
+}
+
+func TestMemoryPersistence_ArchiveAndUnarchive(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	handle.Save([]byte{1}, dirName1, fileName11)
+	handle.Save([]byte{2}, dirName2, fileName21)
+
+	err := handle.Archive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := readAllDescriptors(handle.ReadAll())
+	if len(current) != 1 || current[0].Directory() != dirName2 {
+		t.Fatalf("only [%v] directory should remain non-archived", dirName2)
+	}
+
+	archived, _ := readAllDescriptors(handle.ReadArchived())
+	if len(archived) != 1 || archived[0].Directory() != dirName1 {
+		t.Fatalf("only [%v] directory should be archived", dirName1)
+	}
+
+	// append to the archive
+	handle.Save([]byte{3}, dirName1, fileName12)
+	err = handle.Archive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archived, _ = readAllDescriptors(handle.ReadArchived())
+	if len(archived) != 2 {
+		t.Fatalf("expected [2] archived descriptors; has [%v]", len(archived))
+	}
+
+	err = handle.Unarchive(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := handle.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{fileName11, fileName12}
+	if !reflect.DeepEqual(expectedNames, names) {
+		t.Fatalf(
+			"unexpected names\nexpected: [%v]\nactual:   [%v]",
+			expectedNames,
+			names,
+		)
+	}
+
+	err = handle.Unarchive(dirName1)
+	expectedError := fmt.Errorf("directory [%v] is not archived", dirName1)
+	if !reflect.DeepEqual(expectedError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedError,
+			err,
+		)
+	}
+}
+
+func TestMemoryPersistence_Delete(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	handle.Save([]byte{1}, dirName1, fileName11)
+	handle.Save([]byte{2}, dirName1, fileName12)
+
+	err := handle.Delete(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := handle.List(dirName1)
+	if !reflect.DeepEqual([]string{fileName12}, names) {
+		t.Fatalf("unexpected names: [%v]", names)
+	}
+
+	err = handle.Delete(dirName1, fileName11)
+	if err == nil {
+		t.Fatalf("expected error for non-existing data")
+	}
+}
+
+func TestMemoryPersistence_Snapshots(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	now := time.Now()
+
+	counter := 0
+	handle.(*memoryPersistence).snapshotTimeGenerator = func() time.Time {
+		counter++
+		// snapshots taken 5, 4, 3, 2 and 1 hour ago
+		return now.Add(time.Duration(counter-6) * time.Hour)
+	}
+
+	for i := 0; i < 5; i++ {
+		err := handle.Snapshot([]byte{byte(i)}, dirName1, fileName11)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := handle.ListSnapshots(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 5 {
+		t.Fatalf("expected [5] snapshots; has [%v]", len(snapshots))
+	}
+
+	err = handle.RestoreSnapshot(dirName1, fileName11, snapshots[1].Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := handle.Read(dirName1, fileName11)
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf("unexpected restored content: [%v]", content)
+	}
+
+	err = handle.PruneSnapshots(&SnapshotRetentionPolicy{
+		KeepLast: 3,
+		MaxAge:   90 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, _ = handle.ListSnapshots(dirName1, fileName11)
+	if len(snapshots) != 1 {
+		t.Fatalf("expected [1] snapshot; has [%v]", len(snapshots))
+	}
+
+	content, _ = snapshots[0].Content()
+	if !bytes.Equal([]byte{4}, content) {
+		t.Fatalf("unexpected retained snapshot content: [%v]", content)
+	}
+}
+
+func TestMemoryPersistence_RefuseSnapshot_NameCollision(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	timestamp := time.Now()
+	handle.(*memoryPersistence).snapshotTimeGenerator = func() time.Time {
+		return timestamp
+	}
+
+	err := handle.Snapshot([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handle.Snapshot([]byte{1}, dirName1, fileName11)
+
+	expectedDuplicateError := fmt.Errorf(
+		"could not create unique snapshot; " +
+			"snapshot name collision has been detected",
+	)
+	if !reflect.DeepEqual(expectedDuplicateError, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			expectedDuplicateError,
+			err,
+		)
+	}
+}
+
+func TestMemoryPersistence_ConcurrentAccess(t *testing.T) {
+	handle := NewMemoryHandle()
+
+	var wg sync.WaitGroup
+	wg.Add(20)
+
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			defer wg.Done()
+			handle.Save([]byte{byte(i)}, dirName1, strconv.Itoa(i))
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			readAllDescriptors(handle.ReadAll())
+		}()
+	}
+
+	wg.Wait()
+
+	names, _ := handle.List(dirName1)
+	if len(names) != 10 {
+		t.Fatalf("expected [10] names; has [%v]", len(names))
+	}
+}
+
+func readAllDescriptors(
+	dataChannel <-chan DataDescriptor,
+	errorChannel <-chan error,
+) ([]DataDescriptor, []error) {
+	var descriptors []DataDescriptor
+	var errors []error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		for e := range errorChannel {
+			errors = append(errors, e)
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		for d := range dataChannel {
+			descriptors = append(descriptors, d)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+
+	return descriptors, errors
+}
@@ -0,0 +1,270 @@
+package persistence
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/keep-network/keep-common/pkg/encryption"
+)
+
+// rotationJournalHeader is the first line of every password rotation journal.
+const rotationJournalHeader = "keep-persistence-password-rotation-journal-v1"
+
+// RotatePassword re-encrypts all the entries kept by the provided handle,
+// that is non-archived data, archived data and snapshots, from the old
+// password to the new one. The handle must be the one the encrypted
+// persistence delegates to, not the encrypted persistence itself.
+//
+// Keys of the re-encrypted entries are recorded in the journal file under the
+// provided path as the rotation progresses. If the rotation is interrupted,
+// the store contains entries encrypted with both passwords and the rotation
+// must be resumed by calling this function again with the same arguments
+// before the store is used again. Entries recorded in the journal are skipped
+// when the rotation is resumed as long as they can be decrypted with the new
+// password. The journal is removed once all the entries are encrypted with
+// the new password.
+func RotatePassword(
+	handle Handle,
+	oldPassword string,
+	newPassword string,
+	journalPath string,
+) error {
+	rotated, journalLength, err := readRotationJournal(journalPath)
+	if err != nil {
+		return err
+	}
+
+	entries, err := collectEntries(handle)
+	if err != nil {
+		return err
+	}
+
+	journal, err := openRotationJournal(journalPath, journalLength)
+	if err != nil {
+		return err
+	}
+
+	oldBox := encryption.NewPasswordBox(oldPassword)
+	newBox := encryption.NewPasswordBox(newPassword)
+
+	for _, entry := range entries {
+		if rotated[entry.Key()] {
+			isRotated, err := isEncryptedWith(entry, newBox)
+			if err != nil {
+				closeFile(journal)
+				return err
+			}
+
+			if isRotated {
+				continue
+			}
+
+			logger.Warningf(
+				"entry [%v] recorded in the journal is not encrypted "+
+					"with the new password; rotating it again",
+				entry.Key(),
+			)
+		}
+
+		err := rotateEntry(handle, entry, oldBox, newBox)
+		if err != nil {
+			closeFile(journal)
+			return err
+		}
+
+		err = appendToRotationJournal(journal, entry.Key())
+		if err != nil {
+			closeFile(journal)
+			return err
+		}
+	}
+
+	err = journal.Close()
+	if err != nil {
+		return fmt.Errorf("could not close the journal: [%v]", err)
+	}
+
+	err = os.Remove(journalPath)
+	if err != nil {
+		return fmt.Errorf("could not remove the journal: [%v]", err)
+	}
+
+	logger.Infof("password rotated for [%v] entries", len(entries))
+
+	return nil
+}
+
+func rotateEntry(
+	handle Handle,
+	entry EntryDescriptor,
+	oldBox encryption.AEADBox,
+	newBox encryption.AEADBox,
+) error {
+	content, err := entry.Content()
+	if err != nil {
+		return fmt.Errorf("could not read entry [%v]: [%v]", entry.Key(), err)
+	}
+
+	additionalData := associatedData(entry.Directory(), entry.Name())
+
+	decrypted, err := oldBox.DecryptWithAD(content, additionalData)
+	if err != nil {
+		// The rotation could be interrupted after the entry has been
+		// re-encrypted but before it has been recorded in the journal.
+		if _, newErr := newBox.DecryptWithAD(content, additionalData); newErr == nil {
+			return nil
+		}
+
+		return fmt.Errorf(
+			"could not decrypt entry [%v] with the old password: [%v]",
+			entry.Key(),
+			err,
+		)
+	}
+
+	encrypted, err := newBox.EncryptWithAD(decrypted, additionalData)
+	if err != nil {
+		return fmt.Errorf(
+			"could not encrypt entry [%v] with the new password: [%v]",
+			entry.Key(),
+			err,
+		)
+	}
+
+	err = handle.WriteEntry(entry.Key(), encrypted)
+	if err != nil {
+		return fmt.Errorf("could not write entry [%v]: [%v]", entry.Key(), err)
+	}
+
+	return nil
+}
+
+// isEncryptedWith checks whether the content of the entry can be decrypted
+// with the provided box.
+func isEncryptedWith(entry EntryDescriptor, box encryption.AEADBox) (bool, error) {
+	content, err := entry.Content()
+	if err != nil {
+		return false, fmt.Errorf("could not read entry [%v]: [%v]", entry.Key(), err)
+	}
+
+	_, err = box.DecryptWithAD(
+		content,
+		associatedData(entry.Directory(), entry.Name()),
+	)
+
+	return err == nil, nil
+}
+
+// readRotationJournal returns keys of all entries recorded in the journal
+// under the provided path and the length of the complete part of the journal.
+// Only lines terminated with a newline are complete; the last line could be
+// partially written if the rotation has been interrupted and is ignored so
+// that such entry is going to be rotated again. If there is no journal or it
+// has no complete header, an empty set and zero length are returned.
+func readRotationJournal(journalPath string) (map[string]bool, int64, error) {
+	rotated := make(map[string]bool)
+
+	// #nosec G304 (file path provided as taint input)
+	// This line opens the journal from the path provided by the operator.
+	journal, err := os.Open(journalPath)
+	if os.IsNotExist(err) {
+		return rotated, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open the journal: [%v]", err)
+	}
+
+	defer closeFile(journal)
+
+	reader := bufio.NewReader(journal)
+
+	header, err := reader.ReadString('\n')
+	if err == io.EOF {
+		return rotated, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read the journal: [%v]", err)
+	}
+	if strings.TrimSuffix(header, "\n") != rotationJournalHeader {
+		return nil, 0, fmt.Errorf(
+			"file [%v] is not a password rotation journal",
+			journalPath,
+		)
+	}
+
+	length := int64(len(header))
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				logger.Warningf(
+					"ignoring incomplete last line of the journal [%v]",
+					journalPath,
+				)
+			}
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read the journal: [%v]", err)
+		}
+
+		length += int64(len(line))
+
+		if key := strings.TrimSpace(line); key != "" {
+			rotated[key] = true
+		}
+	}
+
+	logger.Infof(
+		"resuming password rotation; [%v] entries already rotated",
+		len(rotated),
+	)
+
+	return rotated, length, nil
+}
+
+// openRotationJournal opens the journal for appending. The journal is
+// truncated to the given length of its complete part so that an incomplete
+// last line does not prefix the next appended key. Zero length means the
+// journal is initialized from scratch.
+func openRotationJournal(journalPath string, length int64) (*os.File, error) {
+	journal, err := os.OpenFile(
+		journalPath,
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+		0600,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the journal: [%v]", err)
+	}
+
+	if err := journal.Truncate(length); err != nil {
+		closeFile(journal)
+		return nil, fmt.Errorf("could not initialize the journal: [%v]", err)
+	}
+
+	if length == 0 {
+		err := appendToRotationJournal(journal, rotationJournalHeader)
+		if err != nil {
+			closeFile(journal)
+			return nil, err
+		}
+	}
+
+	return journal, nil
+}
+
+func appendToRotationJournal(journal *os.File, line string) error {
+	if _, err := journal.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("could not write to the journal: [%v]", err)
+	}
+
+	if err := journal.Sync(); err != nil {
+		return fmt.Errorf("could not sync the journal: [%v]", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const newAccountPassword = "bolek"
+
+func TestRotatePassword(t *testing.T) {
+	delegate := NewMemoryHandle()
+	journalPath := newTestJournalPath(t)
+	defer os.Remove(journalPath)
+
+	populateEncryptedStore(t, delegate, accountPassword)
+
+	err := RotatePassword(
+		delegate,
+		accountPassword,
+		newAccountPassword,
+		journalPath,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEncryptedStore(t, delegate, newAccountPassword)
+
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatalf("journal should be removed after the rotation")
+	}
+}
+
+func TestRotatePassword_Resume(t *testing.T) {
+	delegate := NewMemoryHandle()
+	journalPath := newTestJournalPath(t)
+	defer os.Remove(journalPath)
+
+	populateEncryptedStore(t, delegate, accountPassword)
+
+	interrupted := &interruptingPersistence{Handle: delegate, writesLeft: 2}
+
+	err := RotatePassword(
+		interrupted,
+		accountPassword,
+		newAccountPassword,
+		journalPath,
+	)
+	if err == nil {
+		t.Fatal("expected rotation to be interrupted")
+	}
+
+	if _, err := os.Stat(journalPath); err != nil {
+		t.Fatalf("journal should be kept after the interruption: [%v]", err)
+	}
+
+	err = RotatePassword(
+		delegate,
+		accountPassword,
+		newAccountPassword,
+		journalPath,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEncryptedStore(t, delegate, newAccountPassword)
+}
+
+func TestRotatePassword_Resume_NotJournaled(t *testing.T) {
+	delegate := NewMemoryHandle()
+	journalPath := newTestJournalPath(t)
+	defer os.Remove(journalPath)
+
+	populateEncryptedStore(t, delegate, accountPassword)
+
+	// entry rotated but the rotation got interrupted before it has been
+	// recorded in the journal
+	encrypted := NewEncryptedPersistence(delegate, newAccountPassword)
+	encrypted.Save([]byte{1}, dirName1, fileName11)
+
+	err := RotatePassword(
+		delegate,
+		accountPassword,
+		newAccountPassword,
+		journalPath,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEncryptedStore(t, delegate, newAccountPassword)
+}
+
+func TestRotatePassword_Resume_UntrustedJournal(t *testing.T) {
+	delegate := NewMemoryHandle()
+	journalPath := newTestJournalPath(t)
+	defer os.Remove(journalPath)
+
+	populateEncryptedStore(t, delegate, accountPassword)
+
+	currentKey := func(directory, name string) string {
+		return fmt.Sprintf("%s/%s/%s", currentDir, directory, name)
+	}
+
+	// the first entry is recorded in the journal but has not been rotated
+	// and the record of the second entry has been cut by a crash
+	journal := rotationJournalHeader + "\n" +
+		currentKey(dirName1, fileName11) + "\n" +
+		currentKey(dirName1, fileName12)
+
+	err := ioutil.WriteFile(journalPath, []byte(journal), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, length, err := readRotationJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated[currentKey(dirName1, fileName12)] {
+		t.Errorf("incomplete last line of the journal should be ignored")
+	}
+
+	expectedLength := int64(
+		len(journal) - len(currentKey(dirName1, fileName12)),
+	)
+	if expectedLength != length {
+		t.Errorf(
+			"unexpected journal length\nexpected: [%v]\nactual:   [%v]",
+			expectedLength,
+			length,
+		)
+	}
+
+	err = RotatePassword(
+		delegate,
+		accountPassword,
+		newAccountPassword,
+		journalPath,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEncryptedStore(t, delegate, newAccountPassword)
+
+	content, err := NewEncryptedPersistence(delegate, newAccountPassword).Read(
+		dirName1,
+		fileName11,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{1}, content) {
+		t.Fatalf("unexpected content: [%v]", content)
+	}
+}
+
+func TestRotatePassword_WrongPassword(t *testing.T) {
+	delegate := NewMemoryHandle()
+	journalPath := newTestJournalPath(t)
+	defer os.Remove(journalPath)
+
+	populateEncryptedStore(t, delegate, accountPassword)
+
+	err := RotatePassword(delegate, "wrong", newAccountPassword, journalPath)
+	if err == nil {
+		t.Fatal("expected rotation with wrong password to fail")
+	}
+
+	assertEncryptedStore(t, delegate, accountPassword)
+}
+
+func newTestJournalPath(t *testing.T) string {
+	file, err := ioutil.TempFile("", "rotation-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	return file.Name()
+}
+
+func populateEncryptedStore(t *testing.T, delegate Handle, password string) {
+	delegate.(*memoryPersistence).snapshotTimeGenerator = func() time.Time {
+		return time.Unix(1583837153, 0)
+	}
+
+	encrypted := NewEncryptedPersistence(delegate, password)
+
+	err := encrypted.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Save([]byte{2}, dirName1, fileName12)
+	encrypted.Save([]byte{3}, dirName2, fileName21)
+	encrypted.Snapshot([]byte{4}, dirName1, fileName11)
+	encrypted.Archive(dirName2)
+}
+
+func assertEncryptedStore(t *testing.T, delegate Handle, password string) {
+	encrypted := NewEncryptedPersistence(delegate, password)
+
+	var tests = map[string]struct {
+		read            func() ([]byte, error)
+		expectedContent []byte
+	}{
+		"current data": {
+			read: func() ([]byte, error) {
+				return encrypted.Read(dirName1, fileName12)
+			},
+			expectedContent: []byte{2},
+		},
+		"archived data": {
+			read: func() ([]byte, error) {
+				archived, errors := readAllDescriptors(encrypted.ReadArchived())
+				if len(errors) > 0 {
+					return nil, errors[0]
+				}
+				if len(archived) != 1 {
+					return nil, fmt.Errorf("unexpected archive: [%v]", archived)
+				}
+				return archived[0].Content()
+			},
+			expectedContent: []byte{3},
+		},
+		"snapshot": {
+			read: func() ([]byte, error) {
+				snapshots, err := encrypted.ListSnapshots(dirName1, fileName11)
+				if err != nil {
+					return nil, err
+				}
+				if len(snapshots) != 1 {
+					return nil, fmt.Errorf("unexpected snapshots: [%v]", snapshots)
+				}
+				return snapshots[0].Content()
+			},
+			expectedContent: []byte{4},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			content, err := test.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(test.expectedContent, content) {
+				t.Fatalf(
+					"unexpected content\nexpected: [%v]\nactual:   [%v]",
+					test.expectedContent,
+					content,
+				)
+			}
+		})
+	}
+}
+
+// interruptingPersistence fails all writes once the given number of writes
+// has been performed.
+type interruptingPersistence struct {
+	Handle
+	writesLeft int
+}
+
+func (ip *interruptingPersistence) WriteEntry(key string, data []byte) error {
+	if ip.writesLeft == 0 {
+		return fmt.Errorf("interrupted")
+	}
+	ip.writesLeft--
+
+	return ip.Handle.WriteEntry(key, data)
+}
@@ -3,7 +3,11 @@
 // retrieving it.
 package persistence
 
-import "github.com/ipfs/go-log"
+import (
+	"time"
+
+	"github.com/ipfs/go-log"
+)
 
 var logger = log.Logger("keep-persistence")
 
@@ -21,17 +25,76 @@ type Handle interface {
 	// storage implementation.
 	Snapshot(data []byte, directory string, name string) error
 
+	// Begin starts a new transaction allowing to save multiple pieces of data
+	// so that either all of them become visible as non-archived data or none
+	// of them does.
+	Begin() (Transaction, error)
+
 	// ReadAll returns all non-archived data. It returns two channels: the first
 	// channel returned is a non-buffered channel streaming DataDescriptors of
 	// all data read. The second channel is a non-buffered channel streaming all
 	// errors occurred during reading. Returned channels can be integrated
 	// in a pipeline pattern. The function is non-blocking. Channels are closed
-	// when there is no more to be read.
-	ReadAll() (<-chan DataDescriptor, <-chan error)
+	// when there is no more to be read. Options allow to filter and order the
+	// data read, to prefetch the content in parallel, and to abort reading.
+	ReadAll(options ...ReadOption) (<-chan DataDescriptor, <-chan error)
 
 	// Archive marks the entire directory with the name provided as archived
 	// so that the data in that directory is not returned from ReadAll.
 	Archive(directory string) error
+
+	// Unarchive reverts Archive for the entire directory with the name
+	// provided so that the data in that directory is returned from ReadAll
+	// again. If the directory has not been fully archived, archived data is
+	// merged with the non-archived data in that directory.
+	Unarchive(directory string) error
+
+	// ReadArchived returns all archived data. It follows the same contract
+	// as ReadAll.
+	ReadArchived(options ...ReadOption) (<-chan DataDescriptor, <-chan error)
+
+	// ListSnapshots returns all snapshots taken for the given name in the
+	// provided directory ordered from the oldest to the most recent one.
+	ListSnapshots(directory string, name string) ([]SnapshotDescriptor, error)
+
+	// RestoreSnapshot persists the content of the snapshot taken at the given
+	// time for the given name in the provided directory as non-archived data
+	// under the same name and directory.
+	RestoreSnapshot(directory string, name string, timestamp time.Time) error
+
+	// PruneSnapshots removes all snapshots which should not be retained
+	// according to the provided retention policy.
+	PruneSnapshots(policy *SnapshotRetentionPolicy) error
+
+	// Verify walks through all the persisted data, including archived data
+	// and snapshots, looking for corrupted entries. Corrupted entries are moved
+	// to the quarantine so they are no longer returned from any read function
+	// and are reported to the returned channel along with all other errors
+	// occurred during the verification. The function is non-blocking.
+	// The channel is closed when the verification completes.
+	Verify() <-chan error
+
+	// ReadEntries returns all entries kept in the storage, that is all
+	// non-archived data, archived data and snapshots. It follows the same
+	// contract as ReadAll.
+	ReadEntries() (<-chan EntryDescriptor, <-chan error)
+
+	// WriteEntry persists the provided data as the entry with the given key,
+	// replacing the current content of the entry if it already exists.
+	// Keys are in the format returned by EntryDescriptor.
+	WriteEntry(key string, data []byte) error
+
+	// Read returns the non-archived data persisted under the given name in
+	// the provided directory. An error is returned if there is no such data.
+	Read(directory string, name string) ([]byte, error)
+
+	// Delete removes the non-archived data persisted under the given name in
+	// the provided directory. An error is returned if there is no such data.
+	Delete(directory string, name string) error
+
+	// List returns names of all non-archived data persisted in the provided
+	// directory. If the directory does not exist, an empty list is returned.
+	List(directory string) ([]string, error)
 }
 
 // DataDescriptor is an interface representing data saved in the persistence
@@ -0,0 +1,209 @@
+package persistence
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// ReadOption configures reading with ReadAll and ReadArchived.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	ctx             context.Context
+	directoryPrefix string
+	sorted          bool
+	workers         int
+}
+
+// WithDirectoryPrefix limits the data read to the data from directories
+// which names start with the given prefix.
+func WithDirectoryPrefix(prefix string) ReadOption {
+	return func(options *readOptions) {
+		options.directoryPrefix = prefix
+	}
+}
+
+// Sorted makes the data read to be returned ordered by directory and name.
+// By default, the data is returned in the order it is found in the storage.
+func Sorted() ReadOption {
+	return func(options *readOptions) {
+		options.sorted = true
+	}
+}
+
+// WithWorkers makes the content of the data read to be prefetched in parallel
+// by the given number of workers before the data descriptors are returned.
+// The order of the returned data is not affected. Zero, which is the default,
+// disables prefetching so the content is read only when requested.
+func WithWorkers(workers int) ReadOption {
+	return func(options *readOptions) {
+		options.workers = workers
+	}
+}
+
+// WithContext makes reading to be aborted once the given context is done.
+// Both returned channels are closed as soon as the reading is aborted.
+func WithContext(ctx context.Context) ReadOption {
+	return func(options *readOptions) {
+		options.ctx = ctx
+	}
+}
+
+func newReadOptions(options []ReadOption) *readOptions {
+	result := &readOptions{
+		ctx: context.Background(),
+	}
+
+	for _, option := range options {
+		option(result)
+	}
+
+	return result
+}
+
+// matches returns true if the data from the given directory should be read.
+func (ro *readOptions) matches(directory string) bool {
+	return strings.HasPrefix(directory, ro.directoryPrefix)
+}
+
+// readDescriptors calls the provided read function in a separate goroutine
+// and streams all the data descriptors and errors the function emits to the
+// returned channels according to the options. Emit functions return false
+// once the reading has been aborted and the read function should return.
+// Channels are not buffered and are closed when the read function returns
+// and all the data descriptors have been streamed.
+func readDescriptors(
+	options *readOptions,
+	read func(
+		emit func(DataDescriptor) bool,
+		emitError func(error) bool,
+	),
+) (<-chan DataDescriptor, <-chan error) {
+	readChannel := make(chan DataDescriptor)
+	errorChannel := make(chan error)
+
+	send := func(descriptor DataDescriptor) bool {
+		select {
+		case readChannel <- descriptor:
+			return true
+		case <-options.ctx.Done():
+			return false
+		}
+	}
+
+	sortBuffer := make([]DataDescriptor, 0)
+
+	emit := func(descriptor DataDescriptor) bool {
+		if !options.matches(descriptor.Directory()) {
+			return true
+		}
+
+		if options.sorted {
+			sortBuffer = append(sortBuffer, descriptor)
+			return options.ctx.Err() == nil
+		}
+
+		return send(descriptor)
+	}
+
+	emitError := func(err error) bool {
+		select {
+		case errorChannel <- err:
+			return true
+		case <-options.ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(readChannel)
+		defer close(errorChannel)
+
+		read(emit, emitError)
+
+		if !options.sorted {
+			return
+		}
+
+		sort.SliceStable(sortBuffer, func(i, j int) bool {
+			if sortBuffer[i].Directory() != sortBuffer[j].Directory() {
+				return sortBuffer[i].Directory() < sortBuffer[j].Directory()
+			}
+			return sortBuffer[i].Name() < sortBuffer[j].Name()
+		})
+
+		for _, descriptor := range sortBuffer {
+			if !send(descriptor) {
+				return
+			}
+		}
+	}()
+
+	return prefetch(options, readChannel), errorChannel
+}
+
+// prefetch reads the content of all the data descriptors from the input
+// channel in parallel with the number of workers from the options and passes
+// descriptors with already read content to the returned channel, keeping
+// their order. If prefetching is disabled, the input channel is returned.
+func prefetch(
+	options *readOptions,
+	input <-chan DataDescriptor,
+) <-chan DataDescriptor {
+	if options.workers <= 0 {
+		return input
+	}
+
+	output := make(chan DataDescriptor)
+
+	// each pending descriptor has its own result channel; the number of
+	// descriptors being read at once is bounded by the buffer size and the
+	// one result awaited by the output goroutine
+	pending := make(chan chan DataDescriptor, options.workers-1)
+
+	go func() {
+		defer close(pending)
+
+		for descriptor := range input {
+			result := make(chan DataDescriptor, 1)
+
+			select {
+			case pending <- result:
+			case <-options.ctx.Done():
+				return
+			}
+
+			go func(descriptor DataDescriptor) {
+				content, err := descriptor.Content()
+
+				result <- &dataDescriptor{
+					name:      descriptor.Name(),
+					directory: descriptor.Directory(),
+					readFunc: func() ([]byte, error) {
+						if err != nil {
+							return nil, err
+						}
+						return copyBytes(content), nil
+					},
+				}
+			}(descriptor)
+		}
+	}()
+
+	go func() {
+		defer close(output)
+
+		for result := range pending {
+			descriptor := <-result
+
+			select {
+			case output <- descriptor:
+			case <-options.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return output
+}
@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadAllOptions(t *testing.T) {
+	var handles = map[string]func(t *testing.T) (Handle, func()){
+		"memory": func(t *testing.T) (Handle, func()) {
+			return NewMemoryHandle(), func() {}
+		},
+		"disk": newTestDiskHandle,
+		"bolt": newTestBoltHandle,
+		"encrypted": func(t *testing.T) (Handle, func()) {
+			handle, cleanup := newTestDiskHandle(t)
+			return NewEncryptedPersistence(handle, accountPassword), cleanup
+		},
+	}
+
+	var tests = map[string]struct {
+		options  []ReadOption
+		expected []string
+	}{
+		"sorted": {
+			options: []ReadOption{Sorted()},
+			expected: []string{
+				"alpha-1/a", "alpha-1/b", "alpha-2/a", "beta/a", "beta/c",
+			},
+		},
+		"prefix": {
+			options:  []ReadOption{WithDirectoryPrefix("alpha"), Sorted()},
+			expected: []string{"alpha-1/a", "alpha-1/b", "alpha-2/a"},
+		},
+		"workers": {
+			options: []ReadOption{WithWorkers(2), Sorted()},
+			expected: []string{
+				"alpha-1/a", "alpha-1/b", "alpha-2/a", "beta/a", "beta/c",
+			},
+		},
+		"no match": {
+			options:  []ReadOption{WithDirectoryPrefix("gamma")},
+			expected: []string{},
+		},
+	}
+
+	for handleName, newHandle := range handles {
+		for testName, test := range tests {
+			t.Run(fmt.Sprintf("%v/%v", handleName, testName), func(t *testing.T) {
+				handle, cleanup := newHandle(t)
+				defer cleanup()
+
+				for _, path := range []string{
+					"beta/c", "alpha-2/a", "beta/a", "alpha-1/b", "alpha-1/a",
+				} {
+					directory, name := path[:len(path)-2], path[len(path)-1:]
+
+					err := handle.Save([]byte(path), directory, name)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				descriptors, errors := readAllDescriptors(
+					handle.ReadAll(test.options...),
+				)
+				if len(errors) != 0 {
+					t.Fatal(errors)
+				}
+
+				actual := make([]string, 0)
+				for _, descriptor := range descriptors {
+					path := descriptor.Directory() + "/" + descriptor.Name()
+					actual = append(actual, path)
+
+					content, err := descriptor.Content()
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if !bytes.Equal([]byte(path), content) {
+						t.Errorf(
+							"unexpected content of [%v]\nexpected: [%v]\nactual:   [%v]",
+							path,
+							path,
+							string(content),
+						)
+					}
+				}
+
+				if !reflect.DeepEqual(test.expected, actual) {
+					t.Errorf(
+						"unexpected data read\nexpected: [%v]\nactual:   [%v]",
+						test.expected,
+						actual,
+					)
+				}
+			})
+		}
+	}
+}
+
+func TestReadAllOptions_Cancel(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		err := handle.Save([]byte{byte(i)}, dirName1, fmt.Sprintf("file%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+
+	dataChannel, errorChannel := handle.ReadAll(
+		WithContext(ctx),
+		WithWorkers(2),
+	)
+
+	<-dataChannel
+	cancelCtx()
+
+	done := make(chan struct{})
+	go func() {
+		readAllDescriptors(dataChannel, errorChannel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channels have not been closed after cancellation")
+	}
+}
+
+func TestDiskPersistence_ReadAllFromMissingDirectory(t *testing.T) {
+	descriptors, errors := readAllDescriptors(
+		readAll("./non-existing", newReadOptions(nil), nil),
+	)
+
+	if len(descriptors) != 0 {
+		t.Errorf("expected no data; has [%v]", len(descriptors))
+	}
+
+	if len(errors) != 1 {
+		t.Errorf("expected one error; has [%v]", len(errors))
+	}
+}
@@ -0,0 +1,120 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotDescriptor is an interface representing a snapshot of data saved
+// in the persistence layer represented by Handle.
+type SnapshotDescriptor interface {
+	DataDescriptor
+	Timestamp() time.Time
+}
+
+// SnapshotRetentionPolicy determines which snapshots should be kept in the
+// persistence layer and which could be pruned. Snapshots violating any of
+// the configured rules are pruned.
+type SnapshotRetentionPolicy struct {
+	// KeepLast specifies the number of the most recent snapshots kept for
+	// each name in each directory; should be ignored if set to 0.
+	KeepLast int
+	// MaxAge specifies the age after which a snapshot is pruned; should be
+	// ignored if set to 0.
+	MaxAge time.Duration
+}
+
+var errNoRetentionPolicy = fmt.Errorf("snapshot retention policy not provided")
+
+// retains determines whether the snapshot taken at the given time should be
+// kept. Position is the position of the snapshot among all snapshots taken
+// for the same name in the same directory, counting from the most recent one
+// which has the position 0.
+func (srp *SnapshotRetentionPolicy) retains(
+	position int,
+	timestamp time.Time,
+	now time.Time,
+) bool {
+	if srp.KeepLast > 0 && position >= srp.KeepLast {
+		return false
+	}
+
+	if srp.MaxAge > 0 && now.Sub(timestamp) > srp.MaxAge {
+		return false
+	}
+
+	return true
+}
+
+// PruneSnapshotsPeriodically triggers a cyclic process pruning snapshots
+// from the provided handle according to the given retention policy. The first
+// pruning is executed immediately. The process stops when the context is done.
+// An error is returned if the policy is not provided or the tick is not
+// positive.
+func PruneSnapshotsPeriodically(
+	ctx context.Context,
+	handle Handle,
+	policy *SnapshotRetentionPolicy,
+	tick time.Duration,
+) error {
+	if policy == nil {
+		return errNoRetentionPolicy
+	}
+
+	if tick <= 0 {
+		return fmt.Errorf("pruning tick must be positive; has [%v]", tick)
+	}
+
+	prune := func() {
+		if err := handle.PruneSnapshots(policy); err != nil {
+			logger.Errorf("could not prune snapshots: [%v]", err)
+		}
+	}
+
+	go func() {
+		prune() // execute the first pruning immediately
+
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				prune()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// snapshotSuffix returns the suffix identifying the snapshot taken at the
+// given time.
+func snapshotSuffix(timestamp time.Time) string {
+	return "." + strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// parseSnapshotFileName splits the name of the snapshot file into the name
+// of the data snapshotted and the time the snapshot was taken at. The last
+// returned value is false if the snapshot file name does not carry the
+// timestamp.
+func parseSnapshotFileName(fileName string) (string, time.Time, bool) {
+	separatorIndex := strings.LastIndex(fileName, ".")
+	if separatorIndex < 0 {
+		return "", time.Time{}, false
+	}
+
+	milliseconds, err := strconv.ParseInt(fileName[separatorIndex+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	timestamp := time.Unix(0, milliseconds*int64(time.Millisecond))
+
+	return fileName[:separatorIndex], timestamp, true
+}
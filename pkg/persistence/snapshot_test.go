@@ -0,0 +1,208 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRetentionPolicy(t *testing.T) {
+	now := time.Now()
+
+	var tests = map[string]struct {
+		policy           *SnapshotRetentionPolicy
+		position         int
+		age              time.Duration
+		expectedRetained bool
+	}{
+		"empty policy": {
+			policy:           &SnapshotRetentionPolicy{},
+			position:         100,
+			age:              1000 * time.Hour,
+			expectedRetained: true,
+		},
+		"within keep last limit": {
+			policy:           &SnapshotRetentionPolicy{KeepLast: 3},
+			position:         2,
+			expectedRetained: true,
+		},
+		"exceeds keep last limit": {
+			policy:           &SnapshotRetentionPolicy{KeepLast: 3},
+			position:         3,
+			expectedRetained: false,
+		},
+		"within max age": {
+			policy:           &SnapshotRetentionPolicy{MaxAge: time.Hour},
+			age:              59 * time.Minute,
+			expectedRetained: true,
+		},
+		"exceeds max age": {
+			policy:           &SnapshotRetentionPolicy{MaxAge: time.Hour},
+			age:              61 * time.Minute,
+			expectedRetained: false,
+		},
+		"exceeds max age within keep last limit": {
+			policy: &SnapshotRetentionPolicy{
+				KeepLast: 3,
+				MaxAge:   time.Hour,
+			},
+			position:         0,
+			age:              61 * time.Minute,
+			expectedRetained: false,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			retained := test.policy.retains(
+				test.position,
+				now.Add(-test.age),
+				now,
+			)
+
+			if test.expectedRetained != retained {
+				t.Errorf(
+					"unexpected result\nexpected: [%v]\nactual:   [%v]",
+					test.expectedRetained,
+					retained,
+				)
+			}
+		})
+	}
+}
+
+func TestParseSnapshotFileName(t *testing.T) {
+	var tests = map[string]struct {
+		fileName          string
+		expectedName      string
+		expectedTimestamp time.Time
+		expectedOk        bool
+	}{
+		"with timestamp": {
+			fileName:          "file11.1583837153000",
+			expectedName:      "file11",
+			expectedTimestamp: time.Unix(1583837153, 0),
+			expectedOk:        true,
+		},
+		"with dot in name": {
+			fileName:          "file.11.1583837153000",
+			expectedName:      "file.11",
+			expectedTimestamp: time.Unix(1583837153, 0),
+			expectedOk:        true,
+		},
+		"without timestamp": {
+			fileName:   "file11.suffix",
+			expectedOk: false,
+		},
+		"without suffix": {
+			fileName:   "file11",
+			expectedOk: false,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			name, timestamp, ok := parseSnapshotFileName(test.fileName)
+
+			if test.expectedOk != ok {
+				t.Fatalf(
+					"unexpected result\nexpected: [%v]\nactual:   [%v]",
+					test.expectedOk,
+					ok,
+				)
+			}
+
+			if test.expectedName != name {
+				t.Errorf(
+					"unexpected name\nexpected: [%v]\nactual:   [%v]",
+					test.expectedName,
+					name,
+				)
+			}
+
+			if !test.expectedTimestamp.Equal(timestamp) {
+				t.Errorf(
+					"unexpected timestamp\nexpected: [%v]\nactual:   [%v]",
+					test.expectedTimestamp,
+					timestamp,
+				)
+			}
+		})
+	}
+}
+
+func TestPruneSnapshotsPeriodically_InvalidInput(t *testing.T) {
+	var tests = map[string]struct {
+		policy        *SnapshotRetentionPolicy
+		tick          time.Duration
+		expectedError error
+	}{
+		"no policy": {
+			policy:        nil,
+			tick:          time.Minute,
+			expectedError: errNoRetentionPolicy,
+		},
+		"zero tick": {
+			policy: &SnapshotRetentionPolicy{KeepLast: 1},
+			tick:   0,
+			expectedError: fmt.Errorf(
+				"pruning tick must be positive; has [0s]",
+			),
+		},
+		"negative tick": {
+			policy: &SnapshotRetentionPolicy{KeepLast: 1},
+			tick:   -time.Minute,
+			expectedError: fmt.Errorf(
+				"pruning tick must be positive; has [-1m0s]",
+			),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			err := PruneSnapshotsPeriodically(
+				ctx,
+				NewMemoryHandle(),
+				test.policy,
+				test.tick,
+			)
+			if !reflect.DeepEqual(test.expectedError, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					test.expectedError,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestPruneSnapshots_NoPolicy(t *testing.T) {
+	diskHandle, diskCleanup := newTestDiskHandle(t)
+	defer diskCleanup()
+
+	boltHandle, boltCleanup := newTestBoltHandle(t)
+	defer boltCleanup()
+
+	for handleName, handle := range map[string]Handle{
+		"memory": NewMemoryHandle(),
+		"disk":   diskHandle,
+		"bolt":   boltHandle,
+	} {
+		err := handle.PruneSnapshots(nil)
+		if !reflect.DeepEqual(errNoRetentionPolicy, err) {
+			t.Errorf(
+				"unexpected error for [%v] handle\n"+
+					"expected: [%v]\nactual:   [%v]",
+				handleName,
+				errNoRetentionPolicy,
+				err,
+			)
+		}
+	}
+}
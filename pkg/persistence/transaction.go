@@ -0,0 +1,125 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Transaction groups saves of multiple pieces of data so that either all of
+// them become visible as non-archived data or none of them does.
+type Transaction interface {
+	// Save stages the provided data to be persisted under the given name in
+	// the provided directory once the transaction is committed. Staged data
+	// is not returned from any read function before the commit.
+	Save(data []byte, directory string, name string) error
+
+	// Commit persists all the data staged in the transaction. Once Commit
+	// returns with no error, all the data is visible. If Commit returns an
+	// error, none of the data is visible unless the error says the
+	// transaction is completed once the handle is created again. If the
+	// process crashes in the middle of the commit, all the data becomes
+	// visible once the handle is created again. Read and List never observe
+	// only a part of the committed data. ReadAll lists either all or none of
+	// the data but reads their content only when requested, so the content
+	// may reflect transactions committed after the data has been listed.
+	Commit() error
+
+	// Rollback discards all the data staged in the transaction.
+	Rollback() error
+}
+
+var errTransactionFinished = fmt.Errorf(
+	"transaction has already been committed or rolled back",
+)
+
+// stagedData is a piece of data staged in the transaction.
+type stagedData struct {
+	directory string
+	name      string
+	data      []byte
+}
+
+// bufferedTransaction keeps the data staged in the transaction in memory and
+// passes all of them at once to the commit function. It is used by handles
+// able to persist multiple pieces of data atomically on their own.
+type bufferedTransaction struct {
+	mutex    sync.Mutex
+	staged   []*stagedData
+	finished bool
+
+	commitFunc func(staged []*stagedData) error
+}
+
+func newBufferedTransaction(
+	commitFunc func(staged []*stagedData) error,
+) *bufferedTransaction {
+	return &bufferedTransaction{
+		staged:     make([]*stagedData, 0),
+		commitFunc: commitFunc,
+	}
+}
+
+func (bt *bufferedTransaction) Save(
+	data []byte,
+	directory string,
+	name string,
+) error {
+	err := validateDirectoryName(directory)
+	if err != nil {
+		return err
+	}
+
+	err = validateFileName(name)
+	if err != nil {
+		return err
+	}
+
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.finished {
+		return errTransactionFinished
+	}
+
+	for _, staged := range bt.staged {
+		if staged.directory == directory && staged.name == name {
+			staged.data = copyBytes(data)
+			return nil
+		}
+	}
+
+	bt.staged = append(bt.staged, &stagedData{
+		directory: directory,
+		name:      name,
+		data:      copyBytes(data),
+	})
+
+	return nil
+}
+
+func (bt *bufferedTransaction) Commit() error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.finished {
+		return errTransactionFinished
+	}
+
+	bt.finished = true
+
+	return bt.commitFunc(bt.staged)
+}
+
+func (bt *bufferedTransaction) Rollback() error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	if bt.finished {
+		return errTransactionFinished
+	}
+
+	bt.finished = true
+	bt.staged = nil
+
+	return nil
+}
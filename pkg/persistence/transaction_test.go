@@ -0,0 +1,547 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	var tests = map[string]struct {
+		newHandle func(t *testing.T) (Handle, func())
+	}{
+		"memory": {
+			newHandle: func(t *testing.T) (Handle, func()) {
+				return NewMemoryHandle(), func() {}
+			},
+		},
+		"disk": {
+			newHandle: newTestDiskHandle,
+		},
+		"bolt": {
+			newHandle: newTestBoltHandle,
+		},
+		"encrypted": {
+			newHandle: func(t *testing.T) (Handle, func()) {
+				handle, cleanup := newTestDiskHandle(t)
+				return NewEncryptedPersistence(handle, accountPassword), cleanup
+			},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			handle, cleanup := test.newHandle(t)
+			defer cleanup()
+
+			err := handle.Save([]byte{1}, dirName1, fileName11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			transaction, err := handle.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = transaction.Save([]byte{2}, dirName1, fileName11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = transaction.Save([]byte{3}, dirName1, fileName12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = transaction.Save([]byte{4}, dirName2, fileName21)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// staged data is not visible before the commit
+			assertTransactionData(t, handle, map[string]map[string][]byte{
+				dirName1: {fileName11: {1}},
+			})
+
+			err = transaction.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertTransactionData(t, handle, map[string]map[string][]byte{
+				dirName1: {fileName11: {2}, fileName12: {3}},
+				dirName2: {fileName21: {4}},
+			})
+
+			err = transaction.Save([]byte{5}, dirName1, fileName11)
+			if !reflect.DeepEqual(errTransactionFinished, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					errTransactionFinished,
+					err,
+				)
+			}
+
+			transaction, err = handle.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = transaction.Save([]byte{6}, dirName1, fileName11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = transaction.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertTransactionData(t, handle, map[string]map[string][]byte{
+				dirName1: {fileName11: {2}, fileName12: {3}},
+				dirName2: {fileName21: {4}},
+			})
+
+			err = transaction.Commit()
+			if !reflect.DeepEqual(errTransactionFinished, err) {
+				t.Fatalf(
+					"unexpected error\nexpected: [%v]\nactual:   [%v]",
+					errTransactionFinished,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestTransaction_RefuseSave(t *testing.T) {
+	transaction, err := NewMemoryHandle().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{1}, notAllowedName, fileName11)
+	if !reflect.DeepEqual(errDirectoryNameLength, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			errDirectoryNameLength,
+			err,
+		)
+	}
+
+	err = transaction.Save([]byte{1}, dirName1, notAllowedName)
+	if !reflect.DeepEqual(errFileNameLength, err) {
+		t.Fatalf(
+			"unexpected error\nexpected: [%v]\nactual:   [%v]",
+			errFileNameLength,
+			err,
+		)
+	}
+}
+
+func TestDiskTransaction_RecoverCommitted(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	transaction, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{2}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash right after the transaction has been marked as
+	// committed and one of the files has been applied
+	diskTransaction := transaction.(*diskTransaction)
+
+	err = write(
+		fmt.Sprintf("%s/%s", diskTransaction.path, transactionCommitMarker),
+		[]byte{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentPath := fmt.Sprintf(
+		"%s/%s",
+		handle.(*diskPersistence).dataDir,
+		currentDir,
+	)
+
+	err = ensureDirectoryExists(currentPath, dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(
+		fmt.Sprintf(
+			"%s/%s/%s/%s",
+			diskTransaction.path,
+			transactionDataDir,
+			dirName1,
+			fileName11,
+		),
+		fmt.Sprintf("%s/%s/%s", currentPath, dirName1, fileName11),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handle of the crashed process does not hold the lock anymore
+	handle.(io.Closer).Close()
+
+	recovered, err := NewDiskHandle(handle.(*diskPersistence).dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.(io.Closer).Close()
+
+	assertTransactionData(t, recovered, map[string]map[string][]byte{
+		dirName1: {fileName11: {1}, fileName12: {2}},
+	})
+
+	assertEmptyJournal(t, recovered)
+}
+
+func TestDiskTransaction_DiscardUncommitted(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	transaction, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash before the transaction has been committed; the handle
+	// of the crashed process does not hold the lock anymore
+	handle.(io.Closer).Close()
+
+	recovered, err := NewDiskHandle(handle.(*diskPersistence).dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.(io.Closer).Close()
+
+	assertTransactionData(t, recovered, map[string]map[string][]byte{})
+
+	assertEmptyJournal(t, recovered)
+
+	if usage := recovered.(*diskPersistence).usage.total(); usage != 0 {
+		t.Fatalf("expected no usage; has [%v]", usage)
+	}
+}
+
+func TestDiskTransaction_KeepInFlightForOtherHandles(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	transaction, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction in flight is not mistaken for the one interrupted by
+	// a crash by another handle of the same process
+	other, err := NewDiskHandle(handle.(*diskPersistence).dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.(io.Closer).Close()
+
+	err = transaction.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTransactionData(t, other, map[string]map[string][]byte{
+		dirName1: {fileName11: {1}},
+	})
+}
+
+func TestDiskTransaction_DiscardOnCommitFailure(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	transaction, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a non-empty directory in place of the commit marker makes writing
+	// the marker fail
+	markerPath := fmt.Sprintf(
+		"%s/%s",
+		transaction.(*diskTransaction).path,
+		transactionCommitMarker,
+	)
+	err = os.MkdirAll(fmt.Sprintf("%s/%s", markerPath, dirName1), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	assertTransactionData(t, handle, map[string]map[string][]byte{})
+
+	assertEmptyJournal(t, handle)
+
+	if usage := handle.(*diskPersistence).usage.total(); usage != 0 {
+		t.Fatalf("expected no usage; has [%v]", usage)
+	}
+}
+
+func TestDiskTransaction_RollbackOnApplyFailure(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	err := handle.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := handle.(*diskPersistence)
+	usageBefore := ds.usage.total()
+
+	transaction, err := handle.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Save([]byte{2}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.Save([]byte{3}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.Save([]byte{4}, dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file in place of the directory makes applying the transaction fail
+	// once the data of the first directory have already been applied
+	err = ioutil.WriteFile(
+		fmt.Sprintf("%s/%s/%s", ds.dataDir, currentDir, dirName2),
+		[]byte{},
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transaction.Commit()
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	data, err := handle.Read(dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{1}, data) {
+		t.Fatalf(
+			"unexpected data\nexpected: [%v]\nactual:   [%v]",
+			[]byte{1},
+			data,
+		)
+	}
+
+	names, err := handle.List(dirName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{fileName11}, names) {
+		t.Fatalf("only [%v] should be in the directory; has [%v]", fileName11, names)
+	}
+
+	assertEmptyJournal(t, handle)
+
+	// the space reserved for the staged data is released
+	if usage := ds.usage.total(); usage != usageBefore {
+		t.Fatalf(
+			"unexpected usage\nexpected: [%v]\nactual:   [%v]",
+			usageBefore,
+			usage,
+		)
+	}
+}
+
+func TestDiskTransaction_ReadersWaitForApply(t *testing.T) {
+	handle, cleanup := newTestDiskHandle(t)
+	defer cleanup()
+
+	err := handle.Save([]byte{1}, dirName1, fileName11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handle.Save([]byte{2}, dirName1, fileName12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handle.Save([]byte{3}, dirName2, fileName21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := handle.(*diskPersistence)
+
+	// simulate the transaction being applied
+	ds.transactionMutex.Lock()
+
+	var tests = map[string]func() error{
+		"read": func() error {
+			_, err := handle.Read(dirName1, fileName11)
+			return err
+		},
+		"list": func() error {
+			_, err := handle.List(dirName1)
+			return err
+		},
+		"read all": func() error {
+			_, errors := readAllDescriptors(handle.ReadAll())
+			if len(errors) > 0 {
+				return errors[0]
+			}
+			return nil
+		},
+		"delete": func() error {
+			return handle.Delete(dirName1, fileName12)
+		},
+		"archive": func() error {
+			return handle.Archive(dirName2)
+		},
+	}
+
+	done := make(chan string, len(tests))
+	for testName, read := range tests {
+		go func(testName string, read func() error) {
+			if err := read(); err != nil {
+				t.Error(err)
+			}
+			done <- testName
+		}(testName, read)
+	}
+
+	select {
+	case testName := <-done:
+		ds.transactionMutex.Unlock()
+		t.Fatalf("[%v] has not waited for the transaction", testName)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ds.transactionMutex.Unlock()
+
+	for range tests {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("readers have not completed after the transaction")
+		}
+	}
+}
+
+func newTestDiskHandle(t *testing.T) (Handle, func()) {
+	dataDir := newTestDataDir(t)
+
+	handle, err := NewDiskHandle(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handle, func() {
+		handle.(io.Closer).Close()
+		os.RemoveAll(dataDir)
+	}
+}
+
+func assertTransactionData(
+	t *testing.T,
+	handle Handle,
+	expected map[string]map[string][]byte,
+) {
+	for _, directory := range []string{dirName1, dirName2} {
+		names, err := handle.List(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(names) != len(expected[directory]) {
+			t.Fatalf(
+				"unexpected number of files in directory [%v]\n"+
+					"expected: [%v]\nactual:   [%v]",
+				directory,
+				len(expected[directory]),
+				len(names),
+			)
+		}
+
+		for name, expectedData := range expected[directory] {
+			data, err := handle.Read(directory, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(expectedData, data) {
+				t.Errorf(
+					"unexpected data of [%v] in directory [%v]\n"+
+						"expected: [%v]\nactual:   [%v]",
+					name,
+					directory,
+					expectedData,
+					data,
+				)
+			}
+		}
+	}
+}
+
+func assertEmptyJournal(t *testing.T, handle Handle) {
+	journalPath := fmt.Sprintf(
+		"%s/%s",
+		handle.(*diskPersistence).dataDir,
+		journalDir,
+	)
+
+	transactions, err := ioutil.ReadDir(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 0 {
+		t.Fatalf("expected empty journal; has [%v] transactions", len(transactions))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keep-network/keep-common/pkg/persistence"
+)
+
+// Main function. Expects to be invoked as:
+//
+//	<executable> -data-dir <disk data directory> -store <bbolt store file>
+//
+// Imports all the data kept by the on-disk persistence handle in the given
+// data directory into the bbolt-backed persistence handle kept in the given
+// store file. The data directory is locked for the time of the migration so
+// the node using it has to be stopped first. Apart from its lock file, the
+// data directory is not modified so it can be removed once the node is
+// confirmed to work correctly with the new store. The migration can be
+// safely repeated if it has been interrupted.
+func main() {
+	dataDir := flag.String(
+		"data-dir",
+		"",
+		"The data directory of the on-disk persistence handle.",
+	)
+	storePath := flag.String(
+		"store",
+		"",
+		"The path of the bbolt store file the data should be imported to.",
+	)
+
+	flag.Parse()
+
+	if *dataDir == "" || *storePath == "" {
+		fmt.Fprintf(
+			os.Stderr,
+			"Expected `%v -data-dir <data directory> -store <store file>`.\n",
+			os.Args[0],
+		)
+		os.Exit(1)
+	}
+
+	err := persistence.MigrateDiskToBolt(*dataDir, *storePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: [%v].\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Data from [%v] imported to [%v].\n", *dataDir, *storePath)
+}